@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"metrics-agent/internal/agent"
+	"metrics-agent/internal/collector"
 	"metrics-agent/internal/config"
+	"metrics-agent/internal/statsd"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -19,28 +24,104 @@ func main() {
 		return
 	}
 
-	const (
-		proto = "http://"
-		path  = "/updates/"
-	)
-	url := proto + cfg.Addr + path
+	if cfg.PollInterval <= 0 || cfg.ReportInterval <= 0 {
+		log.Printf("Poll and report intervals must be positive, got %d and %d\n", cfg.PollInterval, cfg.ReportInterval)
+		return
+	}
+
+	// the metrics the server rejects do not hold back the rest of the batch
+	const path = "/updates/?mode=best-effort"
+	client, err := agent.NewClient(&cfg, path)
+	if err != nil {
+		log.Printf("Cannot set up HTTP client. Error:%v\n", err)
+		return
+	}
+
+	var queue *agent.Queue
+	if cfg.QueueDir != "" {
+		queue, err = agent.NewQueue(cfg.QueueDir, cfg.QueueMaxBytes, cfg.QueueMaxAge)
+		if err != nil {
+			log.Printf("Cannot open queue. Error:%v\n", err)
+			return
+		}
+		log.Printf("%d batches in queue\n", queue.Len())
+	}
 
-	for {
-		for i := 0; i < (cfg.ReportInterval / cfg.PollInterval); i++ {
+	collectors, err := collector.LoadConfig(cfg.Collectors)
+	if err != nil {
+		log.Printf("Cannot get collectors. Error:%v\n", err)
+		return
+	}
+	registry, err := collector.NewRegistry(collectors, cfg.CollectTimeout)
+	if err != nil {
+		log.Printf("Cannot set up collectors. Error:%v\n", err)
+		return
+	}
+	log.Printf("Collectors: %s\n", strings.Join(registry.Names(), ", "))
 
-			m, err := agent.GetMetrics(&cfg)
+	var relay *statsd.Server
+	if cfg.StatsdAddr != "" || cfg.StatsdTCPAddr != "" {
+		relay = statsd.New()
+		defer relay.Close()
+		if cfg.StatsdAddr != "" {
+			addr, err := relay.ListenUDP(cfg.StatsdAddr)
 			if err != nil {
-				log.Printf("Cannot get metrics: %v\n", err)
+				log.Printf("Cannot start StatsD listener. Error:%v\n", err)
+				return
 			}
-
-			if len(*m) != 0 {
-				err = agent.SendMetrics(url, m)
-				if err != nil {
-					log.Printf("Metric send failed. Error:%v\n", err)
-				}
+			log.Printf("StatsD on udp %s\n", addr)
+		}
+		if cfg.StatsdTCPAddr != "" {
+			addr, err := relay.ListenTCP(cfg.StatsdTCPAddr)
+			if err != nil {
+				log.Printf("Cannot start StatsD listener. Error:%v\n", err)
+				return
 			}
+			log.Printf("StatsD on tcp %s\n", addr)
+		}
+	}
+
+	// polls are aggregated, a batch per report interval is sent
+	agg := agent.NewAggregator(cfg.GaugeStats)
+	go func() {
+		poll := time.NewTicker(time.Duration(cfg.PollInterval) * time.Second)
+		defer poll.Stop()
+		for range poll.C {
+			agg.Add(registry.Collect(context.Background()))
+		}
+	}()
+
+	var filter *agent.ChangeFilter
+	if cfg.ChangedOnly {
+		filter = agent.NewChangeFilter(cfg.Resync)
+	}
 
-			time.Sleep(time.Duration(cfg.PollInterval) * time.Second)
+	report := time.NewTicker(time.Duration(cfg.ReportInterval) * time.Second)
+	defer report.Stop()
+	for range report.C {
+		batch := agg.Flush()
+		if relay != nil {
+			batch = append(batch, relay.Flush()...)
+		}
+		if filter != nil {
+			batch = filter.Filter(batch, time.Now())
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		if queue != nil {
+			batch = append(batch, agent.QueueDepth(queue))
+			err = queue.Deliver(batch, client.Send, time.Now())
+		} else {
+			err = client.Send(batch)
+		}
+		if err != nil {
+			log.Printf("Metric send failed. Error:%v\n", err)
+			// a queued batch reaches the server later, a lost one is sent again
+			if filter != nil && !errors.Is(err, agent.ErrQueued) {
+				filter.Reset()
+			}
 		}
 	}
 }
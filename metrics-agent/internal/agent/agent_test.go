@@ -34,7 +34,7 @@ func Test_SendMetric(t *testing.T) {
 			server := httptest.NewServer(handler)
 			defer server.Close()
 
-			gotErr := SendMetrics(server.URL, &[]*metrics.Metric{&randomValue})
+			gotErr := testClient(server).Send([]*metrics.Metric{&randomValue})
 			if gotErr != nil {
 				if !tt.wantErr {
 					t.Errorf("sendMetric() failed: %v", gotErr)
@@ -47,3 +47,23 @@ func Test_SendMetric(t *testing.T) {
 		})
 	}
 }
+
+func Test_SendMetricToken(t *testing.T) {
+	var got string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	rnd := rand.Float64()
+	m := []*metrics.Metric{{ID: "RandomValue", MType: "gauge", Value: &rnd}}
+	client := testClient(server)
+	client.Token = "secret"
+	if err := client.Send(m); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	if got != "Bearer secret" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer secret")
+	}
+}
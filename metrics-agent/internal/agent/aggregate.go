@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"metrics-agent/internal/metrics"
+	"sync"
+)
+
+// Suffixes of the gauges with statistics of a gauge over a report interval.
+const (
+	MinSuffix = "_min"
+	MaxSuffix = "_max"
+	AvgSuffix = "_avg"
+)
+
+// Aggregator accumulates polled metrics until they are reported: deltas of a
+// counter are summed, a gauge keeps its last value and, with Stats, its
+// minimum, maximum and average.
+type Aggregator struct {
+	Stats bool
+
+	mu       sync.Mutex
+	order    []string // IDs in order of the first poll
+	counters map[string]int64
+	gauges   map[string]*gaugeStats
+}
+
+type gaugeStats struct {
+	last, min, max, sum float64
+	n                   int
+}
+
+func NewAggregator(stats bool) *Aggregator {
+	return &Aggregator{
+		Stats:    stats,
+		counters: make(map[string]int64),
+		gauges:   make(map[string]*gaugeStats),
+	}
+}
+
+// Add accumulates a polled batch.
+func (a *Aggregator) Add(batch []*metrics.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, m := range batch {
+		switch {
+		case m.MType == "counter" && m.Delta != nil:
+			if _, ok := a.counters[m.ID]; !ok {
+				a.order = append(a.order, m.ID)
+			}
+			a.counters[m.ID] += *m.Delta
+		case m.MType == "gauge" && m.Value != nil:
+			v := *m.Value
+			g, ok := a.gauges[m.ID]
+			if !ok {
+				a.order = append(a.order, m.ID)
+				g = &gaugeStats{min: v, max: v}
+				a.gauges[m.ID] = g
+			}
+			g.last = v
+			g.min = min(g.min, v)
+			g.max = max(g.max, v)
+			g.sum += v
+			g.n++
+		}
+	}
+}
+
+// Flush returns the metrics accumulated since the previous flush and starts
+// a new interval.
+func (a *Aggregator) Flush() []*metrics.Metric {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	batch := make([]*metrics.Metric, 0, len(a.order))
+	for _, id := range a.order {
+		if delta, ok := a.counters[id]; ok {
+			batch = append(batch, &metrics.Metric{ID: id, MType: "counter", Delta: &delta})
+			continue
+		}
+		g := a.gauges[id]
+		batch = append(batch, newGauge(id, g.last))
+		if a.Stats {
+			batch = append(batch,
+				newGauge(id+MinSuffix, g.min),
+				newGauge(id+MaxSuffix, g.max),
+				newGauge(id+AvgSuffix, g.sum/float64(g.n)),
+			)
+		}
+	}
+
+	a.order = nil
+	clear(a.counters)
+	clear(a.gauges)
+	return batch
+}
+
+func newGauge(id string, value float64) *metrics.Metric {
+	return &metrics.Metric{ID: id, MType: "gauge", Value: &value}
+}
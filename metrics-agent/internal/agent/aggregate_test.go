@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"metrics-agent/internal/metrics"
+	"testing"
+)
+
+func Test_Aggregator(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats bool
+		want  map[string]float64
+	}{
+		{
+			name: "last values",
+			want: map[string]float64{"PollCount": 3, "Alloc": 2},
+		},
+		{
+			name:  "with statistics",
+			stats: true,
+			want: map[string]float64{
+				"PollCount": 3,
+				"Alloc":     2,
+				"Alloc_min": 1,
+				"Alloc_max": 6,
+				"Alloc_avg": 3,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAggregator(tt.stats)
+			for _, v := range []float64{1, 6, 2} {
+				a.Add([]*metrics.Metric{counter("PollCount", 1), gauge("Alloc", v)})
+			}
+
+			batch := a.Flush()
+			if len(batch) != len(tt.want) {
+				t.Fatalf("Flush() returned %d metrics, want %d", len(batch), len(tt.want))
+			}
+			if batch[0].ID != "PollCount" {
+				t.Errorf("first metric is %s, want the order of polls", batch[0].ID)
+			}
+			for _, m := range batch {
+				want, ok := tt.want[m.ID]
+				if !ok {
+					t.Errorf("unexpected metric %s", m.ID)
+					continue
+				}
+				var got float64
+				if m.MType == "counter" {
+					got = float64(*m.Delta)
+				} else {
+					got = *m.Value
+				}
+				if got != want {
+					t.Errorf("%s = %v, want %v", m.ID, got, want)
+				}
+			}
+
+			if rest := a.Flush(); len(rest) != 0 {
+				t.Errorf("second Flush() returned %d metrics, want a new interval", len(rest))
+			}
+		})
+	}
+}
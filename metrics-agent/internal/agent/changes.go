@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"math"
+	"metrics-agent/internal/metrics"
+	"time"
+)
+
+// ChangeFilter leaves out of batches the metrics the server already has:
+// gauges with the value sent last time and counters with zero delta. Every
+// Resync, and after Reset, a batch goes complete so a restarted server gets
+// everything back.
+type ChangeFilter struct {
+	Resync time.Duration
+
+	sent       map[string]uint64 // bits of the last sent gauge values
+	lastResync time.Time
+}
+
+func NewChangeFilter(resync time.Duration) *ChangeFilter {
+	return &ChangeFilter{
+		Resync: resync,
+		sent:   make(map[string]uint64),
+	}
+}
+
+// Filter returns the part of batch to send at now and takes it as sent.
+func (f *ChangeFilter) Filter(batch []*metrics.Metric, now time.Time) []*metrics.Metric {
+	full := f.lastResync.IsZero() || now.Sub(f.lastResync) >= f.Resync
+	if full {
+		f.lastResync = now
+	}
+
+	changed := make([]*metrics.Metric, 0, len(batch))
+	for _, m := range batch {
+		switch {
+		case m.MType == "counter" && m.Delta != nil:
+			if !full && *m.Delta == 0 {
+				continue
+			}
+		case m.MType == "gauge" && m.Value != nil:
+			// bits compare NaN equal to itself
+			bits := math.Float64bits(*m.Value)
+			if last, ok := f.sent[m.ID]; !full && ok && last == bits {
+				continue
+			}
+			f.sent[m.ID] = bits
+		}
+		changed = append(changed, m)
+	}
+	return changed
+}
+
+// Reset forgets what was sent, for a batch which did not reach the server.
+// The next batch is complete.
+func (f *ChangeFilter) Reset() {
+	clear(f.sent)
+	f.lastResync = time.Time{}
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"math"
+	"metrics-agent/internal/metrics"
+	"slices"
+	"testing"
+	"time"
+)
+
+func ids(batch []*metrics.Metric) []string {
+	var got []string
+	for _, m := range batch {
+		got = append(got, m.ID)
+	}
+	return got
+}
+
+func Test_ChangeFilter(t *testing.T) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	f := NewChangeFilter(5 * time.Minute)
+
+	steps := []struct {
+		name  string
+		at    time.Duration
+		reset bool
+		batch []*metrics.Metric
+		want  []string
+	}{
+		{
+			name:  "first batch is complete",
+			batch: []*metrics.Metric{counter("PollCount", 0), gauge("Alloc", 1), gauge("NumGC", 3), gauge("Bad", math.NaN())},
+			want:  []string{"PollCount", "Alloc", "NumGC", "Bad"},
+		},
+		{
+			name:  "only changes",
+			at:    time.Minute,
+			batch: []*metrics.Metric{counter("PollCount", 2), gauge("Alloc", 2), gauge("NumGC", 3), gauge("Bad", math.NaN())},
+			want:  []string{"PollCount", "Alloc"},
+		},
+		{
+			name:  "zero delta left out",
+			at:    2 * time.Minute,
+			batch: []*metrics.Metric{counter("PollCount", 0), gauge("Alloc", 2), gauge("NumGC", 3)},
+		},
+		{
+			name:  "resync",
+			at:    5 * time.Minute,
+			batch: []*metrics.Metric{counter("PollCount", 0), gauge("Alloc", 2), gauge("NumGC", 3)},
+			want:  []string{"PollCount", "Alloc", "NumGC"},
+		},
+		{
+			name:  "after resync",
+			at:    6 * time.Minute,
+			batch: []*metrics.Metric{counter("PollCount", 0), gauge("Alloc", 2), gauge("NumGC", 4)},
+			want:  []string{"NumGC"},
+		},
+		{
+			name:  "complete after reset",
+			at:    7 * time.Minute,
+			reset: true,
+			batch: []*metrics.Metric{counter("PollCount", 1), gauge("Alloc", 2), gauge("NumGC", 4)},
+			want:  []string{"PollCount", "Alloc", "NumGC"},
+		},
+	}
+	for _, s := range steps {
+		if s.reset {
+			f.Reset()
+		}
+		got := ids(f.Filter(s.batch, start.Add(s.at)))
+		if !slices.Equal(got, s.want) {
+			t.Errorf("%s: Filter() = %v, want %v", s.name, got, s.want)
+		}
+	}
+}
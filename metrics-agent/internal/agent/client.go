@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"metrics-agent/internal/config"
+	"metrics-agent/internal/metrics"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAttempts is how many times a batch is tried.
+	defaultAttempts = 4
+	// defaultBackoff is the wait after the first failure, doubled after
+	// every next one up to defaultMaxBackoff.
+	defaultBackoff    = time.Second
+	defaultMaxBackoff = 30 * time.Second
+	// maxRetryAfter caps the wait the server may ask for, so the agent
+	// keeps polling.
+	maxRetryAfter = time.Minute
+)
+
+// sleep is replaced in tests.
+var sleep = time.Sleep
+
+var errInvalidRequest = errors.New("cannot create request")
+
+// StatusError is an answer of the server other than 200 and 207.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server answered %d %s", e.StatusCode, e.Message)
+}
+
+// Temporary tells whether the request may succeed later: the server failed
+// or asked to slow down. Other errors are in the request itself.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Denied tells whether the server refused the credentials of the agent
+// rather than the batch, which may be sent once the key is fixed.
+func (e *StatusError) Denied() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// IsPermanent tells whether sending the batch again would not change err:
+// the server rejected it or the request cannot be made.
+func IsPermanent(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return !se.Temporary() && !se.Denied()
+	}
+	return errors.Is(err, errInvalidRequest)
+}
+
+// IsDenied tells whether the server refused the credentials of the agent,
+// retrying at once does not help, but the batch is worth keeping.
+func IsDenied(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Denied()
+}
+
+// Client sends batches of metrics to the server. It keeps connections
+// between batches and retries network errors, 5xx and 429 with jittered
+// exponential backoff, or as long as Retry-After tells.
+type Client struct {
+	HTTP       *http.Client
+	URL        string
+	Token      string // sent as a bearer token if set
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewClient returns the client to post batches to path on the server.
+func NewClient(cfg *config.Config, path string) (*Client, error) {
+	httpClient, err := NewHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	httpClient.Timeout = cfg.Timeout
+
+	return &Client{
+		HTTP:       httpClient,
+		URL:        ServerURL(cfg, path),
+		Token:      cfg.Token,
+		Attempts:   defaultAttempts,
+		Backoff:    defaultBackoff,
+		MaxBackoff: defaultMaxBackoff,
+	}, nil
+}
+
+// Send posts batch, gzipped. It returns the last error when no attempt
+// succeeds, a *StatusError for answers other than 200 and 207. A 207 means
+// the server took the batch but rejected some of its metrics, which are
+// not sent again.
+func (c *Client) Send(batch []*metrics.Metric) error {
+	jsonData, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("error in marshaller: %v", err)
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(jsonData); err != nil {
+		return fmt.Errorf("error gzipping data: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("error closing gzip writer: %v", err)
+	}
+
+	attempts := max(1, c.Attempts)
+	for attempt := 0; ; attempt++ {
+		wait, err := c.post(buf.Bytes())
+		if err == nil {
+			return nil
+		}
+		if IsPermanent(err) || IsDenied(err) {
+			return err
+		}
+		if attempt+1 == attempts {
+			return fmt.Errorf("%d attempts failed, last: %w", attempts, err)
+		}
+
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+		log.Printf("Error posting metrics: %v, retrying in %v\n", err, wait)
+		sleep(wait)
+	}
+}
+
+// post makes one attempt, the wait is what the server asked for with
+// Retry-After.
+func (c *Client) post(body []byte) (time.Duration, error) {
+	// a request consumes its body, every attempt gets a reader of its own
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// the rest of the body is read for the connection to be reused
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return 0, nil
+	case http.StatusMultiStatus:
+		log.Printf("Server rejected some metrics of the batch: %s\n", strings.TrimSpace(string(msg)))
+		return 0, nil
+	}
+
+	var wait time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait, _ = retryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	return wait, &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
+
+// backoff returns the wait after the failed attempt: Backoff doubled with
+// every attempt, capped at MaxBackoff, of which a random half is taken.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.Backoff << min(attempt, 30)
+	if c.MaxBackoff > 0 && (d > c.MaxBackoff || d <= 0) {
+		d = c.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryAfter returns the wait of a Retry-After header, in seconds or an
+// HTTP date, capped at maxRetryAfter.
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = max(0, date.Sub(now))
+	} else {
+		return 0, false
+	}
+	return min(wait, maxRetryAfter), true
+}
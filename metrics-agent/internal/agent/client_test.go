@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"metrics-agent/internal/config"
+	"metrics-agent/internal/metrics"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClient returns a client of server which does not wait between
+// attempts.
+func testClient(server *httptest.Server) *Client {
+	return &Client{
+		HTTP:     server.Client(),
+		URL:      server.URL,
+		Attempts: 3,
+	}
+}
+
+// noSleep records the waits of the client instead of sleeping.
+func noSleep(t *testing.T) *[]time.Duration {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	t.Cleanup(func() { sleep = time.Sleep })
+	return &slept
+}
+
+func Test_ClientSend(t *testing.T) {
+	tests := []struct {
+		name         string
+		codes        []int // answers to the attempts, 200 after them
+		retryAfter   string
+		wantErr      bool
+		wantPerm     bool
+		wantRequests int
+	}{
+		{name: "success", wantRequests: 1},
+		{name: "5xx retried", codes: []int{500, 503}, wantRequests: 3},
+		{name: "429 retried", codes: []int{429}, retryAfter: "1", wantRequests: 2},
+		{name: "5xx until attempts end", codes: []int{502, 502, 502, 502}, wantErr: true, wantRequests: 3},
+		{name: "400 not retried", codes: []int{400}, wantErr: true, wantPerm: true, wantRequests: 1},
+		{name: "207 taken", codes: []int{207}, wantRequests: 1},
+		{name: "401 not retried, kept", codes: []int{401}, wantErr: true, wantRequests: 1},
+		{name: "403 not retried, kept", codes: []int{403}, wantErr: true, wantRequests: 1},
+		{name: "404 after 5xx", codes: []int{500, 404}, wantErr: true, wantPerm: true, wantRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			noSleep(t)
+
+			var requests int
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Errorf("request body is not gzipped: %v", err)
+					return
+				}
+				var m []*metrics.Metric
+				if err := json.NewDecoder(gr).Decode(&m); err != nil || len(m) != 1 {
+					t.Errorf("request %d has body %v, %v, want the batch every time", requests, m, err)
+				}
+
+				requests++
+				if requests <= len(tt.codes) {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					http.Error(w, "failure", tt.codes[requests-1])
+				}
+			})
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			rnd := 1.5
+			err := testClient(server).Send([]*metrics.Metric{{ID: "RandomValue", MType: "gauge", Value: &rnd}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if IsPermanent(err) != tt.wantPerm {
+				t.Errorf("IsPermanent(%v) = %v, want %v", err, IsPermanent(err), tt.wantPerm)
+			}
+			var se *StatusError
+			if tt.wantErr && !errors.As(err, &se) {
+				t.Errorf("Send() error = %v, want a *StatusError", err)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("got %d requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func Test_ClientRetryAfter(t *testing.T) {
+	slept := noSleep(t)
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	client := testClient(server)
+	client.Backoff = time.Second
+	rnd := 1.5
+	if err := client.Send([]*metrics.Metric{{ID: "RandomValue", MType: "gauge", Value: &rnd}}); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	if len(*slept) != 1 || (*slept)[0] != 7*time.Second {
+		t.Errorf("slept %v, want Retry-After of 7s over the backoff", *slept)
+	}
+}
+
+func Test_ClientNetworkError(t *testing.T) {
+	slept := noSleep(t)
+
+	// a listener which is closed right away, nothing answers on its port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	client := &Client{HTTP: &http.Client{}, URL: "http://" + addr + "/updates/", Attempts: 3, Backoff: time.Second, MaxBackoff: 3 * time.Second}
+	rnd := 1.5
+	err = client.Send([]*metrics.Metric{{ID: "RandomValue", MType: "gauge", Value: &rnd}})
+	if err == nil || IsPermanent(err) {
+		t.Fatalf("Send() error = %v, want a temporary error", err)
+	}
+	if len(*slept) != 2 {
+		t.Fatalf("slept %d times, want 2", len(*slept))
+	}
+	// jittered exponential backoff: half to the whole of 1s, then of 2s
+	for i, d := range *slept {
+		base := time.Second << i
+		if d < base/2 || d > base {
+			t.Errorf("wait %d is %v, want within [%v, %v]", i, d, base/2, base)
+		}
+	}
+}
+
+func Test_ClientTimeout(t *testing.T) {
+	noSleep(t)
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			<-release
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := NewClient(&config.Config{Addr: server.Listener.Addr().String(), Timeout: 100 * time.Millisecond}, "/updates/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := 1.5
+	if err := client.Send([]*metrics.Metric{{ID: "RandomValue", MType: "gauge", Value: &rnd}}); err != nil {
+		t.Fatalf("Send() failed: %v, a timed out request is retried", err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("got %d requests, want 2", requests.Load())
+	}
+}
+
+func Test_ClientReusesConnection(t *testing.T) {
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad metric", http.StatusBadRequest)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client, err := NewClient(&config.Config{Addr: server.Listener.Addr().String(), Timeout: time.Second}, "/updates/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := 1.5
+	for i := 0; i < 3; i++ {
+		client.Send([]*metrics.Metric{{ID: "RandomValue", MType: "gauge", Value: &rnd}})
+	}
+	if conns.Load() != 1 {
+		t.Errorf("%d connections for 3 batches, want 1", conns.Load())
+	}
+}
+
+func Test_ClientBackoffCap(t *testing.T) {
+	c := &Client{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt := 0; attempt < 40; attempt++ {
+		if d := c.backoff(attempt); d > 5*time.Second || d < 0 {
+			t.Errorf("backoff(%d) = %v, want within the cap", attempt, d)
+		}
+	}
+}
+
+func Test_retryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "absent"},
+		{name: "seconds", header: "5", want: 5 * time.Second, wantOK: true},
+		{name: "capped", header: "3600", want: maxRetryAfter, wantOK: true},
+		{name: "date", header: now.Add(10 * time.Second).Format(http.TimeFormat), want: 10 * time.Second, wantOK: true},
+		{name: "past date", header: now.Add(-time.Hour).Format(http.TimeFormat), want: 0, wantOK: true},
+		{name: "negative", header: "-1"},
+		{name: "garbage", header: "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := retryAfter(tt.header, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("retryAfter(%q) = %v, %v, want %v, %v", tt.header, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
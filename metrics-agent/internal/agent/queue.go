@@ -0,0 +1,287 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"metrics-agent/internal/metrics"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const queueExt = ".json"
+
+// ErrQueued tells that a batch is not sent yet, but is queued to be sent.
+var ErrQueued = errors.New("batch is queued")
+
+// Queue keeps the batches which could not be sent in a directory, a file per
+// batch, and replays them oldest first. The queue is bounded: batches older
+// than MaxAge are dropped, and when MaxBytes is reached a new batch is merged
+// into the newest one (counters are summed, gauges keep the last value), the
+// oldest batches go if that is not enough. Zero limits are no limits.
+type Queue struct {
+	Dir      string
+	MaxBytes int64
+	MaxAge   time.Duration
+
+	mu      sync.Mutex
+	entries []queueEntry
+	size    int64
+	last    int64
+}
+
+type queueEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// NewQueue opens the queue in dir, batches left by a previous run are kept.
+func NewQueue(dir string, maxBytes int64, maxAge time.Duration) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cannot create queue directory: %v", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read queue directory: %v", err)
+	}
+
+	q := &Queue{Dir: dir, MaxBytes: maxBytes, MaxAge: maxAge}
+	// names are zero padded sequence numbers, ReadDir sorts them in order
+	for _, f := range files {
+		seq, ok := queueSeq(f.Name())
+		if !ok || f.IsDir() {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read queue directory: %v", err)
+		}
+		q.entries = append(q.entries, queueEntry{name: f.Name(), size: info.Size(), modTime: info.ModTime()})
+		q.size += info.Size()
+		q.last = seq
+	}
+	return q, nil
+}
+
+func queueSeq(name string) (int64, bool) {
+	base, ok := strings.CutSuffix(name, queueExt)
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(base, 10, 64)
+	return seq, err == nil
+}
+
+// Len returns the number of queued batches.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Size returns the bytes taken by the queued batches.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// QueueDepth returns the gauge of the number of queued batches, sent along
+// with the metrics to watch the queue from the server.
+func QueueDepth(q *Queue) *metrics.Metric {
+	return newGauge("AgentQueueDepth", float64(q.Len()))
+}
+
+// Push queues batch after the others.
+func (q *Queue) Push(batch []*metrics.Metric, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(now)
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("error in marshaller: %v", err)
+	}
+
+	// a merged batch is as old as the oldest metrics in it
+	name, modTime := "", now
+	if q.full(len(data)) && len(q.entries) > 0 {
+		tail := q.entries[len(q.entries)-1]
+		queued, err := q.read(tail.name)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(mergeBatches(queued, batch)); err != nil {
+			return fmt.Errorf("error in marshaller: %v", err)
+		}
+		name, modTime = tail.name, tail.modTime
+		q.entries = q.entries[:len(q.entries)-1]
+		q.size -= tail.size
+	} else {
+		q.last = max(q.last+1, now.UnixNano())
+		name = fmt.Sprintf("%020d%s", q.last, queueExt)
+	}
+
+	for q.full(len(data)) && len(q.entries) > 0 {
+		log.Printf("Queue is full, batch %s is dropped\n", q.entries[0].name)
+		q.remove(0)
+	}
+	if q.full(len(data)) {
+		os.Remove(filepath.Join(q.Dir, name))
+		return fmt.Errorf("batch of %d bytes exceeds the queue limit", len(data))
+	}
+
+	if err := q.write(name, data, modTime); err != nil {
+		return err
+	}
+	q.entries = append(q.entries, queueEntry{name: name, size: int64(len(data)), modTime: modTime})
+	q.size += int64(len(data))
+	return nil
+}
+
+// Replay sends the queued batches oldest first and removes the sent ones. It
+// stops at the first batch which is not sent, the batch stays queued.
+func (q *Queue) Replay(send func([]*metrics.Metric) error, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(now)
+
+	for len(q.entries) > 0 {
+		batch, err := q.read(q.entries[0].name)
+		if err != nil {
+			log.Printf("Batch %s is dropped: %v\n", q.entries[0].name, err)
+			q.remove(0)
+			continue
+		}
+		if err := send(batch); err != nil {
+			if !IsPermanent(err) {
+				return err
+			}
+			log.Printf("Batch %s is rejected, dropped: %v\n", q.entries[0].name, err)
+		}
+		q.remove(0)
+	}
+	return nil
+}
+
+// Deliver sends batch after the queued ones. A batch which cannot be sent is
+// queued, so the server gets the batches in order once it is back. Batches
+// the server rejects are not queued and are dropped from the queue, but not
+// the ones refused for the credentials of the agent: they wait for the key
+// to be fixed like for the server to be back.
+func (q *Queue) Deliver(batch []*metrics.Metric, send func([]*metrics.Metric) error, now time.Time) error {
+	err := q.Replay(send, now)
+	if err == nil {
+		err = send(batch)
+	}
+	if err == nil || IsPermanent(err) {
+		return err
+	}
+
+	if qerr := q.Push(batch, now); qerr != nil {
+		return fmt.Errorf("%v, cannot queue batch: %v", err, qerr)
+	}
+	return fmt.Errorf("%v, %w, %d in queue", err, ErrQueued, q.Len())
+}
+
+// full tells whether n more bytes exceed the limit, q.mu must be held.
+func (q *Queue) full(n int) bool {
+	return q.MaxBytes > 0 && q.size+int64(n) > q.MaxBytes
+}
+
+// expire drops batches older than MaxAge, q.mu must be held.
+func (q *Queue) expire(now time.Time) {
+	if q.MaxAge <= 0 {
+		return
+	}
+	for len(q.entries) > 0 && now.Sub(q.entries[0].modTime) > q.MaxAge {
+		log.Printf("Batch %s is too old, dropped\n", q.entries[0].name)
+		q.remove(0)
+	}
+}
+
+// remove deletes the i-th batch, q.mu must be held.
+func (q *Queue) remove(i int) {
+	e := q.entries[i]
+	if err := os.Remove(filepath.Join(q.Dir, e.name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Cannot remove batch %s: %v\n", e.name, err)
+	}
+	q.entries = append(q.entries[:i], q.entries[i+1:]...)
+	q.size -= e.size
+}
+
+func (q *Queue) read(name string) ([]*metrics.Metric, error) {
+	data, err := os.ReadFile(filepath.Join(q.Dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read batch: %v", err)
+	}
+	var batch []*metrics.Metric
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, fmt.Errorf("cannot parse batch %s: %v", name, err)
+	}
+	return batch, nil
+}
+
+// write replaces the batch file atomically.
+// write replaces the batch file, its mtime is the age of the batch after a
+// restart.
+func (q *Queue) write(name string, data []byte, modTime time.Time) error {
+	tmp, err := os.CreateTemp(q.Dir, name+".tmp*")
+	if err != nil {
+		return fmt.Errorf("cannot create batch file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("cannot write batch file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot write batch file: %v", err)
+	}
+	if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+		return fmt.Errorf("cannot write batch file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(q.Dir, name)); err != nil {
+		return fmt.Errorf("cannot rename batch file: %v", err)
+	}
+	return nil
+}
+
+// mergeBatches returns queued with batch applied: deltas of counters are
+// added, gauges take the newer value.
+func mergeBatches(queued, batch []*metrics.Metric) []*metrics.Metric {
+	index := make(map[string]int, len(queued))
+	merged := make([]*metrics.Metric, 0, len(queued)+len(batch))
+	add := func(m *metrics.Metric) {
+		c := *m
+		i, ok := index[c.ID]
+		if !ok {
+			index[c.ID] = len(merged)
+			merged = append(merged, &c)
+			return
+		}
+		prev := merged[i]
+		if c.MType == "counter" && prev.MType == "counter" && prev.Delta != nil && c.Delta != nil {
+			sum := *prev.Delta + *c.Delta
+			c.Delta = &sum
+		}
+		merged[i] = &c
+	}
+	for _, m := range queued {
+		add(m)
+	}
+	for _, m := range batch {
+		add(m)
+	}
+	return merged
+}
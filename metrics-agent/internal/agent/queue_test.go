@@ -0,0 +1,258 @@
+package agent
+
+import (
+	"errors"
+	"metrics-agent/internal/metrics"
+	"os"
+	"testing"
+	"time"
+)
+
+func counter(id string, delta int64) *metrics.Metric {
+	return &metrics.Metric{ID: id, MType: "counter", Delta: &delta}
+}
+
+func gauge(id string, value float64) *metrics.Metric {
+	return &metrics.Metric{ID: id, MType: "gauge", Value: &value}
+}
+
+// collect returns a send function which records batches, failing while
+// *down is true.
+func collect(sent *[][]*metrics.Metric, down *bool) func([]*metrics.Metric) error {
+	return func(batch []*metrics.Metric) error {
+		if *down {
+			return errors.New("server is unreachable")
+		}
+		*sent = append(*sent, batch)
+		return nil
+	}
+}
+
+func Test_QueueDeliver(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	q, err := NewQueue(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent [][]*metrics.Metric
+	down := true
+	send := collect(&sent, &down)
+
+	for i := int64(1); i <= 3; i++ {
+		if err := q.Deliver([]*metrics.Metric{counter("PollCount", i)}, send, now); !errors.Is(err, ErrQueued) {
+			t.Fatalf("Deliver() error = %v, want the batch queued", err)
+		}
+	}
+	if q.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", q.Len())
+	}
+
+	// batches survive a restart
+	q, err = NewQueue(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 3 || q.Size() == 0 {
+		t.Fatalf("reopened queue has %d batches of %d bytes, want 3", q.Len(), q.Size())
+	}
+
+	down = false
+	if err := q.Deliver([]*metrics.Metric{counter("PollCount", 4)}, send, now); err != nil {
+		t.Fatalf("Deliver() failed: %v", err)
+	}
+	if len(sent) != 4 {
+		t.Fatalf("sent %d batches, want 4", len(sent))
+	}
+	for i, batch := range sent {
+		if *batch[0].Delta != int64(i+1) {
+			t.Errorf("batch %d has delta %d, batches are out of order", i, *batch[0].Delta)
+		}
+	}
+	if q.Len() != 0 || q.Size() != 0 {
+		t.Errorf("queue has %d batches of %d bytes after replay, want none", q.Len(), q.Size())
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("%d files left in queue directory", len(files))
+	}
+}
+
+func Test_QueueRejected(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	q, err := NewQueue(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := &StatusError{StatusCode: 400, Message: "bad metric"}
+	reject := func([]*metrics.Metric) error { return rejected }
+
+	if err := q.Deliver([]*metrics.Metric{counter("PollCount", 1)}, reject, now); !errors.Is(err, rejected) {
+		t.Errorf("Deliver() error = %v, want the rejection", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("rejected batch is queued")
+	}
+
+	// a queued batch rejected on replay does not block the others
+	q.Push([]*metrics.Metric{counter("PollCount", 1)}, now)
+	q.Push([]*metrics.Metric{counter("PollCount", 2)}, now)
+	var sent [][]*metrics.Metric
+	err = q.Replay(func(b []*metrics.Metric) error {
+		if *b[0].Delta == 1 {
+			return rejected
+		}
+		sent = append(sent, b)
+		return nil
+	}, now)
+	if err != nil || len(sent) != 1 || q.Len() != 0 {
+		t.Errorf("Replay() = %v, sent %d, %d left, want the rejected batch dropped", err, len(sent), q.Len())
+	}
+}
+
+func Test_QueueDenied(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	q, err := NewQueue(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied := &StatusError{StatusCode: 401, Message: "invalid API key"}
+	deny := func([]*metrics.Metric) error { return denied }
+
+	if err := q.Deliver([]*metrics.Metric{counter("PollCount", 1)}, deny, now); !errors.Is(err, ErrQueued) {
+		t.Errorf("Deliver() error = %v, want the batch queued", err)
+	}
+	q.Push([]*metrics.Metric{counter("PollCount", 2)}, now)
+
+	// a revoked key keeps the queue until it is replaced
+	forbidden := &StatusError{StatusCode: 403, Message: "scope write is required"}
+	if err := q.Replay(func([]*metrics.Metric) error { return forbidden }, now); !errors.Is(err, forbidden) || q.Len() != 2 {
+		t.Errorf("Replay() = %v, %d left, want both batches kept", err, q.Len())
+	}
+
+	var sent []int64
+	err = q.Replay(func(b []*metrics.Metric) error {
+		sent = append(sent, *b[0].Delta)
+		return nil
+	}, now)
+	if err != nil || len(sent) != 2 || sent[0] != 1 || q.Len() != 0 {
+		t.Errorf("Replay() = %v, sent %v, %d left, want both batches in order", err, sent, q.Len())
+	}
+}
+
+func Test_QueueLimits(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	batch := func(delta int64, value float64) []*metrics.Metric {
+		return []*metrics.Metric{counter("PollCount", delta), gauge("Alloc", value)}
+	}
+
+	t.Run("merged when full", func(t *testing.T) {
+		q, err := NewQueue(t.TempDir(), 150, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 5; i++ {
+			if err := q.Push(batch(int64(i), float64(i)), now); err != nil {
+				t.Fatalf("Push() failed: %v", err)
+			}
+		}
+		if q.Len() >= 5 {
+			t.Errorf("Len() = %d, batches are not merged", q.Len())
+		}
+		if q.Size() > 150 {
+			t.Errorf("Size() = %d, exceeds the limit", q.Size())
+		}
+
+		var sent [][]*metrics.Metric
+		down := false
+		if err := q.Replay(collect(&sent, &down), now); err != nil {
+			t.Fatal(err)
+		}
+		var total int64
+		for _, b := range sent {
+			total += *b[0].Delta
+		}
+		if total != 15 {
+			t.Errorf("counters sum to %d, want 15 as nothing is lost", total)
+		}
+		last := sent[len(sent)-1]
+		if *last[1].Value != 5 {
+			t.Errorf("gauge = %v, want the last value 5", *last[1].Value)
+		}
+	})
+
+	t.Run("merged keeps its age", func(t *testing.T) {
+		dir := t.TempDir()
+		q, err := NewQueue(dir, 100, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Push(batch(1, 1), now)
+		q.Push(batch(2, 2), now.Add(50*time.Minute))
+		if q.Len() != 1 {
+			t.Fatalf("Len() = %d, want the batches merged", q.Len())
+		}
+
+		// after a restart too
+		reopened, err := NewQueue(dir, 100, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range []*Queue{q, reopened} {
+			q.mu.Lock()
+			q.expire(now.Add(61 * time.Minute))
+			q.mu.Unlock()
+			if q.Len() != 0 {
+				t.Errorf("merged batch with metrics of 61m ago is kept")
+			}
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		q, err := NewQueue(t.TempDir(), 0, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Push(batch(1, 1), now)
+		q.Push(batch(2, 2), now.Add(30*time.Minute))
+
+		var sent [][]*metrics.Metric
+		down := false
+		if err := q.Replay(collect(&sent, &down), now.Add(61*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent) != 1 || *sent[0][0].Delta != 2 {
+			t.Errorf("sent %v, want only the batch within the age limit", sent)
+		}
+	})
+
+	t.Run("batch over the limit", func(t *testing.T) {
+		q, err := NewQueue(t.TempDir(), 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Push(batch(1, 1), now); err == nil {
+			t.Error("Push() of a batch over the limit succeeded")
+		}
+		if q.Len() != 0 {
+			t.Errorf("Len() = %d, want 0", q.Len())
+		}
+	})
+}
+
+func Test_mergeBatches(t *testing.T) {
+	got := mergeBatches(
+		[]*metrics.Metric{counter("PollCount", 2), gauge("Alloc", 1)},
+		[]*metrics.Metric{gauge("Alloc", 3), counter("PollCount", 5), gauge("RandomValue", 0.5)},
+	)
+	if len(got) != 3 {
+		t.Fatalf("got %d metrics, want 3", len(got))
+	}
+	if *got[0].Delta != 7 || *got[1].Value != 3 || got[2].ID != "RandomValue" {
+		t.Errorf("mergeBatches() = %v, %v, %v", *got[0].Delta, *got[1].Value, got[2].ID)
+	}
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"metrics-agent/internal/config"
+	"net/http"
+	"os"
+)
+
+// ServerURL returns the URL of path on the server, https if TLS is on.
+func ServerURL(cfg *config.Config, path string) string {
+	proto := "http://"
+	if cfg.TLS {
+		proto = "https://"
+	}
+	return proto + cfg.Addr + path
+}
+
+// NewHTTPClient returns the client to talk to the server. With TLS on the
+// server is verified with the CA bundle, or the system roots without one,
+// and the client certificate is presented if set.
+func NewHTTPClient(cfg *config.Config) (*http.Client, error) {
+	if !cfg.TLS {
+		if cfg.CACert != "" || cfg.ClientCert != "" {
+			return nil, fmt.Errorf("TLS settings are given, but TLS is off")
+		}
+		return &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA bundle %s", cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		if cfg.ClientCert == "" || cfg.ClientKey == "" {
+			return nil, fmt.Errorf("both client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"metrics-agent/internal/config"
+	"metrics-agent/internal/metrics"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, written as PEM files.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert issues a certificate signed by ca, self-signed if ca is nil.
+func newTestCert(t *testing.T, dir, cn string, ca *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, cn+".crt"),
+		keyFile:  filepath.Join(dir, cn+".key"),
+	}
+	if err := os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func Test_ServerURL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want string
+	}{
+		{name: "plain", cfg: config.Config{Addr: "localhost:8080"}, want: "http://localhost:8080/updates/"},
+		{name: "TLS", cfg: config.Config{Addr: "localhost:8443", TLS: true}, want: "https://localhost:8443/updates/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ServerURL(&tt.cfg, "/updates/"); got != tt.want {
+				t.Errorf("ServerURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_NewHTTPClient(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "test-ca", nil)
+	agent := newTestCert(t, dir, "agent-1", ca)
+
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr bool
+	}{
+		{name: "plain"},
+		{name: "TLS with system roots", cfg: config.Config{TLS: true}},
+		{name: "mutual TLS", cfg: config.Config{TLS: true, CACert: ca.certFile, ClientCert: agent.certFile, ClientKey: agent.keyFile}},
+		{name: "TLS off", cfg: config.Config{CACert: ca.certFile}, wantErr: true},
+		{name: "no client key", cfg: config.Config{TLS: true, ClientCert: agent.certFile}, wantErr: true},
+		{name: "bad CA", cfg: config.Config{TLS: true, CACert: agent.keyFile}, wantErr: true},
+		{name: "absent CA", cfg: config.Config{TLS: true, CACert: filepath.Join(dir, "absent")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHTTPClient(&tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewHTTPClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_SendMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "test-ca", nil)
+	srvCert := newTestCert(t, dir, "server", ca)
+	agent := newTestCert(t, dir, "agent-1", ca)
+
+	var got string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}))
+	pair, err := tls.LoadX509KeyPair(srvCert.certFile, srvCert.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	cfg := config.Config{
+		Addr:       strings.TrimPrefix(server.URL, "https://"),
+		TLS:        true,
+		CACert:     ca.certFile,
+		ClientCert: agent.certFile,
+		ClientKey:  agent.keyFile,
+	}
+	client, err := NewClient(&cfg, "/updates/")
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+
+	rnd := 1.5
+	m := []*metrics.Metric{{ID: "RandomValue", MType: "gauge", Value: &rnd}}
+	if err := client.Send(m); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	if got != "agent-1" {
+		t.Errorf("server saw client %q, want %q", got, "agent-1")
+	}
+
+	// without the client certificate the server refuses the connection
+	cfg.ClientCert, cfg.ClientKey = "", ""
+	anonymous, err := NewHTTPClient(&cfg)
+	if err != nil {
+		t.Fatalf("NewHTTPClient() failed: %v", err)
+	}
+	if resp, err := anonymous.Get(ServerURL(&cfg, "/updates/")); err == nil {
+		resp.Body.Close()
+		t.Error("request without client certificate succeeded")
+	}
+}
@@ -0,0 +1,245 @@
+// Package collector gathers the metrics the agent reports. Every source of
+// metrics is a Collector, the Registry polls the enabled ones.
+package collector
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"metrics-agent/internal/metrics"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Collector gathers a set of metrics on every poll. Collect should return
+// when ctx is done.
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context) ([]metrics.Metric, error)
+}
+
+// Factory creates a collector of a type from the settings of its entry in
+// the config, nil settings if there are none.
+type Factory func(name string, settings json.RawMessage) (Collector, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a type of collector available to the config. It panics if
+// the type is registered twice.
+func Register(typ string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, ok := factories[typ]; ok {
+		panic("collector: type " + typ + " is registered twice")
+	}
+	factories[typ] = f
+}
+
+// Types returns the registered types of collectors.
+func Types() []string {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	types := make([]string, 0, len(factories))
+	for typ := range factories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Config lists the collectors of the agent. ExecConcurrency limits the
+// commands of exec collectors running at once.
+type Config struct {
+	Collectors      []Entry `json:"collectors"`
+	ExecConcurrency int     `json:"exec_concurrency,omitempty"`
+}
+
+// Entry configures a collector. Name defaults to Type, it tells apart
+// several collectors of a type. Timeout overrides the default of the
+// registry.
+type Entry struct {
+	Type     string          `json:"type"`
+	Name     string          `json:"name,omitempty"`
+	Disabled bool            `json:"disabled,omitempty"`
+	Timeout  Duration        `json:"timeout,omitzero"`
+	Settings json.RawMessage `json:"settings,omitempty"`
+}
+
+// Duration is a time.Duration written as "1.5s" in the config.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultConfig is used without a config file: the runtime metrics,
+// PollCount and RandomValue.
+func DefaultConfig() *Config {
+	return &Config{Collectors: []Entry{
+		{Type: RuntimeType},
+		{Type: PollCountType},
+		{Type: RandomType},
+	}}
+}
+
+// LoadConfig reads the config file, the default config if path is empty.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read collectors config: %v", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse collectors config %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// Registry polls the enabled collectors.
+type Registry struct {
+	entries   []registered
+	execSlots chan struct{} // limit the commands of exec collectors running at once
+}
+
+type registered struct {
+	collector Collector
+	timeout   time.Duration
+}
+
+// NewRegistry creates the enabled collectors of cfg, timeout applies to
+// those without their own.
+func NewRegistry(cfg *Config, timeout time.Duration) (*Registry, error) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	r := &Registry{execSlots: make(chan struct{}, cmp.Or(cfg.ExecConcurrency, DefaultExecConcurrency))}
+	names := make(map[string]bool)
+	for i, e := range cfg.Collectors {
+		if e.Disabled {
+			continue
+		}
+		f, ok := factories[e.Type]
+		if !ok {
+			return nil, fmt.Errorf("collector %d: unknown type %q", i, e.Type)
+		}
+		name := e.Name
+		if name == "" {
+			name = e.Type
+		}
+		if names[name] {
+			return nil, fmt.Errorf("collector %d: name %q is used twice", i, name)
+		}
+		names[name] = true
+
+		c, err := f(name, e.Settings)
+		if err != nil {
+			return nil, fmt.Errorf("collector %s: %v", name, err)
+		}
+		if ex, ok := c.(*Exec); ok {
+			ex.slots = r.execSlots
+		}
+		t := time.Duration(e.Timeout)
+		if t <= 0 {
+			t = timeout
+		}
+		r.entries = append(r.entries, registered{collector: c, timeout: t})
+	}
+	return r, nil
+}
+
+// Names returns the names of the enabled collectors.
+func (r *Registry) Names() []string {
+	names := make([]string, len(r.entries))
+	for i, e := range r.entries {
+		names[i] = e.collector.Name()
+	}
+	return names
+}
+
+// Collect polls the collectors at once and returns their metrics in the
+// order of the config. A collector which fails, panics or runs out of its
+// timeout is logged and left out, the others are not affected.
+func (r *Registry) Collect(ctx context.Context) []*metrics.Metric {
+	results := make([][]metrics.Metric, len(r.entries))
+
+	var wg sync.WaitGroup
+	for i, e := range r.entries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := collect(ctx, e)
+			if err != nil {
+				log.Printf("Collector %s failed: %v\n", e.collector.Name(), err)
+				return
+			}
+			results[i] = m
+		}()
+	}
+	wg.Wait()
+
+	var batch []*metrics.Metric
+	for _, m := range results {
+		for i := range m {
+			batch = append(batch, &m[i])
+		}
+	}
+	return batch
+}
+
+// collect runs one collector within its timeout. A collector which does not
+// return in time is abandoned, its goroutine is left to finish on its own.
+func collect(ctx context.Context, e registered) ([]metrics.Metric, error) {
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		m   []metrics.Metric
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{err: fmt.Errorf("panic: %v", p)}
+			}
+		}()
+		m, err := e.collector.Collect(ctx)
+		done <- result{m: m, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.m, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,162 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"metrics-agent/internal/metrics"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fake is a collector of tests, it answers a gauge after delay or fails.
+type fake struct {
+	name  string
+	delay time.Duration
+	err   error
+	panic bool
+}
+
+func (c *fake) Name() string { return c.name }
+
+func (c *fake) Collect(ctx context.Context) ([]metrics.Metric, error) {
+	if c.panic {
+		panic("broken collector")
+	}
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	v := 1.0
+	return []metrics.Metric{{ID: c.name, MType: "gauge", Value: &v}}, nil
+}
+
+func init() {
+	Register("fake", func(name string, settings json.RawMessage) (Collector, error) {
+		c := &fake{name: name}
+		var s struct {
+			Delay Duration `json:"delay"`
+			Fail  bool     `json:"fail"`
+			Panic bool     `json:"panic"`
+		}
+		if settings != nil {
+			if err := json.Unmarshal(settings, &s); err != nil {
+				return nil, err
+			}
+		}
+		c.delay, c.panic = time.Duration(s.Delay), s.Panic
+		if s.Fail {
+			c.err = errors.New("source is unavailable")
+		}
+		return c, nil
+	})
+}
+
+func batchIDs(batch []*metrics.Metric) []string {
+	var ids []string
+	for _, m := range batch {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func Test_DefaultRegistry(t *testing.T) {
+	r, err := NewRegistry(DefaultConfig(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Names(); !slices.Equal(got, []string{"runtime", "pollcount", "random"}) {
+		t.Errorf("Names() = %v", got)
+	}
+
+	ids := batchIDs(r.Collect(context.Background()))
+	if len(ids) != len(metrics.MetricList)+2 {
+		t.Errorf("got %d metrics, want %d", len(ids), len(metrics.MetricList)+2)
+	}
+	for _, id := range []string{"Alloc", "PollCount", "RandomValue"} {
+		if !slices.Contains(ids, id) {
+			t.Errorf("%s is not collected", id)
+		}
+	}
+}
+
+func Test_RegistryIsolation(t *testing.T) {
+	cfg := &Config{Collectors: []Entry{
+		{Type: "fake", Name: "ok"},
+		{Type: "fake", Name: "slow", Settings: json.RawMessage(`{"delay":"1s"}`)},
+		{Type: "fake", Name: "own-timeout", Timeout: Duration(time.Second), Settings: json.RawMessage(`{"delay":"100ms"}`)},
+		{Type: "fake", Name: "failing", Settings: json.RawMessage(`{"fail":true}`)},
+		{Type: "fake", Name: "panicking", Settings: json.RawMessage(`{"panic":true}`)},
+		{Type: "fake", Name: "off", Disabled: true},
+	}}
+	r, err := NewRegistry(cfg, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	got := batchIDs(r.Collect(context.Background()))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Collect() took %v, the slow collector is not cut off", elapsed)
+	}
+	if !slices.Equal(got, []string{"ok", "own-timeout"}) {
+		t.Errorf("Collect() = %v, want the healthy collectors only", got)
+	}
+}
+
+func Test_NewRegistryErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "unknown type", cfg: Config{Collectors: []Entry{{Type: "nope"}}}},
+		{name: "name twice", cfg: Config{Collectors: []Entry{{Type: "fake"}, {Type: "fake"}}}},
+		{name: "unexpected settings", cfg: Config{Collectors: []Entry{{Type: RuntimeType, Settings: json.RawMessage(`{"x":1}`)}}}},
+		{name: "bad settings", cfg: Config{Collectors: []Entry{{Type: "fake", Settings: json.RawMessage(`{"delay":5}`)}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRegistry(&tt.cfg, time.Second); err == nil {
+				t.Error("NewRegistry() succeeded unexpectedly")
+			}
+		})
+	}
+}
+
+func Test_LoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collectors.json")
+	data := `{"collectors": [
+		{"type": "runtime", "timeout": "200ms"},
+		{"type": "random", "disabled": true}
+	]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() failed: %v", err)
+	}
+	if len(cfg.Collectors) != 2 || time.Duration(cfg.Collectors[0].Timeout) != 200*time.Millisecond || !cfg.Collectors[1].Disabled {
+		t.Errorf("LoadConfig() = %+v", cfg)
+	}
+
+	r, err := NewRegistry(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Names(); !slices.Equal(got, []string{"runtime"}) {
+		t.Errorf("Names() = %v, want runtime only", got)
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "absent.json")); err == nil {
+		t.Error("LoadConfig() of an absent file succeeded")
+	}
+}
@@ -0,0 +1,288 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"metrics-agent/internal/metrics"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ExecType = "exec"
+
+	// DefaultExecConcurrency is how many commands run at once without
+	// exec_concurrency in the config.
+	DefaultExecConcurrency = 4
+
+	// maxExecOutput caps the output of a command which is parsed.
+	maxExecOutput = 1 << 20
+)
+
+// Formats of the output of a command.
+const (
+	FormatAuto  = "auto"  // JSON if the output starts with [, lines otherwise
+	FormatLines = "lines" // "<type> <name> <value>" a line
+	FormatJSON  = "json"  // array of metrics.Metric
+)
+
+func init() {
+	Register(ExecType, newExec)
+}
+
+// ExecSettings configure an exec collector. The command runs with the
+// timeout of the collector entry and is killed when it runs out.
+type ExecSettings struct {
+	Command   []string `json:"command"`
+	Dir       string   `json:"dir,omitempty"`
+	Interval  Duration `json:"interval,omitzero"`    // between runs, every poll if zero
+	Format    string   `json:"format,omitempty"`     // auto by default
+	Prefix    string   `json:"prefix,omitempty"`     // added to the names of metrics
+	ExitCodes []int    `json:"exit_codes,omitempty"` // accepted besides 0
+}
+
+// Exec runs a command and parses its output as metrics.
+type Exec struct {
+	name     string
+	settings ExecSettings
+	slots    chan struct{} // shared by the exec collectors of a registry, no limit if nil
+
+	mu      sync.Mutex
+	lastRun time.Time
+}
+
+func newExec(name string, raw json.RawMessage) (Collector, error) {
+	var s ExecSettings
+	if raw == nil {
+		return nil, fmt.Errorf("settings with command expected")
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("cannot parse settings: %v", err)
+	}
+	if len(s.Command) == 0 || s.Command[0] == "" {
+		return nil, fmt.Errorf("command expected")
+	}
+	switch s.Format {
+	case "":
+		s.Format = FormatAuto
+	case FormatAuto, FormatLines, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown format %q", s.Format)
+	}
+	if metrics.SanitizeID(s.Prefix) != s.Prefix {
+		return nil, fmt.Errorf("prefix %q has characters other than letters, digits and _.:-", s.Prefix)
+	}
+	return &Exec{name: name, settings: s}, nil
+}
+
+func (c *Exec) Name() string { return c.name }
+
+// Collect runs the command if its interval has passed since the last run,
+// it returns no metrics otherwise.
+func (c *Exec) Collect(ctx context.Context) ([]metrics.Metric, error) {
+	c.mu.Lock()
+	now := time.Now()
+	if !c.lastRun.IsZero() && now.Sub(c.lastRun) < time.Duration(c.settings.Interval) {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	c.lastRun = now
+	c.mu.Unlock()
+
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+			defer func() { <-c.slots }()
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no free slot to run: %v", ctx.Err())
+		}
+	}
+
+	output, err := c.run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := ParseOutput(output, c.settings.Format)
+	if err != nil {
+		return nil, err
+	}
+	if c.settings.Prefix != "" {
+		for i := range m {
+			m[i].ID = c.settings.Prefix + m[i].ID
+			if len(m[i].ID) > metrics.MaxIDLength {
+				return nil, fmt.Errorf("metric %d: name with prefix is longer than %d bytes", i+1, metrics.MaxIDLength)
+			}
+		}
+	}
+	return m, nil
+}
+
+func (c *Exec) run(ctx context.Context) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, c.settings.Command[0], c.settings.Command[1:]...)
+	cmd.Dir = c.settings.Dir
+	cmd.WaitDelay = time.Second
+
+	var stdout, stderr bytes.Buffer
+	out := &limitWriter{w: &stdout, n: maxExecOutput}
+	cmd.Stdout = out
+	cmd.Stderr = &limitWriter{w: &stderr, n: 4096}
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("command is killed: %v", ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		if !slices.Contains(c.settings.ExitCodes, code) {
+			return nil, fmt.Errorf("command exited with %d: %s", code, firstLine(stderr.String()))
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot run command: %v", err)
+	}
+	// a cut output may end in a cut value, which would parse as another one
+	if out.dropped {
+		return nil, fmt.Errorf("output exceeds %d MiB", maxExecOutput>>20)
+	}
+	return stdout.Bytes(), nil
+}
+
+// limitWriter keeps the first n bytes and discards the rest, so a command
+// is not blocked by a full pipe. dropped tells whether bytes were discarded.
+type limitWriter struct {
+	w       io.Writer
+	n       int
+	dropped bool
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	keep := p[:min(len(p), max(l.n, 0))]
+	if len(keep) > 0 {
+		l.n -= len(keep)
+		l.w.Write(keep)
+	}
+	if len(keep) < len(p) {
+		l.dropped = true
+	}
+	return len(p), nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
+
+// ParseOutput parses the output of a command in format.
+func ParseOutput(output []byte, format string) ([]metrics.Metric, error) {
+	if format == FormatAuto {
+		format = FormatLines
+		if trimmed := bytes.TrimSpace(output); len(trimmed) > 0 && trimmed[0] == '[' {
+			format = FormatJSON
+		}
+	}
+
+	var m []metrics.Metric
+	var err error
+	if format == FormatJSON {
+		m, err = parseJSON(output)
+	} else {
+		m, err = parseLines(output)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range m {
+		if err := check(&m[i]); err != nil {
+			return nil, fmt.Errorf("metric %d: %v", i+1, err)
+		}
+	}
+	return m, nil
+}
+
+func parseJSON(output []byte) ([]metrics.Metric, error) {
+	var m []metrics.Metric
+	if err := json.Unmarshal(output, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse JSON output: %v", err)
+	}
+	return m, nil
+}
+
+// parseLines reads "<type> <name> <value>" lines, empty lines and lines
+// starting with # are skipped.
+func parseLines(output []byte) ([]metrics.Metric, error) {
+	var m []metrics.Metric
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: <type> <name> <value> expected", n)
+		}
+
+		metric := metrics.Metric{MType: fields[0], ID: fields[1]}
+		switch metric.MType {
+		case "gauge":
+			v, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad gauge value %q", n, fields[2])
+			}
+			metric.Value = &v
+		case "counter":
+			d, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad counter delta %q", n, fields[2])
+			}
+			metric.Delta = &d
+		default:
+			return nil, fmt.Errorf("line %d: unknown type %q", n, metric.MType)
+		}
+		m = append(m, metric)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read output: %v", err)
+	}
+	return m, nil
+}
+
+// check tells whether the server would take the metric. Characters the
+// server does not take in names become _, like in StatsD names.
+func check(m *metrics.Metric) error {
+	if m.ID == "" {
+		return fmt.Errorf("no name")
+	}
+	m.ID = metrics.SanitizeID(m.ID)
+	if len(m.ID) > metrics.MaxIDLength {
+		return fmt.Errorf("name is longer than %d bytes", metrics.MaxIDLength)
+	}
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil || math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+			return fmt.Errorf("gauge %s has no finite value", m.ID)
+		}
+		m.Delta = nil
+	case "counter":
+		if m.Delta == nil {
+			return fmt.Errorf("counter %s has no delta", m.ID)
+		}
+		m.Value = nil
+	default:
+		return fmt.Errorf("%s has unknown type %q", m.ID, m.MType)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shell returns settings running script with sh.
+func shell(script string, extra string) json.RawMessage {
+	cmd, _ := json.Marshal([]string{"sh", "-c", script})
+	return json.RawMessage(`{"command":` + string(cmd) + extra + `}`)
+}
+
+func Test_ExecCollect(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings json.RawMessage
+		timeout  time.Duration
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:     "lines",
+			settings: shell(`printf '# device stats\ngauge if_util 0.75\n\ncounter rx_errors 3\n'`, ``),
+			want:     []string{"if_util", "rx_errors"},
+		},
+		{
+			name:     "JSON with prefix",
+			settings: shell(`echo '[{"id":"temp","type":"gauge","value":41.5}]'`, `,"prefix":"sw1."`),
+			want:     []string{"sw1.temp"},
+		},
+		{
+			name:     "names sanitized",
+			settings: shell(`echo 'gauge eth0/rx 1'; echo 'counter disk[sda] 2'`, `,"prefix":"sw1."`),
+			want:     []string{"sw1.eth0_rx", "sw1.disk_sda_"},
+		},
+		{
+			name:     "too long with prefix",
+			settings: shell(`echo 'gauge `+strings.Repeat("a", 250)+` 1'`, `,"prefix":"switch."`),
+			wantErr:  "longer than 255 bytes",
+		},
+		{
+			name:     "failing command",
+			settings: shell(`echo 'device unreachable' >&2; exit 2`, ``),
+			wantErr:  "exited with 2: device unreachable",
+		},
+		{
+			name:     "accepted exit code",
+			settings: shell(`echo 'gauge link_up 0'; exit 1`, `,"exit_codes":[1]`),
+			want:     []string{"link_up"},
+		},
+		{
+			name:     "timed out",
+			settings: shell(`sleep 5`, ``),
+			timeout:  100 * time.Millisecond,
+			wantErr:  "killed",
+		},
+		{
+			name:     "output over the limit",
+			settings: shell(`yes '# filler' | head -c 1100000; echo 'gauge foo 12345'`, ``),
+			wantErr:  "output exceeds 1 MiB",
+		},
+		{
+			name:     "bad output",
+			settings: shell(`echo 'gauge if_util high'`, ``),
+			wantErr:  "bad gauge value",
+		},
+		{
+			name:     "absent command",
+			settings: json.RawMessage(`{"command":["/nonexistent/scrape.sh"]}`),
+			wantErr:  "cannot run command",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newExec("test", tt.settings)
+			if err != nil {
+				t.Fatalf("newExec() failed: %v", err)
+			}
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			start := time.Now()
+			m, err := c.Collect(ctx)
+			if time.Since(start) > 3*time.Second {
+				t.Errorf("Collect() took %v", time.Since(start))
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Collect() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Collect() failed: %v", err)
+			}
+			var ids []string
+			for _, metric := range m {
+				ids = append(ids, metric.ID)
+			}
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("Collect() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ExecInterval(t *testing.T) {
+	c, err := newExec("test", shell(`echo 'counter runs 1'`, `,"interval":"1h"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := c.Collect(context.Background())
+	if err != nil || len(first) != 1 {
+		t.Fatalf("first Collect() = %v, %v", first, err)
+	}
+	second, err := c.Collect(context.Background())
+	if err != nil || len(second) != 0 {
+		t.Errorf("Collect() within the interval = %v, %v, want nothing", second, err)
+	}
+}
+
+func Test_ExecConcurrency(t *testing.T) {
+	cfg := &Config{ExecConcurrency: 1}
+	for _, name := range []string{"a", "b", "c"} {
+		cfg.Collectors = append(cfg.Collectors, Entry{Type: ExecType, Name: name, Settings: shell(`sleep 0.2; echo 'gauge `+name+` 1'`, ``)})
+	}
+	r, err := NewRegistry(cfg, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	got := batchIDs(r.Collect(context.Background()))
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Errorf("3 commands took %v, want them one after another", elapsed)
+	}
+	if !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("Collect() = %v", got)
+	}
+}
+
+func Test_NewExecErrors(t *testing.T) {
+	for _, settings := range []string{
+		``,
+		`{}`,
+		`{"command":[]}`,
+		`{"command":["true"],"format":"xml"}`,
+		`{"command":["true"],"timeout":"1s"}`,
+		`{"command":["true"],"prefix":"core switch."}`,
+	} {
+		var raw json.RawMessage
+		if settings != "" {
+			raw = json.RawMessage(settings)
+		}
+		if _, err := newExec("test", raw); err == nil {
+			t.Errorf("newExec(%s) succeeded unexpectedly", settings)
+		}
+	}
+}
+
+func Test_ParseOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		format  string
+		want    int
+		wantErr bool
+	}{
+		{name: "empty", output: "", format: FormatAuto},
+		{name: "lines", output: "gauge a 1\ncounter b 2\n", format: FormatLines, want: 2},
+		{name: "JSON", output: `[{"id":"a","type":"counter","delta":2}]`, format: FormatJSON, want: 1},
+		{name: "JSON forced on lines", output: "gauge a 1", format: FormatJSON, wantErr: true},
+		{name: "too many fields", output: "gauge a 1 2", format: FormatLines, wantErr: true},
+		{name: "fractional counter", output: "counter a 1.5", format: FormatLines, wantErr: true},
+		{name: "unknown type", output: "histogram a 1", format: FormatLines, wantErr: true},
+		{name: "NaN gauge", output: "gauge a NaN", format: FormatLines, wantErr: true},
+		{name: "counter without delta", output: `[{"id":"a","type":"counter","value":1}]`, format: FormatAuto, wantErr: true},
+		{name: "no name", output: `[{"type":"gauge","value":1}]`, format: FormatAuto, wantErr: true},
+		{name: "too long name", output: "gauge " + strings.Repeat("a", 256) + " 1", format: FormatLines, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseOutput([]byte(tt.output), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseOutput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(m) != tt.want {
+				t.Errorf("ParseOutput() returned %d metrics, want %d", len(m), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"metrics-agent/internal/metrics"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	NetDevType = "netdev"
+
+	// DefaultNetDevPrefix starts the names of the metrics of interfaces.
+	DefaultNetDevPrefix = "net."
+)
+
+// netDevCounters are the counters of /proc/net/dev which are reported and
+// their columns: the receive columns come first, transmit ones from 8 on.
+var netDevCounters = []struct {
+	name   string
+	column int
+}{
+	{"rx_bytes", 0},
+	{"rx_packets", 1},
+	{"rx_errors", 2},
+	{"rx_dropped", 3},
+	{"tx_bytes", 8},
+	{"tx_packets", 9},
+	{"tx_errors", 10},
+	{"tx_dropped", 11},
+}
+
+func init() {
+	Register(NetDevType, newNetDev)
+}
+
+// NetDevSettings configure a netdev collector. Interfaces are matched by
+// shell patterns like "eth*"; all are reported if Include is empty and
+// Exclude wins over Include.
+type NetDevSettings struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	Prefix  string   `json:"prefix,omitempty"` // net. by default
+}
+
+// NetDev reports the statistics of network interfaces on Linux as
+// <prefix><interface>.<name>: the rx/tx bytes, packets, errors and drops of
+// /proc/net/dev as counters, and link_up, speed_mbps and mtu of
+// /sys/class/net as gauges.
+//
+// The kernel keeps totals, the counters are sent as increases since the
+// previous poll; the first poll of an interface sends 0. A total which
+// goes down has wrapped around 32 bits if it fits in them and the increase
+// is plausible, otherwise the interface has been reset and the new total
+// is the increase, as it is when the ifindex of the interface changes.
+type NetDev struct {
+	name     string
+	settings NetDevSettings
+	procFile string
+	sysDir   string
+
+	mu    sync.Mutex
+	state map[string]*netDevState
+}
+
+// netDevState is what the previous poll has read of an interface.
+type netDevState struct {
+	ifindex string
+	totals  map[string]uint64
+}
+
+func newNetDev(name string, raw json.RawMessage) (Collector, error) {
+	var s NetDevSettings
+	if len(raw) != 0 && string(raw) != "null" {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&s); err != nil {
+			return nil, fmt.Errorf("cannot parse settings: %v", err)
+		}
+	}
+	for _, pattern := range append(s.Include, s.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad interface pattern %q", pattern)
+		}
+	}
+	if s.Prefix == "" {
+		s.Prefix = DefaultNetDevPrefix
+	}
+	return &NetDev{
+		name:     name,
+		settings: s,
+		procFile: "/proc/net/dev",
+		sysDir:   "/sys/class/net",
+		state:    make(map[string]*netDevState),
+	}, nil
+}
+
+func (c *NetDev) Name() string { return c.name }
+
+func (c *NetDev) Collect(ctx context.Context) ([]metrics.Metric, error) {
+	data, err := os.ReadFile(c.procFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read interface statistics: %v", err)
+	}
+	stats, err := ParseNetDev(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var m []metrics.Metric
+	seen := make(map[string]bool)
+	for _, s := range stats {
+		if !c.matches(s.Interface) {
+			continue
+		}
+		seen[s.Interface] = true
+		prefix := c.settings.Prefix + metrics.SanitizeID(s.Interface) + "."
+
+		ifindex := c.readSys(s.Interface, "ifindex")
+		prev := c.state[s.Interface]
+		reset := prev != nil && prev.ifindex != ifindex
+		for _, counter := range netDevCounters {
+			var delta int64
+			if prev != nil {
+				delta = increase(prev.totals[counter.name], s.Counters[counter.name], reset)
+			}
+			m = append(m, metrics.Metric{ID: prefix + counter.name, MType: "counter", Delta: &delta})
+		}
+		c.state[s.Interface] = &netDevState{ifindex: ifindex, totals: s.Counters}
+
+		m = append(m, c.gauges(s.Interface, prefix)...)
+	}
+	for iface := range c.state {
+		if !seen[iface] {
+			delete(c.state, iface)
+		}
+	}
+	return m, nil
+}
+
+// gauges reads the link state, the speed and the MTU of an interface. The
+// speed of an interface without a link or a physical one is unknown and
+// not reported.
+func (c *NetDev) gauges(iface, prefix string) []metrics.Metric {
+	var m []metrics.Metric
+	if state := c.readSys(iface, "operstate"); state != "" {
+		// loopback and some virtual links have no operational state, their
+		// carrier tells
+		up := 0.0
+		if state == "up" || state == "unknown" && c.readSys(iface, "carrier") == "1" {
+			up = 1
+		}
+		m = append(m, metrics.Metric{ID: prefix + "link_up", MType: "gauge", Value: &up})
+	}
+	if speed, err := strconv.ParseFloat(c.readSys(iface, "speed"), 64); err == nil && speed >= 0 {
+		m = append(m, metrics.Metric{ID: prefix + "speed_mbps", MType: "gauge", Value: &speed})
+	}
+	if mtu, err := strconv.ParseFloat(c.readSys(iface, "mtu"), 64); err == nil {
+		m = append(m, metrics.Metric{ID: prefix + "mtu", MType: "gauge", Value: &mtu})
+	}
+	return m
+}
+
+// readSys returns the trimmed content of an attribute of the interface,
+// empty if it cannot be read.
+func (c *NetDev) readSys(iface, attr string) string {
+	data, err := os.ReadFile(filepath.Join(c.sysDir, iface, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (c *NetDev) matches(iface string) bool {
+	for _, pattern := range c.settings.Exclude {
+		if ok, _ := path.Match(pattern, iface); ok {
+			return false
+		}
+	}
+	if len(c.settings.Include) == 0 {
+		return true
+	}
+	for _, pattern := range c.settings.Include {
+		if ok, _ := path.Match(pattern, iface); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// increase returns how much a kernel total has grown from prev to cur.
+func increase(prev, cur uint64, reset bool) int64 {
+	switch {
+	case reset:
+		return clampDelta(cur)
+	case cur >= prev:
+		return clampDelta(cur - prev)
+	case prev <= math.MaxUint32 && cur+(math.MaxUint32+1-prev) <= math.MaxUint32/2:
+		// a 32 bit counter has wrapped
+		return int64(cur + (math.MaxUint32 + 1 - prev))
+	default:
+		return clampDelta(cur)
+	}
+}
+
+func clampDelta(v uint64) int64 {
+	return int64(min(v, math.MaxInt64))
+}
+
+// InterfaceStats is a line of /proc/net/dev.
+type InterfaceStats struct {
+	Interface string
+	Counters  map[string]uint64
+}
+
+// ParseNetDev reads the content of /proc/net/dev.
+func ParseNetDev(data []byte) ([]InterfaceStats, error) {
+	var stats []InterfaceStats
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		iface, values, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue // the two header lines
+		}
+		fields := strings.Fields(values)
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("line %d: 16 columns expected, got %d", n, len(fields))
+		}
+		s := InterfaceStats{Interface: strings.TrimSpace(iface), Counters: make(map[string]uint64, len(netDevCounters))}
+		for _, counter := range netDevCounters {
+			v, err := strconv.ParseUint(fields[counter.column], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad %s %q", n, counter.name, fields[counter.column])
+			}
+			s.Counters[counter.name] = v
+		}
+		stats = append(stats, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read interface statistics: %v", err)
+	}
+	return stats, nil
+}
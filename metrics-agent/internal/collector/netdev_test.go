@@ -0,0 +1,199 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"metrics-agent/internal/metrics"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const netDevHeader = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+`
+
+// netDevLine formats a line of /proc/net/dev with rx and tx bytes, the
+// other counters are 1 for rx and 2 for tx.
+func netDevLine(iface string, rx, tx uint64) string {
+	return fmt.Sprintf("%6s: %d 1 1 1 0 0 0 0 %d 2 2 2 0 0 0 0\n", iface, rx, tx)
+}
+
+type fakeNetDev struct {
+	t    *testing.T
+	proc string
+	sys  string
+}
+
+func newFakeNetDev(t *testing.T) *fakeNetDev {
+	dir := t.TempDir()
+	return &fakeNetDev{t: t, proc: filepath.Join(dir, "dev"), sys: filepath.Join(dir, "net")}
+}
+
+func (f *fakeNetDev) write(lines ...string) {
+	f.t.Helper()
+	if err := os.WriteFile(f.proc, []byte(netDevHeader+strings.Join(lines, "")), 0o600); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeNetDev) link(iface string, attrs map[string]string) {
+	f.t.Helper()
+	dir := filepath.Join(f.sys, iface)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		f.t.Fatal(err)
+	}
+	for name, value := range attrs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), 0o600); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+func (f *fakeNetDev) collector(settings string) *NetDev {
+	f.t.Helper()
+	c, err := newNetDev("netdev", json.RawMessage(settings))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	n := c.(*NetDev)
+	n.procFile, n.sysDir = f.proc, f.sys
+	return n
+}
+
+func collectMap(t *testing.T, c Collector) map[string]float64 {
+	t.Helper()
+	m, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect() failed: %v", err)
+	}
+	got := make(map[string]float64, len(m))
+	for _, metric := range m {
+		if v, ok := number(&metric); ok {
+			got[metric.ID] = v
+		}
+	}
+	return got
+}
+
+func number(m *metrics.Metric) (float64, bool) {
+	switch {
+	case m.MType == "counter" && m.Delta != nil:
+		return float64(*m.Delta), true
+	case m.MType == "gauge" && m.Value != nil:
+		return *m.Value, true
+	}
+	return 0, false
+}
+
+func Test_NetDevCollect(t *testing.T) {
+	f := newFakeNetDev(t)
+	f.link("eth0", map[string]string{"ifindex": "2", "operstate": "up", "speed": "1000", "mtu": "1500"})
+	f.link("wlan0", map[string]string{"ifindex": "3", "operstate": "dormant", "speed": "-1", "mtu": "1500"})
+	f.link("lo", map[string]string{"ifindex": "1", "operstate": "unknown", "carrier": "1", "mtu": "65536"})
+	f.link("tun0", map[string]string{"ifindex": "4", "operstate": "unknown", "carrier": "1", "mtu": "1400"})
+	c := f.collector(`{"exclude": ["lo"]}`)
+
+	f.write(netDevLine("lo", 500, 500), netDevLine("eth0", 1000, 2000), netDevLine("wlan0", 10, 20), netDevLine("tun0", 0, 0))
+	got := collectMap(t, c)
+	want := map[string]float64{
+		"net.eth0.rx_bytes": 0, "net.eth0.tx_dropped": 0, "net.wlan0.rx_bytes": 0,
+		"net.eth0.link_up": 1, "net.eth0.speed_mbps": 1000, "net.eth0.mtu": 1500,
+		"net.wlan0.link_up": 0, "net.wlan0.mtu": 1500,
+		"net.tun0.link_up": 1, "net.tun0.mtu": 1400,
+	}
+	for id, v := range want {
+		if got[id] != v {
+			t.Errorf("first poll %s = %v, want %v", id, got[id], v)
+		}
+	}
+	if _, ok := got["net.wlan0.speed_mbps"]; ok {
+		t.Errorf("speed of a link without speed is reported")
+	}
+	if _, ok := got["net.lo.rx_bytes"]; ok {
+		t.Errorf("excluded interface is reported")
+	}
+	if len(got) != 3*8+3+2+2 {
+		t.Errorf("first poll has %d metrics, want %d: %v", len(got), 3*8+3+2+2, got)
+	}
+
+	f.write(netDevLine("lo", 600, 600), netDevLine("eth0", 1500, 2100), netDevLine("wlan0", 15, 20))
+	got = collectMap(t, c)
+	for id, v := range map[string]float64{"net.eth0.rx_bytes": 500, "net.eth0.tx_bytes": 100, "net.eth0.rx_errors": 0, "net.wlan0.rx_bytes": 5} {
+		if got[id] != v {
+			t.Errorf("second poll %s = %v, want %v", id, got[id], v)
+		}
+	}
+
+	// eth0 is recreated, wlan0 and tun0 disappear
+	f.link("eth0", map[string]string{"ifindex": "7"})
+	f.write(netDevLine("eth0", 300, 5000))
+	got = collectMap(t, c)
+	if got["net.eth0.rx_bytes"] != 300 || got["net.eth0.tx_bytes"] != 5000 || got["net.eth0.rx_packets"] != 1 {
+		t.Errorf("after reset rx_bytes = %v, tx_bytes = %v, rx_packets = %v, want 300, 5000, 1",
+			got["net.eth0.rx_bytes"], got["net.eth0.tx_bytes"], got["net.eth0.rx_packets"])
+	}
+	if len(c.state) != 1 {
+		t.Errorf("state of %d interfaces is kept, want 1", len(c.state))
+	}
+}
+
+func Test_NetDevInclude(t *testing.T) {
+	f := newFakeNetDev(t)
+	c := f.collector(`{"include": ["eth*", "bond?"], "exclude": ["eth9"], "prefix": "host1.if."}`)
+	f.write(netDevLine("eth0", 1, 1), netDevLine("eth9", 1, 1), netDevLine("bond0", 1, 1),
+		netDevLine("docker0", 1, 1), netDevLine("eth0.100", 1, 1))
+
+	got := collectMap(t, c)
+	for _, iface := range []string{"eth0", "bond0", "eth0.100"} {
+		if _, ok := got["host1.if."+iface+".rx_bytes"]; !ok {
+			t.Errorf("%s is not reported", iface)
+		}
+	}
+	for _, iface := range []string{"eth9", "docker0"} {
+		if _, ok := got["host1.if."+iface+".rx_bytes"]; ok {
+			t.Errorf("%s is reported", iface)
+		}
+	}
+}
+
+func Test_increase(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur uint64
+		reset     bool
+		want      int64
+	}{
+		{name: "growth", prev: 100, cur: 250, want: 150},
+		{name: "unchanged", prev: 100, cur: 100, want: 0},
+		{name: "32 bit wrap", prev: math.MaxUint32 - 9, cur: 5, want: 15},
+		{name: "drop of a 32 bit total", prev: 1_000_000_000, cur: 10, want: 10},
+		{name: "drop of a 64 bit total", prev: 1 << 40, cur: 10, want: 10},
+		{name: "reset", prev: 100, cur: 250, reset: true, want: 250},
+		{name: "beyond int64", prev: 0, cur: math.MaxUint64, want: math.MaxInt64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := increase(tt.prev, tt.cur, tt.reset); got != tt.want {
+				t.Errorf("increase(%d, %d, %v) = %d, want %d", tt.prev, tt.cur, tt.reset, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_NetDevSettings(t *testing.T) {
+	for _, settings := range []string{`{"include": ["eth["]}`, `{"interfaces": ["eth0"]}`} {
+		if _, err := newNetDev("netdev", json.RawMessage(settings)); err == nil {
+			t.Errorf("settings %s are accepted", settings)
+		}
+	}
+
+	f := newFakeNetDev(t)
+	os.WriteFile(f.proc, []byte(netDevHeader+"  eth0: 1 2 3\n"), 0o600)
+	if _, err := f.collector("").Collect(context.Background()); err == nil || !strings.Contains(err.Error(), "16 columns expected") {
+		t.Errorf("Collect() error = %v, want short line", err)
+	}
+}
@@ -0,0 +1,79 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"metrics-agent/internal/metrics"
+	"runtime"
+)
+
+// Types of the built-in collectors.
+const (
+	RuntimeType   = "runtime"
+	PollCountType = "pollcount"
+	RandomType    = "random"
+)
+
+func init() {
+	Register(RuntimeType, noSettings(func(name string) Collector { return &Runtime{name: name} }))
+	Register(PollCountType, noSettings(func(name string) Collector { return &PollCount{name: name} }))
+	Register(RandomType, noSettings(func(name string) Collector { return &Random{name: name} }))
+}
+
+// noSettings makes the factory of a collector which takes no settings.
+func noSettings(create func(name string) Collector) Factory {
+	return func(name string, settings json.RawMessage) (Collector, error) {
+		if len(settings) != 0 && string(settings) != "null" {
+			return nil, fmt.Errorf("no settings expected")
+		}
+		return create(name), nil
+	}
+}
+
+// Runtime reports the gauges of metrics.MetricList from runtime.MemStats.
+type Runtime struct {
+	name string
+}
+
+func (c *Runtime) Name() string { return c.name }
+
+func (c *Runtime) Collect(ctx context.Context) ([]metrics.Metric, error) {
+	var r runtime.MemStats
+	runtime.ReadMemStats(&r)
+
+	m := make([]metrics.Metric, 0, len(metrics.MetricList))
+	for _, name := range metrics.MetricList {
+		value, err := metrics.RuntimeMetric(&r, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		m = append(m, metrics.Metric{ID: name, MType: "gauge", Value: &value})
+	}
+	return m, nil
+}
+
+// PollCount counts the polls with the PollCount counter.
+type PollCount struct {
+	name string
+}
+
+func (c *PollCount) Name() string { return c.name }
+
+func (c *PollCount) Collect(ctx context.Context) ([]metrics.Metric, error) {
+	delta := int64(1)
+	return []metrics.Metric{{ID: "PollCount", MType: "counter", Delta: &delta}}, nil
+}
+
+// Random reports the RandomValue gauge.
+type Random struct {
+	name string
+}
+
+func (c *Random) Name() string { return c.name }
+
+func (c *Random) Collect(ctx context.Context) ([]metrics.Metric, error) {
+	value := rand.Float64()
+	return []metrics.Metric{{ID: "RandomValue", MType: "gauge", Value: &value}}, nil
+}
@@ -0,0 +1,183 @@
+package collector
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"metrics-agent/internal/metrics"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	TCPProbeType = "tcpprobe"
+
+	// DefaultProbePrefix starts the names of the metrics of targets.
+	DefaultProbePrefix = "probe."
+
+	// DefaultProbeTimeout limits a connect without timeout in the settings.
+	DefaultProbeTimeout = time.Second
+
+	// DefaultProbeConcurrency is how many targets are probed at once without
+	// concurrency in the settings.
+	DefaultProbeConcurrency = 8
+
+	// maxProbeReserve caps the time a round leaves before the deadline of
+	// the collector to return its results, a tenth of the time left.
+	maxProbeReserve = 100 * time.Millisecond
+)
+
+func init() {
+	Register(TCPProbeType, newTCPProbe)
+}
+
+// TCPProbeSettings configure a tcpprobe collector. A round of probes should
+// fit in the timeout of the collector entry: with n targets it takes up to
+// n/Concurrency times Timeout. A round which does not fit ends a little
+// before the timeout: the unfinished probes are failures, the targets not
+// probed yet are left out.
+type TCPProbeSettings struct {
+	Targets     []string `json:"targets"`               // host:port
+	Interval    Duration `json:"interval,omitzero"`     // between rounds, every poll if zero
+	Timeout     Duration `json:"timeout,omitzero"`      // of a connect, 1s by default
+	Concurrency int      `json:"concurrency,omitempty"` // connects at once, 8 by default
+	Prefix      string   `json:"prefix,omitempty"`      // probe. by default
+}
+
+// TCPProbe connects to targets and reports for each of them, as
+// <prefix><host:port>.<name>: the reachable gauge, 1 if the connect has
+// succeeded and 0 otherwise, the successes and failures counters, and the
+// connect_ms gauge with the time the connect took, name resolution
+// included, when it has succeeded. The connection is closed at once.
+type TCPProbe struct {
+	name     string
+	settings TCPProbeSettings
+	ids      []string // metric names of the targets without a suffix
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+
+	mu      sync.Mutex
+	lastRun time.Time
+}
+
+func newTCPProbe(name string, raw json.RawMessage) (Collector, error) {
+	var s TCPProbeSettings
+	if raw == nil {
+		return nil, fmt.Errorf("settings with targets expected")
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("cannot parse settings: %v", err)
+	}
+	if len(s.Targets) == 0 {
+		return nil, fmt.Errorf("targets expected")
+	}
+	if s.Timeout < 0 || s.Concurrency < 0 {
+		return nil, fmt.Errorf("timeout and concurrency must not be negative")
+	}
+	s.Timeout = cmp.Or(s.Timeout, Duration(DefaultProbeTimeout))
+	s.Concurrency = cmp.Or(s.Concurrency, DefaultProbeConcurrency)
+	s.Prefix = cmp.Or(s.Prefix, DefaultProbePrefix)
+
+	c := &TCPProbe{name: name, settings: s, dial: (&net.Dialer{}).DialContext}
+	targets := make(map[string]string, len(s.Targets))
+	for _, target := range s.Targets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("target %q: %v", target, err)
+		}
+		id := s.Prefix + metrics.SanitizeID(target)
+		if other, ok := targets[id]; ok {
+			return nil, fmt.Errorf("targets %q and %q have the same name %s", other, target, id)
+		}
+		targets[id] = target
+		c.ids = append(c.ids, id)
+	}
+	return c, nil
+}
+
+func (c *TCPProbe) Name() string { return c.name }
+
+// Collect probes the targets if the interval has passed since the last
+// round, it returns no metrics otherwise. The round ends before the
+// deadline of ctx, so that the probes done are reported.
+func (c *TCPProbe) Collect(ctx context.Context) ([]metrics.Metric, error) {
+	c.mu.Lock()
+	now := time.Now()
+	if !c.lastRun.IsZero() && now.Sub(c.lastRun) < time.Duration(c.settings.Interval) {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	c.lastRun = now
+	c.mu.Unlock()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		reserve := min(time.Until(deadline)/10, maxProbeReserve)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-reserve))
+		defer cancel()
+	}
+
+	results := make([][]metrics.Metric, len(c.settings.Targets))
+	slots := make(chan struct{}, c.settings.Concurrency)
+	var wg sync.WaitGroup
+	started := 0
+	for i, target := range c.settings.Targets {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		started++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = c.probe(ctx, c.ids[i], target)
+		}()
+	}
+	wg.Wait()
+
+	if started == 0 {
+		return nil, fmt.Errorf("no target is probed: %v", ctx.Err())
+	}
+	if started < len(results) {
+		log.Printf("Collector %s: %d of %d targets are not probed in time\n", c.name, len(results)-started, len(results))
+	}
+	m := make([]metrics.Metric, 0, 4*started)
+	for _, r := range results {
+		m = append(m, r...)
+	}
+	return m, nil
+}
+
+// probe connects to a target once.
+func (c *TCPProbe) probe(ctx context.Context, id, target string) []metrics.Metric {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.settings.Timeout))
+	defer cancel()
+
+	start := time.Now()
+	conn, err := c.dial(ctx, "tcp", target)
+	elapsed := time.Since(start)
+
+	reachable, successes, failures := 0.0, int64(0), int64(1)
+	if err == nil {
+		conn.Close()
+		reachable, successes, failures = 1, 1, 0
+	}
+	m := []metrics.Metric{
+		{ID: id + ".reachable", MType: "gauge", Value: &reachable},
+		{ID: id + ".successes", MType: "counter", Delta: &successes},
+		{ID: id + ".failures", MType: "counter", Delta: &failures},
+	}
+	if err == nil {
+		ms := float64(elapsed) / float64(time.Millisecond)
+		m = append(m, metrics.Metric{ID: id + ".connect_ms", MType: "gauge", Value: &ms})
+	}
+	return m
+}
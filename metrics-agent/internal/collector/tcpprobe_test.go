@@ -0,0 +1,201 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestProbe(t *testing.T, settings string) *TCPProbe {
+	t.Helper()
+	c, err := newTCPProbe("probe", json.RawMessage(settings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*TCPProbe)
+}
+
+// closedAddress returns the address of a port nothing listens on.
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func Test_TCPProbeCollect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	open, closed := l.Addr().String(), closedAddress(t)
+
+	c := newTestProbe(t, `{"targets": ["`+open+`", "`+closed+`"]}`)
+	got := collectMap(t, c)
+	for id, v := range map[string]float64{
+		"probe." + open + ".reachable": 1, "probe." + open + ".successes": 1, "probe." + open + ".failures": 0,
+		"probe." + closed + ".reachable": 0, "probe." + closed + ".successes": 0, "probe." + closed + ".failures": 1,
+	} {
+		if got[id] != v {
+			t.Errorf("%s = %v, want %v", id, got[id], v)
+		}
+	}
+	if ms, ok := got["probe."+open+".connect_ms"]; !ok || ms < 0 || ms > 1000 {
+		t.Errorf("connect_ms of the open port = %v, %v", ms, ok)
+	}
+	if _, ok := got["probe."+closed+".connect_ms"]; ok {
+		t.Errorf("connect_ms of a failed probe is reported")
+	}
+}
+
+func Test_TCPProbeTimeout(t *testing.T) {
+	c := newTestProbe(t, `{"targets": ["a:1", "b:1", "c:1", "d:1"], "timeout": "50ms", "concurrency": 2, "prefix": "p."}`)
+	var (
+		mu            sync.Mutex
+		running, most int
+	)
+	c.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		<-ctx.Done()
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil, ctx.Err()
+	}
+
+	start := time.Now()
+	got := collectMap(t, c)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("4 probes of 50ms by 2 took %v", elapsed)
+	}
+	if most != 2 {
+		t.Errorf("%d probes ran at once, want 2", most)
+	}
+	for _, target := range []string{"a:1", "b:1", "c:1", "d:1"} {
+		if got["p."+target+".failures"] != 1 || got["p."+target+".reachable"] != 0 {
+			t.Errorf("timed out probe of %s is not a failure: %v", target, got)
+		}
+	}
+}
+
+func Test_TCPProbeRegistryDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	open := l.Addr().String()
+
+	// the timeout of a connect is the one of the collector
+	tests := []struct {
+		name        string
+		settings    string
+		want        map[string]float64
+		wantMissing string
+	}{
+		{
+			name:     "every target probed",
+			settings: `{"targets": ["silent:1", "` + open + `", "silent:2"], "timeout": "200ms", "concurrency": 2}`,
+			want:     map[string]float64{"probe.silent:1.failures": 1, "probe." + open + ".reachable": 1, "probe.silent:2.failures": 1},
+		},
+		{
+			name:        "target without a slot left out",
+			settings:    `{"targets": ["silent:1", "` + open + `"], "timeout": "200ms", "concurrency": 1}`,
+			want:        map[string]float64{"probe.silent:1.failures": 1},
+			wantMissing: "probe." + open + ".reachable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Collectors: []Entry{{Type: TCPProbeType, Timeout: Duration(200 * time.Millisecond), Settings: json.RawMessage(tt.settings)}}}
+			r, err := NewRegistry(cfg, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.entries[0].collector.(*TCPProbe).dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+				if address == open {
+					return (&net.Dialer{}).DialContext(ctx, network, address)
+				}
+				// a target which never answers
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+
+			got := make(map[string]float64)
+			for _, m := range r.Collect(context.Background()) {
+				if m.Value != nil {
+					got[m.ID] = *m.Value
+				} else {
+					got[m.ID] = float64(*m.Delta)
+				}
+			}
+			for id, v := range tt.want {
+				if value, ok := got[id]; !ok || value != v {
+					t.Errorf("%s = %v, %v, want %v", id, value, ok, v)
+				}
+			}
+			if _, ok := got[tt.wantMissing]; ok {
+				t.Errorf("%s is reported: %v", tt.wantMissing, got)
+			}
+		})
+	}
+}
+
+func Test_TCPProbeInterval(t *testing.T) {
+	c := newTestProbe(t, `{"targets": ["`+closedAddress(t)+`"], "interval": "1h"}`)
+	first, err := c.Collect(context.Background())
+	if err != nil || len(first) != 3 {
+		t.Fatalf("first Collect() = %v, %v", first, err)
+	}
+	second, err := c.Collect(context.Background())
+	if err != nil || len(second) != 0 {
+		t.Errorf("Collect() within the interval = %v, %v, want nothing", second, err)
+	}
+}
+
+func Test_NewTCPProbeErrors(t *testing.T) {
+	for _, settings := range []string{
+		``,
+		`{}`,
+		`{"targets": []}`,
+		`{"targets": ["localhost"]}`,
+		`{"targets": ["a b:1", "a_b:1"]}`,
+		`{"targets": ["a:1", "a:1"]}`,
+		`{"targets": ["a:1"], "timeout": "-1s"}`,
+		`{"targets": ["a:1"], "concurrency": -1}`,
+		`{"targets": ["a:1"], "port": 80}`,
+	} {
+		if _, err := newTCPProbe("probe", json.RawMessage(settings)); err == nil {
+			t.Errorf("settings %q are accepted", settings)
+		}
+	}
+}
@@ -3,14 +3,31 @@ package config
 import (
 	"flag"
 	"fmt"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 )
 
 type Config struct {
-	Addr           string `env:"ADDRESS"`
-	ReportInterval int    `env:"REPORT_INTERVAL"`
-	PollInterval   int    `env:"POLL_INTERVAL"`
+	Addr           string        `env:"ADDRESS"`
+	ReportInterval int           `env:"REPORT_INTERVAL"`
+	PollInterval   int           `env:"POLL_INTERVAL"`
+	Token          string        `env:"API_TOKEN"`
+	TLS            bool          `env:"TLS"`
+	CACert         string        `env:"CA_CERT"`
+	ClientCert     string        `env:"CLIENT_CERT"`
+	ClientKey      string        `env:"CLIENT_KEY"`
+	Collectors     string        `env:"COLLECTORS_CONFIG"`
+	CollectTimeout time.Duration `env:"COLLECT_TIMEOUT"`
+	StatsdAddr     string        `env:"STATSD_ADDR"`
+	StatsdTCPAddr  string        `env:"STATSD_TCP_ADDR"`
+	GaugeStats     bool          `env:"GAUGE_STATS"`
+	ChangedOnly    bool          `env:"CHANGED_ONLY"`
+	Resync         time.Duration `env:"RESYNC_INTERVAL"`
+	Timeout        time.Duration `env:"REQUEST_TIMEOUT"`
+	QueueDir       string        `env:"QUEUE_DIR"`
+	QueueMaxBytes  int64         `env:"QUEUE_MAX_BYTES"`
+	QueueMaxAge    time.Duration `env:"QUEUE_MAX_AGE"`
 }
 
 func (cfg *Config) Get() error {
@@ -23,6 +40,22 @@ func (cfg *Config) Get() error {
 	addr := flag.String("a", "localhost:8080", "Server address")
 	reportInterval := flag.Int("r", 10, "Report interval")
 	pollInterval := flag.Int("p", 2, "Poll interval")
+	token := flag.String("token", "", "API key token of the server, not sent if empty")
+	tlsFlag := flag.Bool("tls", false, "Send metrics over HTTPS")
+	caCert := flag.String("ca-cert", "", "PEM CA bundle to verify the server, system roots if empty")
+	clientCert := flag.String("client-cert", "", "PEM client certificate for mutual TLS")
+	clientKey := flag.String("client-key", "", "PEM private key of the client certificate")
+	collectors := flag.String("collectors", "", "JSON file with collectors config, runtime, pollcount and random if empty")
+	collectTimeout := flag.Duration("collect-timeout", time.Second, "Timeout of a collector without its own")
+	statsdAddr := flag.String("statsd", "", "UDP address to receive StatsD metrics on, like :8125, off if empty")
+	statsdTCPAddr := flag.String("statsd-tcp", "", "TCP address to receive StatsD metrics on, off if empty")
+	gaugeStats := flag.Bool("stats", false, "Also send min, max and avg of gauges over the report interval")
+	changedOnly := flag.Bool("changed-only", false, "Send only changed gauges and non-zero counters")
+	resync := flag.Duration("resync", 5*time.Minute, "Interval of complete batches with -changed-only")
+	timeout := flag.Duration("timeout", 10*time.Second, "Timeout of a request to the server")
+	queueDir := flag.String("queue-dir", "", "Directory to keep unsent batches in, not kept if empty")
+	queueMaxBytes := flag.Int64("queue-max-bytes", 10<<20, "Size limit of the queue, batches are merged when it is reached")
+	queueMaxAge := flag.Duration("queue-max-age", 24*time.Hour, "Age limit of queued batches")
 	flag.Parse()
 
 	if cfg.Addr == "" {
@@ -34,6 +67,54 @@ func (cfg *Config) Get() error {
 	if cfg.PollInterval == 0 {
 		cfg.PollInterval = *pollInterval
 	}
+	if cfg.Token == "" {
+		cfg.Token = *token
+	}
+	if !cfg.TLS {
+		cfg.TLS = *tlsFlag
+	}
+	if cfg.CACert == "" {
+		cfg.CACert = *caCert
+	}
+	if cfg.ClientCert == "" {
+		cfg.ClientCert = *clientCert
+	}
+	if cfg.ClientKey == "" {
+		cfg.ClientKey = *clientKey
+	}
+	if cfg.Collectors == "" {
+		cfg.Collectors = *collectors
+	}
+	if cfg.CollectTimeout == 0 {
+		cfg.CollectTimeout = *collectTimeout
+	}
+	if cfg.StatsdAddr == "" {
+		cfg.StatsdAddr = *statsdAddr
+	}
+	if cfg.StatsdTCPAddr == "" {
+		cfg.StatsdTCPAddr = *statsdTCPAddr
+	}
+	if !cfg.GaugeStats {
+		cfg.GaugeStats = *gaugeStats
+	}
+	if !cfg.ChangedOnly {
+		cfg.ChangedOnly = *changedOnly
+	}
+	if cfg.Resync == 0 {
+		cfg.Resync = *resync
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = *timeout
+	}
+	if cfg.QueueDir == "" {
+		cfg.QueueDir = *queueDir
+	}
+	if cfg.QueueMaxBytes == 0 {
+		cfg.QueueMaxBytes = *queueMaxBytes
+	}
+	if cfg.QueueMaxAge == 0 {
+		cfg.QueueMaxAge = *queueMaxAge
+	}
 
 	return nil
 }
@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"reflect"
 	"runtime"
+	"strings"
 )
 
+// MaxIDLength is the longest ID the server takes.
+const MaxIDLength = 255
+
 type Metric struct {
 	ID    string   `json:"id"`              // имя метрики
 	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
@@ -47,8 +51,13 @@ var MetricList = []string{
 func GetRuntimeMetric(name string) (float64, error) {
 	var r runtime.MemStats
 	runtime.ReadMemStats(&r)
+	return RuntimeMetric(&r, name)
+}
 
-	v := reflect.ValueOf(r)
+// RuntimeMetric returns the field name of r, to read several metrics from
+// one runtime.ReadMemStats.
+func RuntimeMetric(r *runtime.MemStats, name string) (float64, error) {
+	v := reflect.ValueOf(*r)
 	fieldValue := v.FieldByName(name)
 	if !fieldValue.IsValid() {
 		return 0, errors.New("value not found")
@@ -65,3 +74,18 @@ func GetRuntimeMetric(name string) (float64, error) {
 		return 0, fmt.Errorf("unknown type %v", metric)
 	}
 }
+
+// SanitizeID replaces the characters the server does not take in IDs, all
+// but letters, digits and _.:-, with _.
+func SanitizeID(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '_', r == '.', r == ':', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -36,3 +36,15 @@ func Test_GetRuntimeMetric(t *testing.T) {
 		})
 	}
 }
+
+func Test_SanitizeID(t *testing.T) {
+	for name, want := range map[string]string{
+		"net.eth0:1.rx-bytes_total": "net.eth0:1.rx-bytes_total",
+		"disk /dev/sda":             "disk__dev_sda",
+		"température":               "temp_rature",
+	} {
+		if got := SanitizeID(name); got != want {
+			t.Errorf("SanitizeID(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Package statsd receives StatsD metrics from local applications and
+// aggregates them until the agent reports.
+package statsd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"metrics-agent/internal/agent"
+	"metrics-agent/internal/metrics"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxPacket is the largest UDP datagram.
+	maxPacket = 65535
+	// maxLine caps a line on TCP.
+	maxLine = 64 * 1024
+	// maxName leaves room for suffixes within the ID limit of the server.
+	maxName = metrics.MaxIDLength - 15
+
+	// CountSuffix names the counter of samples of a timer.
+	CountSuffix = "_count"
+	// BadLines counts the lines which could not be parsed.
+	BadLines = "StatsdBadLines"
+
+	// StaleAfter is the number of report intervals a gauge is kept without
+	// being set.
+	StaleAfter = 60
+)
+
+// Server takes StatsD lines, "<name>:<value>|<type>[|@<rate>][|#<tags>]",
+// of counters (c), gauges (g, relative with a sign) and timers (ms, h).
+// Over a report interval deltas of a counter are summed (and scaled up by the
+// sample rate), a gauge keeps its
+// last value and a timer is sent as the counter <name>_count and the gauges
+// <name>_min, <name>_max and <name>_avg. Tags are ignored. A gauge not set
+// for StaleAfter intervals is forgotten.
+type Server struct {
+	mu       sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	updated  map[string]bool // gauges set in the interval
+	idle     map[string]int  // intervals since a gauge was set
+	timers   map[string]*timer
+	bad      int64
+
+	conns  []net.PacketConn
+	ls     []net.Listener
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+type timer struct {
+	count         float64 // samples scaled by the sample rate
+	samples       int
+	min, max, sum float64
+}
+
+func New() *Server {
+	return &Server{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		updated:  make(map[string]bool),
+		idle:     make(map[string]int),
+		timers:   make(map[string]*timer),
+		closed:   make(chan struct{}),
+	}
+}
+
+// ListenUDP receives datagrams of lines on addr.
+func (s *Server) ListenUDP(addr string) (net.Addr, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for StatsD: %v", err)
+	}
+	s.conns = append(s.conns, conn)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		buf := make([]byte, maxPacket)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !s.isClosed() {
+					log.Printf("StatsD UDP read error: %v\n", err)
+				}
+				return
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				s.handle(line)
+			}
+		}
+	}()
+	return conn.LocalAddr(), nil
+}
+
+// ListenTCP receives streams of lines on addr.
+func (s *Server) ListenTCP(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for StatsD: %v", err)
+	}
+	s.ls = append(s.ls, l)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !s.isClosed() {
+					log.Printf("StatsD TCP accept error: %v\n", err)
+				}
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+	return l.Addr(), nil
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// the connection is closed on Close
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.closed:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxLine)
+	for scanner.Scan() {
+		s.handle(scanner.Text())
+	}
+}
+
+func (s *Server) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the listeners and waits for the connections to end.
+func (s *Server) Close() error {
+	close(s.closed)
+	var errs []error
+	for _, c := range s.conns {
+		errs = append(errs, c.Close())
+	}
+	for _, l := range s.ls {
+		errs = append(errs, l.Close())
+	}
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *Server) handle(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if err := s.Handle(line); err != nil {
+		s.mu.Lock()
+		s.bad++
+		s.mu.Unlock()
+	}
+}
+
+// Handle takes one line.
+func (s *Server) Handle(line string) error {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return fmt.Errorf("no name in %q", line)
+	}
+	if len(name) > maxName {
+		return fmt.Errorf("name of %d bytes is too long", len(name))
+	}
+	name = metrics.SanitizeID(name)
+
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return fmt.Errorf("no type in %q", line)
+	}
+	raw, typ := fields[0], fields[1]
+
+	rate := 1.0
+	for _, f := range fields[2:] {
+		if r, ok := strings.CutPrefix(f, "@"); ok {
+			v, err := strconv.ParseFloat(r, 64)
+			if err != nil || v <= 0 || v > 1 {
+				return fmt.Errorf("bad sample rate in %q", line)
+			}
+			rate = v
+		}
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("bad value in %q", line)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch typ {
+	case "c":
+		s.counters[name] += value / rate
+	case "g":
+		if raw[0] == '+' || raw[0] == '-' {
+			s.gauges[name] += value
+		} else {
+			s.gauges[name] = value
+		}
+		s.updated[name] = true
+	case "ms", "h":
+		t, ok := s.timers[name]
+		if !ok {
+			t = &timer{min: value, max: value}
+			s.timers[name] = t
+		}
+		t.count += 1 / rate
+		t.min = min(t.min, value)
+		t.max = max(t.max, value)
+		t.sum += value
+		t.samples++
+	default:
+		return fmt.Errorf("unknown type %q", typ)
+	}
+	return nil
+}
+
+// Flush returns the metrics received since the previous flush, sorted by
+// name, and starts a new interval. Gauges keep their values for relative
+// updates, but are sent only when set in the interval.
+func (s *Server) Flush() []*metrics.Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var batch []*metrics.Metric
+	counter := func(id string, delta int64) {
+		batch = append(batch, &metrics.Metric{ID: id, MType: "counter", Delta: &delta})
+	}
+	gauge := func(id string, value float64) {
+		batch = append(batch, &metrics.Metric{ID: id, MType: "gauge", Value: &value})
+	}
+
+	// sampled counters may sum to fractions, the rest is carried over
+	for _, name := range sortedKeys(s.counters) {
+		delta := math.Round(s.counters[name])
+		s.counters[name] -= delta
+		if delta != 0 {
+			counter(name, int64(delta))
+		}
+		if s.counters[name] == 0 {
+			delete(s.counters, name)
+		}
+	}
+	for _, name := range sortedKeys(s.updated) {
+		gauge(name, s.gauges[name])
+	}
+	s.sweep()
+	for _, name := range sortedKeys(s.timers) {
+		t := s.timers[name]
+		counter(name+CountSuffix, int64(math.Round(t.count)))
+		gauge(name+agent.MinSuffix, t.min)
+		gauge(name+agent.MaxSuffix, t.max)
+		gauge(name+agent.AvgSuffix, t.sum/float64(t.samples))
+	}
+	if s.bad > 0 {
+		counter(BadLines, s.bad)
+	}
+
+	clear(s.updated)
+	clear(s.timers)
+	s.bad = 0
+	return batch
+}
+
+// sweep drops the gauges which have not been set for StaleAfter intervals,
+// a relative update of them starts from 0 again.
+func (s *Server) sweep() {
+	for name := range s.gauges {
+		if s.updated[name] {
+			delete(s.idle, name)
+			continue
+		}
+		s.idle[name]++
+		if s.idle[name] >= StaleAfter {
+			delete(s.gauges, name)
+			delete(s.idle, name)
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,218 @@
+package statsd
+
+import (
+	"fmt"
+	"metrics-agent/internal/metrics"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// values returns the metrics of a batch as name=value.
+func values(batch []*metrics.Metric) map[string]float64 {
+	got := make(map[string]float64)
+	for _, m := range batch {
+		if m.MType == "counter" {
+			got[m.ID] = float64(*m.Delta)
+		} else {
+			got[m.ID] = *m.Value
+		}
+	}
+	return got
+}
+
+func Test_Handle(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		wantErr bool
+	}{
+		{name: "counter", line: "api.requests:1|c"},
+		{name: "sampled counter", line: "api.requests:1|c|@0.1"},
+		{name: "gauge", line: "queue.size:42|g"},
+		{name: "timer with tags", line: "api.latency:12.5|ms|#route:/users"},
+		{name: "histogram", line: "api.size:512|h"},
+		{name: "no value", line: "api.requests|c", wantErr: true},
+		{name: "no type", line: "api.requests:1", wantErr: true},
+		{name: "unknown type", line: "api.requests:1|s", wantErr: true},
+		{name: "bad value", line: "api.requests:many|c", wantErr: true},
+		{name: "bad rate", line: "api.requests:1|c|@2", wantErr: true},
+		{name: "long name", line: strings.Repeat("a", 300) + ":1|c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := New().Handle(tt.line); (err != nil) != tt.wantErr {
+				t.Errorf("Handle(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_Flush(t *testing.T) {
+	s := New()
+	for _, line := range []string{
+		"api.requests:1|c",
+		"api.requests:2|c",
+		"api.errors:1|c|@0.5",
+		"queue.size:10|g",
+		"queue.size:+5|g",
+		"conns:3|g",
+		"conns:-1|g",
+		"api.latency:10|ms",
+		"api.latency:30|ms",
+		"api.latency:20|ms",
+		"user/profile:1|c",
+		"garbage",
+	} {
+		s.handle(line)
+	}
+
+	got := values(s.Flush())
+	want := map[string]float64{
+		"api.requests":      3,
+		"api.errors":        2,
+		"queue.size":        15,
+		"conns":             2,
+		"api.latency_count": 3,
+		"api.latency_min":   10,
+		"api.latency_max":   30,
+		"api.latency_avg":   20,
+		"user_profile":      1,
+		BadLines:            1,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Flush() = %v, want %v", got, want)
+	}
+
+	// gauges are kept for relative updates, but sent only when set
+	s.handle("queue.size:-3|g")
+	got = values(s.Flush())
+	if fmt.Sprint(got) != fmt.Sprint(map[string]float64{"queue.size": 12}) {
+		t.Errorf("second Flush() = %v, want queue.size=12 only", got)
+	}
+}
+
+func Test_FlushStaleGauges(t *testing.T) {
+	s := New()
+	s.Handle("queue.size:10|g")
+	s.Handle("conns:3|g")
+	s.Flush()
+	for i := 1; i < StaleAfter; i++ {
+		s.Handle("conns:+1|g")
+		s.Flush()
+	}
+	if len(s.gauges) != 2 {
+		t.Fatalf("gauges = %v, want both kept until StaleAfter", s.gauges)
+	}
+
+	s.Flush()
+	if _, ok := s.gauges["queue.size"]; ok || len(s.gauges) != 1 {
+		t.Errorf("gauges = %v, want queue.size dropped", s.gauges)
+	}
+	s.Handle("queue.size:+2|g")
+	got := values(s.Flush())
+	if got["queue.size"] != 2 {
+		t.Errorf("queue.size = %v after a relative update of a dropped gauge, want 2", got["queue.size"])
+	}
+}
+
+func Test_FlushCarriesFractions(t *testing.T) {
+	s := New()
+	total := 0.0
+	for i := 0; i < 4; i++ {
+		// 0.25 a sample, scaled by the rate of 0.5: 0.5 an interval
+		s.Handle("jobs:0.25|c|@0.5")
+		total += values(s.Flush())["jobs"]
+	}
+	if total != 2 {
+		t.Errorf("counters sum to %v over the intervals, want 2", total)
+	}
+}
+
+// waitFor flushes s until name shows up.
+func waitFor(t *testing.T, s *Server, name string) map[string]float64 {
+	t.Helper()
+	got := make(map[string]float64)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for k, v := range values(s.Flush()) {
+			got[k] += v
+		}
+		if _, ok := got[name]; ok {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s is not received, got %v", name, got)
+	return nil
+}
+
+func Test_Listeners(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	udpAddr, err := s.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpAddr, err := s.ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udp, err := net.Dial("udp", udpAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	if _, err := udp.Write([]byte("udp.hits:2|c\nudp.temp:36.6|g\n")); err != nil {
+		t.Fatal(err)
+	}
+	got := waitFor(t, s, "udp.temp")
+	if got["udp.hits"] != 2 || got["udp.temp"] != 36.6 {
+		t.Errorf("UDP metrics = %v", got)
+	}
+
+	tcp, err := net.Dial("tcp", tcpAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if _, err := fmt.Fprint(tcp, "tcp.hits:1|c\ntcp.hits:4|c\ntcp.done:1|g\n"); err != nil {
+		t.Fatal(err)
+	}
+	got = waitFor(t, s, "tcp.done")
+	if got["tcp.hits"] != 5 {
+		t.Errorf("TCP metrics = %v", got)
+	}
+}
+
+func Test_Close(t *testing.T) {
+	s := New()
+	tcpAddr, err := s.ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ListenUDP("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an idle connection does not hold Close up
+	conn, err := net.Dial("tcp", tcpAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	done := make(chan error)
+	go func() { done <- s.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Close() failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close() hangs")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"metrics-server/internal/auth"
+	"metrics-server/internal/config"
+	"metrics-server/internal/storage/postgres"
+	"metrics-server/internal/usecase"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const keysUsage = `Usage:
+  server keys [-auth-keys file | -d dsn] create [-tenant name] [-scopes read,write,admin]
+  server keys [-auth-keys file | -d dsn] revoke <key ID>
+  server keys [-auth-keys file | -d dsn] list`
+
+// keysCommand manages API keys in the store the server uses: the database
+// if a DSN is given, otherwise the keys file. AUTH_KEYS and DATABASE_DSN
+// override the flags like they do for the server.
+func keysCommand(args []string) error {
+	fs := flag.NewFlagSet("keys", flag.ContinueOnError)
+	keysFile := fs.String("auth-keys", config.DefaultKeysFile, "File with API keys.")
+	dsn := fs.String("d", "", "PostrgeSQL DSN, keys are kept in the database if set.")
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), keysUsage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if v := os.Getenv("AUTH_KEYS"); v != "" {
+		*keysFile = v
+	}
+	if v := os.Getenv("DATABASE_DSN"); v != "" {
+		*dsn = v
+	}
+
+	var store auth.Store
+	if *dsn != "" {
+		db, err := postgres.NewPsqlStorage(*dsn)
+		if err != nil {
+			return err
+		}
+		defer db.DB.Close()
+		if store, err = auth.NewPsqlStore(db.DB); err != nil {
+			return err
+		}
+	} else {
+		store = auth.NewFileStore(*keysFile)
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no keys command")
+	}
+
+	switch fs.Arg(0) {
+	case "create":
+		return createKey(store, fs.Args()[1:])
+	case "revoke":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return fmt.Errorf("key ID expected")
+		}
+		if err := store.Revoke(fs.Arg(1)); err != nil {
+			return err
+		}
+		fmt.Println("Revoked", fs.Arg(1))
+		return nil
+	case "list":
+		return listKeys(store)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown keys command %q", fs.Arg(0))
+	}
+}
+
+func createKey(store auth.Store, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	tenant := fs.String("tenant", usecase.DefaultTenant, "Tenant of the key.")
+	scopes := fs.String("scopes", auth.ScopeRead+","+auth.ScopeWrite, "Comma separated scopes: read, write, admin.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	token, key, err := auth.NewKey(*tenant, strings.Split(*scopes, ","))
+	if err != nil {
+		return err
+	}
+	if err := store.Create(key); err != nil {
+		return err
+	}
+
+	fmt.Println("Key", key.ID, "created, the token is shown only once:")
+	fmt.Println(token)
+	return nil
+}
+
+func listKeys(store auth.Store) error {
+	keys, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTENANT\tSCOPES\tCREATED\tREVOKED")
+	for _, k := range keys {
+		revoked := "-"
+		if k.Revoked() {
+			revoked = k.RevokedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", k.ID, k.Tenant, strings.Join(k.Scopes, ","), k.Created.Format(time.RFC3339), revoked)
+	}
+	return w.Flush()
+}
@@ -4,7 +4,6 @@ import (
 	"log"
 	"metrics-server/internal/config"
 	"metrics-server/internal/server"
-	"metrics-server/internal/storage"
 	"metrics-server/internal/usecase/context"
 	"os"
 )
@@ -16,6 +15,14 @@ func main() {
 
 	log.SetOutput(os.Stdout)
 
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := keysCommand(os.Args[2:]); err != nil {
+			log.Printf("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	err = cfg.Get()
 	if err != nil {
 		log.Printf("%v", err)
@@ -28,17 +35,46 @@ func main() {
 		return
 	}
 
-	if cfg.Restore {
-		err := app.DB.Restore(cfg.FileStoragePath)
-		if err != nil {
+	// PostgreSQL keeps its data itself, snapshots are for the in-memory storage
+	if app.Dumper != nil {
+		if cfg.Restore.Enabled {
+			snapshots, err := app.Dumper.Restore(cfg.Restore.Snapshot)
+			if err != nil {
+				app.Log.Fatalf("%v", err)
+				return
+			}
+			for _, snapshot := range snapshots {
+				app.Log.Infoln("Restored from", snapshot.Path)
+			}
+		}
+
+		app.Dumper.Start()
+	}
+
+	if app.Alerts != nil {
+		app.Alerts.Start()
+	}
+
+	if app.Graphite != nil {
+		if err := app.Graphite.Start(cfg.GraphiteAddr); err != nil {
 			app.Log.Fatalf("%v", err)
 			return
 		}
 	}
 
-	if cfg.StoreInterval > 0 {
-		go storage.Dumper(app)
+	server.HTTPServer(app)
+
+	if app.Graphite != nil {
+		app.Graphite.Stop()
 	}
 
-	server.HTTPServer(app)
+	if app.Alerts != nil {
+		app.Alerts.Stop()
+	}
+
+	if app.Dumper != nil {
+		if err := app.Dumper.Stop(); err != nil {
+			app.Log.Errorln("Final dump failed:", err)
+		}
+	}
 }
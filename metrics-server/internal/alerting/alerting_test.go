@@ -0,0 +1,227 @@
+package alerting
+
+import (
+	"encoding/json"
+	"metrics-server/internal/storage/memory"
+	"metrics-server/internal/usecase"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type recorder struct {
+	states []State
+}
+
+func (r *recorder) Notify(alert Alert) {
+	r.states = append(r.states, alert.State)
+}
+
+func (r *recorder) Close() {}
+
+func Test_EngineTransitions(t *testing.T) {
+	db := memory.NewMemStorage()
+	setGauge := func(v float64) {
+		_, err := db.Set(&usecase.Metric{ID: "HeapInuse", MType: "gauge", Value: &v})
+		require.NoError(t, err)
+	}
+
+	rules := []Rule{{Name: "heap", Metric: "HeapInuse", MType: "gauge", Condition: GreaterThan, Threshold: 100, For: Duration(2 * time.Minute)}}
+	rec := &recorder{}
+	e := NewEngine(db, rules, rec, zap.NewNop().Sugar(), time.Second)
+	now := time.Now()
+	e.now = func() time.Time { return now }
+
+	steps := []struct {
+		value  float64
+		after  time.Duration
+		active State
+	}{
+		{value: 50, after: 0, active: ""},
+		{value: 150, after: time.Minute, active: Pending},
+		{value: 150, after: time.Minute, active: Pending},
+		{value: 150, after: time.Minute, active: Firing},
+		{value: 150, after: time.Minute, active: Firing},
+		{value: 50, after: time.Minute, active: ""},
+		{value: 150, after: time.Minute, active: Pending},
+		{value: 50, after: time.Minute, active: ""},
+	}
+	for i, s := range steps {
+		now = now.Add(s.after)
+		setGauge(s.value)
+		e.Evaluate()
+
+		active := e.Active(usecase.DefaultTenant)
+		if s.active == "" {
+			assert.Empty(t, active, "step %d", i)
+			continue
+		}
+		require.Len(t, active, 1, "step %d", i)
+		assert.Equal(t, s.active, active[0].State, "step %d", i)
+	}
+
+	assert.Equal(t, []State{Pending, Firing, Resolved, Pending, Inactive}, rec.states)
+}
+
+func Test_EngineNotIncreasing(t *testing.T) {
+	db := memory.NewMemStorage()
+	var delta int64 = 1
+
+	rules := []Rule{{Name: "stuck", Metric: "PollCount", MType: "counter", Condition: NotIncreasing}}
+	rec := &recorder{}
+	e := NewEngine(db, rules, rec, zap.NewNop().Sugar(), time.Second)
+
+	_, err := db.Set(&usecase.Metric{ID: "PollCount", MType: "counter", Delta: &delta})
+	require.NoError(t, err)
+	e.Evaluate()
+	assert.Empty(t, e.Active(usecase.DefaultTenant), "the first value is a baseline")
+
+	_, err = db.Set(&usecase.Metric{ID: "PollCount", MType: "counter", Delta: &delta})
+	require.NoError(t, err)
+	e.Evaluate()
+	assert.Empty(t, e.Active(usecase.DefaultTenant))
+
+	e.Evaluate()
+	require.Len(t, e.Active(usecase.DefaultTenant), 1)
+	assert.Equal(t, Firing, e.Active(usecase.DefaultTenant)[0].State)
+}
+
+type tenantRecorder struct {
+	alerts []Alert
+}
+
+func (r *tenantRecorder) Notify(alert Alert) {
+	r.alerts = append(r.alerts, alert)
+}
+
+func (r *tenantRecorder) Close() {}
+
+func Test_EngineTenants(t *testing.T) {
+	db := memory.NewMemStorage()
+	heap := 150.0
+	_, err := db.Tenant("team-a").Set(&usecase.Metric{ID: "HeapInuse", MType: "gauge", Value: &heap})
+	require.NoError(t, err)
+	_, err = db.Tenant("team-b").Set(&usecase.Metric{ID: "Other", MType: "gauge", Value: &heap})
+	require.NoError(t, err)
+
+	rules := []Rule{
+		{Name: "heap", Metric: "HeapInuse", MType: "gauge", Condition: GreaterThan, Threshold: 100},
+		{Name: "stuck", Metric: "PollCount", MType: "counter", Condition: NotIncreasing},
+	}
+	rec := &tenantRecorder{}
+	e := NewEngine(db, rules, rec, zap.NewNop().Sugar(), time.Second)
+	e.Evaluate()
+	e.Evaluate()
+
+	active := e.Active("team-a")
+	require.Len(t, active, 1)
+	assert.Equal(t, "team-a", active[0].Tenant)
+	assert.Equal(t, "heap", active[0].Rule)
+	assert.Equal(t, Firing, active[0].State)
+	// the missing PollCount alerts the default tenant only, which has no HeapInuse
+	active = e.Active(usecase.DefaultTenant)
+	require.Len(t, active, 1)
+	assert.Equal(t, "stuck", active[0].Rule)
+	assert.Empty(t, e.Active("team-b"), "tenant without the metrics of the rules")
+
+	var notified []string
+	for _, a := range rec.alerts {
+		notified = append(notified, a.Tenant+" "+a.Rule)
+	}
+	assert.ElementsMatch(t, []string{"default stuck", "team-a heap"}, notified)
+}
+
+func Test_NotifierRetries(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	var got Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	n := NewNotifier([]string{server.URL}, zap.NewNop().Sugar())
+	n.BackOffSchedule = []time.Duration{time.Millisecond, time.Millisecond}
+	n.Notify(Alert{Rule: "heap", State: Firing})
+	n.Close()
+
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, "heap", got.Rule)
+	assert.Equal(t, Firing, got.State)
+}
+
+func Test_NotifierGivesUp(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	n := NewNotifier([]string{server.URL}, zap.NewNop().Sugar())
+	n.BackOffSchedule = []time.Duration{time.Millisecond, 300 * time.Millisecond}
+	start := time.Now()
+	n.Notify(Alert{Rule: "heap", State: Firing})
+	n.Close()
+
+	// a delay is a wait before a retry, none follows the last attempt
+	assert.Equal(t, int32(3), calls.Load())
+	assert.Less(t, time.Since(start), 600*time.Millisecond)
+}
+
+func Test_LoadRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			data: `[{"name":"heap","metric":"HeapInuse","type":"gauge","condition":">","threshold":1e9,"for":"2m"}]`,
+		},
+		{
+			name:    "bad condition",
+			data:    `[{"name":"heap","metric":"HeapInuse","type":"gauge","condition":"~"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "bad duration",
+			data:    `[{"name":"heap","metric":"HeapInuse","type":"gauge","condition":">","for":"soon"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate",
+			data:    `[{"name":"a","metric":"m","type":"gauge","condition":">"},{"name":"a","metric":"m","type":"gauge","condition":"<"}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.data), 0666))
+
+			_, err := LoadRules(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
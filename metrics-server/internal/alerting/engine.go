@@ -0,0 +1,238 @@
+package alerting
+
+import (
+	"metrics-server/internal/usecase"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type State string
+
+const (
+	Inactive State = "inactive"
+	Pending  State = "pending"
+	Firing   State = "firing"
+	Resolved State = "resolved"
+)
+
+// Alert is the state of a rule in a tenant, it is also the webhook payload.
+type Alert struct {
+	Tenant    string    `json:"tenant"`
+	Rule      string    `json:"rule"`
+	Metric    string    `json:"metric"`
+	MType     string    `json:"type"`
+	Condition string    `json:"condition"`
+	Threshold float64   `json:"threshold"`
+	State     State     `json:"state"`
+	Value     *float64  `json:"value,omitempty"`
+	Since     time.Time `json:"since"`
+	FiredAt   time.Time `json:"fired_at,omitzero"`
+}
+
+type notifier interface {
+	Notify(alert Alert)
+	Close()
+}
+
+// Engine evaluates rules against the storage of every tenant every
+// interval. The rules apply to the default tenant from the start, and to
+// another tenant once it has the metric of the rule, so a tenant which does
+// not report a metric is not alerted for it missing.
+type Engine struct {
+	db       usecase.Repositories
+	rules    []Rule
+	notifier notifier
+	log      *zap.SugaredLogger
+	interval time.Duration
+	now      func() time.Time
+
+	mu     sync.Mutex
+	alerts map[string]*Alert   // by tenant and rule name
+	last   map[string]*float64 // previous values for not_increasing, same keys
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewEngine(db usecase.Repositories, rules []Rule, notifier notifier, log *zap.SugaredLogger, interval time.Duration) *Engine {
+	e := &Engine{
+		db:       db,
+		rules:    rules,
+		notifier: notifier,
+		log:      log,
+		interval: interval,
+		now:      time.Now,
+		alerts:   make(map[string]*Alert),
+		last:     make(map[string]*float64),
+	}
+
+	for i := range rules {
+		e.alerts[alertKey(usecase.DefaultTenant, rules[i].Name)] = newAlert(usecase.DefaultTenant, &rules[i])
+	}
+
+	return e
+}
+
+func newAlert(tenant string, r *Rule) *Alert {
+	return &Alert{
+		Tenant:    tenant,
+		Rule:      r.Name,
+		Metric:    r.Metric,
+		MType:     r.MType,
+		Condition: r.Condition,
+		Threshold: r.Threshold,
+		State:     Inactive,
+	}
+}
+
+func alertKey(tenant, rule string) string {
+	return tenant + "\x00" + rule
+}
+
+func (e *Engine) Start() {
+	if e.stop != nil {
+		return
+	}
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.Evaluate()
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends evaluation and delivers the queued notifications.
+func (e *Engine) Stop() {
+	if e.stop == nil {
+		return
+	}
+	close(e.stop)
+	<-e.done
+	e.stop = nil
+
+	if e.notifier != nil {
+		e.notifier.Close()
+	}
+}
+
+// Evaluate checks all rules in every tenant once and notifies about state
+// transitions.
+func (e *Engine) Evaluate() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tenants, err := e.db.Tenants()
+	if err != nil {
+		e.log.Errorln("Cannot list tenants for alerting:", err)
+		tenants = []string{usecase.DefaultTenant}
+	}
+
+	now := e.now()
+	for _, tenant := range tenants {
+		db := e.db.Tenant(tenant)
+		for i := range e.rules {
+			e.evaluate(tenant, db, &e.rules[i], now)
+		}
+	}
+}
+
+func (e *Engine) evaluate(tenant string, db usecase.Repositories, r *Rule, now time.Time) {
+	key := alertKey(tenant, r.Name)
+	value := value(db, r)
+	alert, ok := e.alerts[key]
+	if !ok {
+		if value == nil {
+			return
+		}
+		alert = newAlert(tenant, r)
+		e.alerts[key] = alert
+	}
+
+	holds := r.holds(value, e.last[key])
+	e.last[key] = value
+	alert.Value = value
+
+	switch {
+	case holds && alert.State == Inactive:
+		alert.Since = now
+		alert.State = Pending
+		if r.For == 0 {
+			e.fire(alert, now)
+		} else {
+			e.notify(alert)
+		}
+	case holds && alert.State == Pending:
+		if now.Sub(alert.Since) >= time.Duration(r.For) {
+			e.fire(alert, now)
+		}
+	case !holds && alert.State == Pending:
+		// the pending alert has been sent, its receivers learn it is over
+		alert.State = Inactive
+		e.notify(alert)
+	case !holds && alert.State == Firing:
+		alert.State = Resolved
+		e.notify(alert)
+		alert.State = Inactive
+		alert.FiredAt = time.Time{}
+	}
+}
+
+func (e *Engine) fire(alert *Alert, now time.Time) {
+	alert.State = Firing
+	alert.FiredAt = now
+	e.notify(alert)
+}
+
+func (e *Engine) notify(alert *Alert) {
+	e.log.Infoln("Alert", alert.Rule, "of", alert.Tenant, alert.State)
+	if e.notifier != nil {
+		e.notifier.Notify(*alert)
+	}
+}
+
+func value(db usecase.Repositories, r *Rule) *float64 {
+	m, err := db.Get(&usecase.Metric{ID: r.Metric, MType: r.MType})
+	if err != nil {
+		return nil
+	}
+
+	var v float64
+	switch {
+	case m.Value != nil:
+		v = *m.Value
+	case m.Delta != nil:
+		v = float64(*m.Delta)
+	default:
+		return nil
+	}
+	return &v
+}
+
+// Active returns pending and firing alerts of the tenant ordered by rule
+// name.
+func (e *Engine) Active(tenant string) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := []Alert{}
+	for _, a := range e.alerts {
+		if a.Tenant == tenant && (a.State == Pending || a.State == Firing) {
+			result = append(result, *a)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Rule < result[j].Rule })
+	return result
+}
@@ -0,0 +1,108 @@
+package alerting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const notificationQueueSize = 100
+
+var backoffSchedule = []time.Duration{
+	1 * time.Second,
+	3 * time.Second,
+	5 * time.Second,
+}
+
+// Notifier posts alert state transitions to webhooks in background, so that
+// slow receivers do not delay rule evaluation. A failed post is retried
+// after each delay of BackOffSchedule in turn.
+type Notifier struct {
+	URLs            []string
+	Client          *http.Client
+	BackOffSchedule []time.Duration
+
+	log   *zap.SugaredLogger
+	queue chan Alert
+	wg    sync.WaitGroup
+}
+
+func NewNotifier(urls []string, log *zap.SugaredLogger) *Notifier {
+	n := &Notifier{
+		URLs:            urls,
+		Client:          &http.Client{Timeout: 5 * time.Second},
+		BackOffSchedule: backoffSchedule,
+		log:             log,
+		queue:           make(chan Alert, notificationQueueSize),
+	}
+
+	n.wg.Add(1)
+	go n.run()
+
+	return n
+}
+
+// Notify queues the alert, it is dropped when the queue is full.
+func (n *Notifier) Notify(alert Alert) {
+	select {
+	case n.queue <- alert:
+	default:
+		n.log.Errorln("Notification queue is full, alert dropped:", alert.Rule, alert.State)
+	}
+}
+
+// Close sends the queued notifications and stops the notifier.
+func (n *Notifier) Close() {
+	close(n.queue)
+	n.wg.Wait()
+}
+
+func (n *Notifier) run() {
+	defer n.wg.Done()
+	for alert := range n.queue {
+		data, err := json.Marshal(alert)
+		if err != nil {
+			n.log.Errorln("Error in marshaller:", err)
+			continue
+		}
+		for _, url := range n.URLs {
+			if err := n.post(url, data); err != nil {
+				n.log.Errorln("Webhook failed:", err)
+			}
+		}
+	}
+}
+
+func (n *Notifier) post(url string, data []byte) error {
+	err := n.send(url, data)
+	for i, backoff := range n.BackOffSchedule {
+		if err == nil {
+			return nil
+		}
+		n.log.Warnln("Webhook attempt", i+1, "failed:", err)
+		time.Sleep(backoff)
+		err = n.send(url, data)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot notify %s: %v", url, err)
+	}
+	return nil
+}
+
+func (n *Notifier) send(url string, data []byte) error {
+	resp, err := n.Client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
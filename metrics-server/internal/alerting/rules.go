@@ -0,0 +1,128 @@
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Condition of a rule: a comparison with Threshold or NotIncreasing.
+const (
+	GreaterThan   = ">"
+	GreaterEqual  = ">="
+	LessThan      = "<"
+	LessEqual     = "<="
+	Equal         = "=="
+	NotEqual      = "!="
+	NotIncreasing = "not_increasing"
+)
+
+// Rule fires when Condition holds for the metric longer than For.
+type Rule struct {
+	Name      string   `json:"name"`
+	Metric    string   `json:"metric"`
+	MType     string   `json:"type"`
+	Condition string   `json:"condition"`
+	Threshold float64  `json:"threshold"`
+	For       Duration `json:"for"`
+}
+
+// Duration is a time.Duration written as "2m" in the rules file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"2m\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadRules reads a JSON array of rules:
+//
+//	[{"name": "heap", "metric": "HeapInuse", "type": "gauge", "condition": ">", "threshold": 1e9, "for": "2m"},
+//	 {"name": "stuck", "metric": "PollCount", "type": "counter", "condition": "not_increasing", "for": "5m"}]
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read rules file %s: %v", path, err)
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("cannot parse rules file %s: %v", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rule #%d: %v", i, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule #%d: duplicate name %s", i, r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	return rules, nil
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is not defined")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("metric is not defined")
+	}
+	if r.MType != "gauge" && r.MType != "counter" {
+		return fmt.Errorf("unsupported metric type: %s", r.MType)
+	}
+	switch r.Condition {
+	case GreaterThan, GreaterEqual, LessThan, LessEqual, Equal, NotEqual, NotIncreasing:
+	default:
+		return fmt.Errorf("unsupported condition: %s", r.Condition)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("negative duration: %v", time.Duration(r.For))
+	}
+	return nil
+}
+
+// holds tells whether the condition is met. prev is the value seen by the
+// previous evaluation. A missing metric is not increasing, but does not
+// match comparisons.
+func (r *Rule) holds(value, prev *float64) bool {
+	if value == nil {
+		return r.Condition == NotIncreasing
+	}
+	if r.Condition == NotIncreasing {
+		return prev != nil && *value <= *prev
+	}
+
+	v := *value
+	switch r.Condition {
+	case GreaterThan:
+		return v > r.Threshold
+	case GreaterEqual:
+		return v >= r.Threshold
+	case LessThan:
+		return v < r.Threshold
+	case LessEqual:
+		return v <= r.Threshold
+	case Equal:
+		return v == r.Threshold
+	case NotEqual:
+		return v != r.Threshold
+	}
+	return false
+}
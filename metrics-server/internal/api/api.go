@@ -0,0 +1,14 @@
+// Package api keeps the OpenAPI document of the server.
+package api
+
+import _ "embed"
+
+// Spec is the OpenAPI 3 document, it must list every route of the router.
+//
+//go:embed openapi.json
+var Spec []byte
+
+// Docs is a page which renders Spec in a browser.
+//
+//go:embed docs.html
+var Docs []byte
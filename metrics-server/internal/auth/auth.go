@@ -0,0 +1,90 @@
+// Package auth keeps API keys. Only SHA-256 hashes of tokens are stored,
+// a token is shown once when its key is created.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"metrics-server/internal/usecase"
+	"slices"
+	"time"
+)
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin" // allows everything
+)
+
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeAdmin}
+
+var ErrKeyNotFound = errors.New("key not found")
+
+type Key struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"hash"` // hex SHA-256 of the token
+	Tenant    string    `json:"tenant"`
+	Scopes    []string  `json:"scopes"`
+	Created   time.Time `json:"created"`
+	RevokedAt time.Time `json:"revoked_at,omitzero"`
+}
+
+// Allows tells whether the key grants the scope.
+func (k *Key) Allows(scope string) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+func (k *Key) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// Store keeps keys, Lookup finds an active key by the token hash.
+type Store interface {
+	Create(key *Key) error
+	Revoke(id string) error
+	List() ([]Key, error)
+	Lookup(hash string) (*Key, error)
+}
+
+// NewKey generates a token and its key, the token is <key ID>.<secret>.
+func NewKey(tenant string, scopes []string) (string, *Key, error) {
+	if err := usecase.ValidateTenant(tenant); err != nil {
+		return "", nil, err
+	}
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("no scopes")
+	}
+	for _, s := range scopes {
+		if !slices.Contains(Scopes, s) {
+			return "", nil, fmt.Errorf("unknown scope %q", s)
+		}
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, fmt.Errorf("cannot generate key: %v", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("cannot generate key: %v", err)
+	}
+
+	key := Key{
+		ID:      hex.EncodeToString(id),
+		Tenant:  tenant,
+		Scopes:  scopes,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	token := key.ID + "." + base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = Hash(token)
+	return token, &key, nil
+}
+
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
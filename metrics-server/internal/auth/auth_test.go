@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_FileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	s := NewFileStore(path)
+
+	_, err := s.Lookup(Hash("anything"))
+	assert.ErrorIs(t, err, ErrKeyNotFound, "absent file has no keys")
+
+	token, key, err := NewKey("team-a", []string{ScopeRead})
+	require.NoError(t, err)
+	require.NoError(t, s.Create(key))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), token, "tokens must not be stored")
+
+	found, err := s.Lookup(Hash(token))
+	require.NoError(t, err)
+	assert.Equal(t, key.ID, found.ID)
+	assert.Equal(t, "team-a", found.Tenant)
+
+	// a key created by another process is seen without restart
+	other := NewFileStore(path)
+	token2, key2, err := NewKey("team-b", []string{ScopeWrite})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, other.Create(key2))
+	_, err = s.Lookup(Hash(token2))
+	assert.NoError(t, err)
+
+	require.NoError(t, s.Revoke(key.ID))
+	_, err = s.Lookup(Hash(token))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.ErrorIs(t, s.Revoke(key.ID), ErrKeyNotFound, "revoked twice")
+
+	keys, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.True(t, keys[0].Revoked())
+	assert.False(t, keys[1].Revoked())
+}
+
+func Test_NewKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenant  string
+		scopes  []string
+		wantErr bool
+	}{
+		{name: "valid", tenant: "default", scopes: []string{ScopeRead, ScopeWrite}},
+		{name: "unknown scope", tenant: "default", scopes: []string{"root"}, wantErr: true},
+		{name: "no scopes", tenant: "default", wantErr: true},
+		{name: "bad tenant", tenant: "../x", scopes: []string{ScopeRead}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, key, err := NewKey(tt.tenant, tt.scopes)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, Hash(token), key.Hash)
+		})
+	}
+}
+
+func Test_KeyAllows(t *testing.T) {
+	read := Key{Scopes: []string{ScopeRead}}
+	assert.True(t, read.Allows(ScopeRead))
+	assert.False(t, read.Allows(ScopeWrite))
+
+	admin := Key{Scopes: []string{ScopeAdmin}}
+	assert.True(t, admin.Allows(ScopeRead))
+	assert.True(t, admin.Allows(ScopeWrite))
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore keeps keys in a JSON file. The file is read again when it
+// changes, so keys managed from the command line apply to a running server.
+type FileStore struct {
+	Path string
+
+	mu      sync.Mutex
+	keys    []Key
+	modTime time.Time
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+// load reads the file if it has changed, s.mu must be held.
+func (s *FileStore) load() error {
+	info, err := os.Stat(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.keys = nil
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read keys file: %v", err)
+	}
+	if info.ModTime().Equal(s.modTime) && s.keys != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return fmt.Errorf("cannot read keys file: %v", err)
+	}
+	keys := []Key{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("cannot parse keys file %s: %v", s.Path, err)
+	}
+	s.keys = keys
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes the keys atomically, readable by the owner only.
+func (s *FileStore) save() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error in marshaller: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("cannot create keys file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("cannot write keys file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot write keys file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("cannot rename keys file: %v", err)
+	}
+
+	// the next load reads what was written
+	s.modTime = time.Time{}
+	return nil
+}
+
+func (s *FileStore) Create(key *Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.keys = append(s.keys, *key)
+	return s.save()
+}
+
+func (s *FileStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	for i := range s.keys {
+		if s.keys[i].ID == id && !s.keys[i].Revoked() {
+			s.keys[i].RevokedAt = time.Now().UTC().Truncate(time.Second)
+			return s.save()
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+}
+
+func (s *FileStore) List() ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return append([]Key{}, s.keys...), nil
+}
+
+func (s *FileStore) Lookup(hash string) (*Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	for i := range s.keys {
+		if s.keys[i].Hash == hash && !s.keys[i].Revoked() {
+			key := s.keys[i]
+			return &key, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const keysTable = "api_keys"
+
+// PsqlStore keeps keys in the database of the PostgreSQL storage.
+type PsqlStore struct {
+	DB *sql.DB
+}
+
+func NewPsqlStore(db *sql.DB) (*PsqlStore, error) {
+	query := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		id VARCHAR(32) PRIMARY KEY,
+		hash CHAR(64) UNIQUE NOT NULL,
+		tenant VARCHAR(64) NOT NULL,
+		scopes VARCHAR(255) NOT NULL,
+		created TIMESTAMPTZ NOT NULL,
+		revoked_at TIMESTAMPTZ NULL)
+	`, keysTable)
+
+	if _, err := db.Exec(query); err != nil {
+		return nil, fmt.Errorf("cannot create table %s: %v", keysTable, err)
+	}
+	return &PsqlStore{DB: db}, nil
+}
+
+func (s *PsqlStore) Create(key *Key) error {
+	query := fmt.Sprintf("INSERT INTO %s (id, hash, tenant, scopes, created) VALUES ($1, $2, $3, $4, $5)", keysTable)
+
+	_, err := s.DB.Exec(query, key.ID, key.Hash, key.Tenant, strings.Join(key.Scopes, ","), key.Created)
+	if err != nil {
+		return fmt.Errorf("cannot create key: %v", err)
+	}
+	return nil
+}
+
+func (s *PsqlStore) Revoke(id string) error {
+	query := fmt.Sprintf("UPDATE %s SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL", keysTable)
+
+	result, err := s.DB.Exec(query, id, time.Now().UTC().Truncate(time.Second))
+	if err != nil {
+		return fmt.Errorf("cannot revoke key: %v", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cannot revoke key: %v", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	return nil
+}
+
+func (s *PsqlStore) List() ([]Key, error) {
+	query := fmt.Sprintf("SELECT id, hash, tenant, scopes, created, revoked_at FROM %s ORDER BY created, id", keysTable)
+
+	rows, err := s.DB.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error in query for keys: %v", err)
+	}
+	defer rows.Close()
+
+	result := []Key{}
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("cannot process a row: %v", err)
+		}
+		result = append(result, *key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot process all rows: %v", err)
+	}
+	return result, nil
+}
+
+func (s *PsqlStore) Lookup(hash string) (*Key, error) {
+	query := fmt.Sprintf("SELECT id, hash, tenant, scopes, created, revoked_at FROM %s WHERE hash = $1 AND revoked_at IS NULL", keysTable)
+
+	key, err := scanKey(s.DB.QueryRow(query, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot look up key: %v", err)
+	}
+	return key, nil
+}
+
+func scanKey(row interface{ Scan(dest ...any) error }) (*Key, error) {
+	var key Key
+	var scopes string
+	var revoked sql.NullTime
+	if err := row.Scan(&key.ID, &key.Hash, &key.Tenant, &scopes, &key.Created, &revoked); err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	if revoked.Valid {
+		key.RevokedAt = revoked.Time
+	}
+	return &key, nil
+}
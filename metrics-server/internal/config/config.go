@@ -3,18 +3,86 @@ package config
 import (
 	"flag"
 	"fmt"
+	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caarlos0/env"
 )
 
+// LatestSnapshot selects the newest readable dump on restoration.
+const LatestSnapshot = "latest"
+
+const DefaultKeysFile = "keys.json"
+
 type Config struct {
-	Addr            string `env:"ADDRESS"`
-	StoreInterval   int    `env:"STORE_INTERVAL"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	Restore         bool   `env:"RESTORE"`
-	DSN             string `env:"DATABASE_DSN"`
+	Addr            string        `env:"ADDRESS"`
+	StoreInterval   int           `env:"STORE_INTERVAL"`
+	FileStoragePath string        `env:"FILE_STORAGE_PATH"`
+	Restore         Restore       `env:"RESTORE"`
+	DSN             string        `env:"DATABASE_DSN"`
+	SnapshotKeep    int           `env:"SNAPSHOT_KEEP"`
+	SnapshotMaxAge  time.Duration `env:"SNAPSHOT_MAX_AGE"`
+	SnapshotEvery   time.Duration `env:"SNAPSHOT_INTERVAL"`
+	AlertRules      string        `env:"ALERT_RULES"`
+	AlertInterval   time.Duration `env:"ALERT_INTERVAL"`
+	AlertWebhooks   []string      `env:"ALERT_WEBHOOKS"`
+	TenantLimit     int           `env:"TENANT_MAX_METRICS"`
+	MaxTenants      int           `env:"MAX_TENANTS"`
+	Auth            bool          `env:"AUTH"`
+	AuthKeys        string        `env:"AUTH_KEYS"`
+	TLSCert         string        `env:"TLS_CERT"`
+	TLSKey          string        `env:"TLS_KEY"`
+	TLSClientCA     string        `env:"TLS_CLIENT_CA"`
+	RateLimit       float64       `env:"RATE_LIMIT"`
+	RateBurst       int           `env:"RATE_BURST"`
+	GraphiteAddr    string        `env:"GRAPHITE_ADDR"`
+	GraphiteRules   string        `env:"GRAPHITE_RULES"`
+	InfluxRules     string        `env:"INFLUX_RULES"`
+	InfluxTags      []string      `env:"INFLUX_TAGS"`
+	OTLPAttributes  []string      `env:"OTLP_ATTRIBUTES"`
+}
+
+// Restore tells whether data is restored on start and from which snapshot.
+// It accepts a boolean or a snapshot selector: "latest" or a timestamp
+// (prefix) like 20261019T120000.
+type Restore struct {
+	Enabled  bool
+	Snapshot string
+}
+
+func (r *Restore) String() string {
+	if !r.Enabled {
+		return "false"
+	}
+	return r.Snapshot
+}
+
+func (r *Restore) Set(flagValue string) error {
+	if flagValue == "" {
+		return fmt.Errorf("empty restore value")
+	}
+	if enabled, err := strconv.ParseBool(flagValue); err == nil {
+		r.Enabled = enabled
+		r.Snapshot = LatestSnapshot
+		return nil
+	}
+	r.Enabled = true
+	r.Snapshot = flagValue
+	return nil
+}
+
+// IsBoolFlag allows to use plain -r as before.
+func (r *Restore) IsBoolFlag() bool {
+	return true
+}
+
+func parseRestore(value string) (interface{}, error) {
+	var r Restore
+	err := r.Set(value)
+	return r, err
 }
 
 type netAddress struct {
@@ -43,16 +111,47 @@ func (n *netAddress) Set(flagValue string) error {
 func (cfg *Config) Get() error {
 	addr := netAddress{Host: "localhost", Port: 8080}
 
-	err := env.Parse(cfg)
+	err := env.ParseWithFuncs(cfg, env.CustomParsers{
+		reflect.TypeOf(Restore{}): parseRestore,
+	})
 	if err != nil {
 		return fmt.Errorf("cannot parse env: %v", err)
 	}
 
 	flag.Var(&addr, "a", "Listen address. Format host:port, default localhost:8080")
 	storeIntervalFlag := flag.Int("i", 300, "Store interval. Format int, default 300.")
-	restoreFlag := flag.Bool("r", true, "Restore data from disk on start. Format bool, default true.")
+	restoreFlag := Restore{Enabled: true, Snapshot: LatestSnapshot}
+	flag.Var(&restoreFlag, "r", "Restore data from disk on start. Format bool, \"latest\" or snapshot timestamp, default true.")
 	fileStoragePathFlag := flag.String("f", "metrics.dmp", "File to store data. Format string, default metrics.dmp.")
 	dsnFlag := flag.String("d", "", "PostrgeSQL DSN. Format: \"user=postgres password=secret host=localhost port=5432 dbname=mydb sslmode=disable\"")
+	snapshotKeepFlag := flag.Int("snapshot-keep", 10, "Number of dump snapshots to keep, 0 keeps all. Format int, default 10.")
+	snapshotMaxAgeFlag := flag.Duration("snapshot-max-age", 0, "Remove dump snapshots older than this, the newest one is always kept. Format duration, default 0 (disabled).")
+	snapshotEveryFlag := flag.Duration("snapshot-interval", time.Minute, "Min time between dump snapshots when every update is stored (-i 0). Format duration, default 1m.")
+
+	alertRulesFlag := flag.String("alert-rules", "", "JSON file with alerting rules, alerting is disabled if empty. Format string, default empty.")
+	alertIntervalFlag := flag.Duration("alert-interval", 10*time.Second, "Alerting rules evaluation interval. Format duration, default 10s.")
+	alertWebhooksFlag := flag.String("alert-webhooks", "", "Comma separated webhook URLs for alert notifications. Format string, default empty.")
+
+	tenantLimitFlag := flag.Int("tenant-max-metrics", 0, "Max number of metrics of a tenant, 0 is unlimited. Format int, default 0.")
+	maxTenantsFlag := flag.Int("max-tenants", 100, "Max number of tenants besides the default one, 0 is unlimited. Format int, default 100.")
+
+	authFlag := flag.Bool("auth", false, "Require API keys. Format bool, default false.")
+	authKeysFlag := flag.String("auth-keys", DefaultKeysFile, "File with API keys, not used with PostgreSQL. Format string, default keys.json.")
+
+	tlsCertFlag := flag.String("tls-cert", "", "PEM certificate of the server, HTTPS is served if set. Format string, default empty.")
+	tlsKeyFlag := flag.String("tls-key", "", "PEM private key of the server certificate. Format string, default empty.")
+	tlsClientCAFlag := flag.String("tls-client-ca", "", "PEM CA bundle, client certificates signed by it are required if set. Format string, default empty.")
+
+	rateLimitFlag := flag.Float64("rate-limit", 0, "Requests per second of a client, 0 is unlimited. Format float, default 0.")
+	rateBurstFlag := flag.Int("rate-burst", 0, "Requests a client may send at once, 0 is the rate rounded up. Format int, default 0.")
+
+	graphiteAddrFlag := flag.String("graphite-addr", "", "TCP address of the Graphite plaintext listener, disabled if empty. Format string, default empty.")
+	graphiteRulesFlag := flag.String("graphite-rules", "", "JSON file with rules mapping Graphite paths to counters. Format string, default empty.")
+
+	influxRulesFlag := flag.String("influx-rules", "", "JSON file with rules mapping line protocol fields to counters. Format string, default empty.")
+	influxTagsFlag := flag.String("influx-tags", "", "Comma separated line protocol tags put into metric IDs. Format string, default empty.")
+
+	otlpAttributesFlag := flag.String("otlp-attributes", "", "Comma separated OTLP attributes put into metric IDs. Format string, default empty.")
 
 	flag.Parse()
 
@@ -68,8 +167,8 @@ func (cfg *Config) Get() error {
 		cfg.StoreInterval = *storeIntervalFlag
 	}
 
-	if !cfg.Restore {
-		cfg.Restore = *restoreFlag
+	if !cfg.Restore.Enabled {
+		cfg.Restore = restoreFlag
 	}
 
 	if cfg.FileStoragePath == "" {
@@ -80,5 +179,86 @@ func (cfg *Config) Get() error {
 		cfg.DSN = *dsnFlag
 	}
 
+	// 0 is a valid value here, only an unset variable takes the flag
+	if _, ok := os.LookupEnv("SNAPSHOT_KEEP"); !ok {
+		cfg.SnapshotKeep = *snapshotKeepFlag
+	}
+
+	if cfg.SnapshotMaxAge == 0 {
+		cfg.SnapshotMaxAge = *snapshotMaxAgeFlag
+	}
+
+	if cfg.SnapshotEvery == 0 {
+		cfg.SnapshotEvery = *snapshotEveryFlag
+	}
+
+	if cfg.AlertRules == "" {
+		cfg.AlertRules = *alertRulesFlag
+	}
+
+	if cfg.AlertInterval == 0 {
+		cfg.AlertInterval = *alertIntervalFlag
+	}
+
+	if len(cfg.AlertWebhooks) == 0 && *alertWebhooksFlag != "" {
+		cfg.AlertWebhooks = strings.Split(*alertWebhooksFlag, ",")
+	}
+
+	if cfg.TenantLimit == 0 {
+		cfg.TenantLimit = *tenantLimitFlag
+	}
+
+	if _, ok := os.LookupEnv("MAX_TENANTS"); !ok {
+		cfg.MaxTenants = *maxTenantsFlag
+	}
+
+	if !cfg.Auth {
+		cfg.Auth = *authFlag
+	}
+
+	if cfg.AuthKeys == "" {
+		cfg.AuthKeys = *authKeysFlag
+	}
+
+	if cfg.TLSCert == "" {
+		cfg.TLSCert = *tlsCertFlag
+	}
+
+	if cfg.TLSKey == "" {
+		cfg.TLSKey = *tlsKeyFlag
+	}
+
+	if cfg.TLSClientCA == "" {
+		cfg.TLSClientCA = *tlsClientCAFlag
+	}
+
+	if cfg.RateLimit == 0 {
+		cfg.RateLimit = *rateLimitFlag
+	}
+
+	if cfg.RateBurst == 0 {
+		cfg.RateBurst = *rateBurstFlag
+	}
+
+	if cfg.GraphiteAddr == "" {
+		cfg.GraphiteAddr = *graphiteAddrFlag
+	}
+
+	if cfg.GraphiteRules == "" {
+		cfg.GraphiteRules = *graphiteRulesFlag
+	}
+
+	if cfg.InfluxRules == "" {
+		cfg.InfluxRules = *influxRulesFlag
+	}
+
+	if len(cfg.InfluxTags) == 0 && *influxTagsFlag != "" {
+		cfg.InfluxTags = strings.Split(*influxTagsFlag, ",")
+	}
+
+	if len(cfg.OTLPAttributes) == 0 && *otlpAttributesFlag != "" {
+		cfg.OTLPAttributes = strings.Split(*otlpAttributesFlag, ",")
+	}
+
 	return nil
 }
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// get parses the config from the given env and command line.
+func get(t *testing.T, env map[string]string, args ...string) *Config {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	oldArgs, oldFlags := os.Args, flag.CommandLine
+	t.Cleanup(func() { os.Args, flag.CommandLine = oldArgs, oldFlags })
+	os.Args = append([]string{"server"}, args...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	var cfg Config
+	require.NoError(t, cfg.Get())
+	return &cfg
+}
+
+func Test_GetZeroFromEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		field func(*Config) int
+		want  int
+	}{
+		{
+			name:  "snapshot keep default",
+			field: func(c *Config) int { return c.SnapshotKeep },
+			want:  10,
+		},
+		{
+			name:  "snapshot keep 0 from env",
+			env:   map[string]string{"SNAPSHOT_KEEP": "0"},
+			args:  []string{"-snapshot-keep", "5"},
+			field: func(c *Config) int { return c.SnapshotKeep },
+			want:  0,
+		},
+		{
+			name:  "max tenants default",
+			field: func(c *Config) int { return c.MaxTenants },
+			want:  100,
+		},
+		{
+			name:  "max tenants 0 from env",
+			env:   map[string]string{"MAX_TENANTS": "0"},
+			args:  []string{"-max-tenants", "5"},
+			field: func(c *Config) int { return c.MaxTenants },
+			want:  0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := get(t, tt.env, tt.args...)
+			assert.Equal(t, tt.want, tt.field(cfg))
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// Package graphite takes metrics in the Graphite plaintext protocol,
+// "<path> <value> [<timestamp>]" lines over TCP.
+package graphite
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"metrics-server/internal/mapping"
+	"metrics-server/internal/usecase"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxLine caps a line, longer lines are malformed.
+	maxLine = 4096
+	// maxBatch is the most lines written at once.
+	maxBatch = 1000
+)
+
+// Stats counts the lines since start.
+type Stats struct {
+	Lines     int64 // stored
+	Malformed int64 // could not be parsed
+	Rejected  int64 // refused by the storage, like over the metric limit
+}
+
+// Listener stores the lines of its connections in the default tenant.
+// Timestamps are accepted but not kept, like with the HTTP API the last
+// value of a gauge wins. A malformed line is counted and logged, the
+// connection goes on; the counts of a connection are logged when it ends.
+// The protocol has no credentials, anyone reaching the listener writes.
+type Listener struct {
+	db    usecase.Repositories
+	rules []mapping.Rule
+	log   *zap.SugaredLogger
+
+	// OnWrite runs after every batch written, the in-memory storage dumps
+	// there when dumps are synchronous.
+	OnWrite func() error
+
+	// LoopbackOnly refuses to listen on addresses other hosts reach, it is
+	// set when the HTTP API requires keys.
+	LoopbackOnly bool
+
+	lines, malformed, rejected atomic.Int64
+
+	ln    net.Listener
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func NewListener(db usecase.Repositories, rules []mapping.Rule, log *zap.SugaredLogger) *Listener {
+	return &Listener{
+		db:    db,
+		rules: rules,
+		log:   log,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Start listens on addr and serves connections until Stop.
+func (l *Listener) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen for Graphite: %v", err)
+	}
+	if tcp, ok := ln.Addr().(*net.TCPAddr); l.LoopbackOnly && !(ok && tcp.IP.IsLoopback()) {
+		ln.Close()
+		return fmt.Errorf("the Graphite listener takes no API keys, with -auth it must listen on a loopback address, not %q", addr)
+	}
+	l.ln = ln
+	l.log.Infoln("Graphite listener on", ln.Addr())
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					l.log.Errorln("Graphite accept error:", err)
+				}
+				return
+			}
+			l.mu.Lock()
+			l.conns[conn] = struct{}{}
+			l.mu.Unlock()
+
+			l.wg.Add(1)
+			go func() {
+				defer l.wg.Done()
+				l.serve(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the listener is on.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Stop closes the listener and the connections, the lines read are stored.
+func (l *Listener) Stop() {
+	if l.ln == nil {
+		return
+	}
+	l.ln.Close()
+
+	l.mu.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	l.ln = nil
+
+	s := l.Stats()
+	l.log.Infof("Graphite listener stopped: %d lines stored, %d malformed, %d rejected", s.Lines, s.Malformed, s.Rejected)
+}
+
+func (l *Listener) Stats() Stats {
+	return Stats{
+		Lines:     l.lines.Load(),
+		Malformed: l.malformed.Load(),
+		Rejected:  l.rejected.Load(),
+	}
+}
+
+func (l *Listener) serve(conn net.Conn) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		conn.Close()
+	}()
+
+	remote := conn.RemoteAddr().String()
+	r := bufio.NewReaderSize(conn, maxLine)
+	var batch []usecase.Metric
+	var stored, malformed, rejected int64
+	flush := func() {
+		ok, bad := l.write(batch, remote)
+		stored += ok
+		rejected += bad
+		batch = batch[:0]
+	}
+	defer func() {
+		if malformed > 0 || rejected > 0 {
+			l.log.Warnf("Graphite connection from %s ended: %d lines stored, %d malformed, %d rejected", remote, stored, malformed, rejected)
+		} else {
+			l.log.Debugf("Graphite connection from %s ended: %d lines stored", remote, stored)
+		}
+	}()
+
+	for n := 1; ; n++ {
+		// what is read so far is written before waiting for more
+		if len(batch) >= maxBatch || (len(batch) > 0 && r.Buffered() == 0) {
+			flush()
+		}
+
+		line, err := readLine(r)
+		if err != nil && !errors.Is(err, errLineTooLong) {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				l.log.Errorln("Graphite read error from", remote, ":", err)
+			}
+			break
+		}
+		if err == nil && strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var metric usecase.Metric
+		if err == nil {
+			metric, err = l.parse(line)
+		}
+		if err != nil {
+			l.malformed.Add(1)
+			malformed++
+			l.log.Warnln("Malformed Graphite line", n, "from", remote, ":", err)
+			continue
+		}
+		batch = append(batch, metric)
+	}
+
+	if len(batch) > 0 {
+		flush()
+	}
+}
+
+var errLineTooLong = fmt.Errorf("line is longer than %d bytes", maxLine)
+
+// readLine returns the next line without its end, or skips a line too long.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = r.ReadSlice('\n')
+		}
+		if err == nil {
+			return "", errLineTooLong
+		}
+		return "", err
+	}
+	if err != nil && !(errors.Is(err, io.EOF) && len(line) > 0) {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// parse maps a line to a metric.
+func (l *Listener) parse(line string) (usecase.Metric, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return usecase.Metric{}, fmt.Errorf("<path> <value> [<timestamp>] expected")
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return usecase.Metric{}, fmt.Errorf("bad value %q", fields[1])
+	}
+	if len(fields) == 3 {
+		if _, err := strconv.ParseFloat(fields[2], 64); err != nil {
+			return usecase.Metric{}, fmt.Errorf("bad timestamp %q", fields[2])
+		}
+	}
+
+	id, mtype := mapping.Map(l.rules, fields[0])
+	metric := usecase.NewGauge(id, value)
+	if mtype == "counter" {
+		if value != math.Trunc(value) || math.Abs(value) > 1<<53 {
+			return usecase.Metric{}, fmt.Errorf("counter %s needs a whole value, got %q", id, fields[1])
+		}
+		metric = usecase.NewCounter(id, int64(value))
+	}
+
+	if err := usecase.Validate(&metric); err != nil {
+		return usecase.Metric{}, err
+	}
+	return metric, nil
+}
+
+// write stores batch and returns how many lines are stored and rejected.
+func (l *Listener) write(batch []usecase.Metric, remote string) (stored, rejected int64) {
+	items, err := l.db.SetBatch(batch, false)
+	if err != nil {
+		l.rejected.Add(int64(len(batch)))
+		l.log.Errorln("Cannot store Graphite lines from", remote, ":", err)
+		return 0, int64(len(batch))
+	}
+	for _, item := range items {
+		if item.Err != nil {
+			rejected++
+			l.log.Warnln("Graphite metric from", remote, "is rejected:", item.Err)
+			continue
+		}
+		stored++
+	}
+	l.lines.Add(stored)
+	l.rejected.Add(rejected)
+
+	if l.OnWrite != nil {
+		if err := l.OnWrite(); err != nil {
+			l.log.Errorln("Dump error:", err)
+		}
+	}
+	return stored, rejected
+}
@@ -0,0 +1,172 @@
+package graphite
+
+import (
+	"fmt"
+	"metrics-server/internal/mapping"
+	"metrics-server/internal/storage/memory"
+	"metrics-server/internal/usecase"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func testRules(t *testing.T) []mapping.Rule {
+	rules := []mapping.Rule{
+		{Match: `^stats_counts\.(.+)$`, Type: "counter", Name: "$1"},
+		{Match: `\.requests$`, Type: "counter"},
+	}
+	require.NoError(t, mapping.Compile(rules))
+	return rules
+}
+
+func Test_Parse(t *testing.T) {
+	l := NewListener(memory.NewMemStorage(), testRules(t), zap.NewNop().Sugar())
+
+	tests := []struct {
+		name    string
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{name: "gauge", line: "servers.web1.load 0.75 1760875200", want: "servers.web1.load gauge 0.75"},
+		{name: "no timestamp", line: "servers.web1.load 1.5", want: "servers.web1.load gauge 1.5"},
+		{name: "renamed counter", line: "stats_counts.api.hits 12 1760875200", want: "api.hits counter 12"},
+		{name: "counter", line: "servers.web1.requests 3.0 1760875200", want: "servers.web1.requests counter 3"},
+		{name: "fractional counter", line: "servers.web1.requests 2.5 1760875200", wantErr: true},
+		{name: "bad value", line: "servers.web1.load high 1760875200", wantErr: true},
+		{name: "bad timestamp", line: "servers.web1.load 1 yesterday", wantErr: true},
+		{name: "no value", line: "servers.web1.load", wantErr: true},
+		{name: "bad path", line: "servers/web1 1 1760875200", wantErr: true},
+		{name: "NaN", line: "servers.web1.load NaN 1760875200", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := l.parse(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			got := fmt.Sprintf("%s %s ", m.ID, m.MType)
+			if m.Delta != nil {
+				got += fmt.Sprint(*m.Delta)
+			} else {
+				got += fmt.Sprint(*m.Value)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_Listener(t *testing.T) {
+	db := memory.NewMemStorage()
+	l := NewListener(db, testRules(t), zap.NewNop().Sugar())
+	var writes atomic.Int32
+	l.OnWrite = func() error { writes.Add(1); return nil }
+	require.NoError(t, l.Start("127.0.0.1:0"))
+	defer l.Stop()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	lines := []string{
+		"servers.web1.load 0.5 1760875200",
+		"this line is broken",
+		strings.Repeat("x", 2*maxLine) + " 1 1760875200",
+		"servers.web1.requests 2 1760875200",
+		"",
+		"servers.web1.requests 3 1760875201",
+		"servers.web1.load 0.75 1760875201\r",
+	}
+	_, err = fmt.Fprint(conn, strings.Join(lines, "\n")+"\n")
+	require.NoError(t, err)
+
+	// the connection goes on after malformed lines
+	require.Eventually(t, func() bool { return l.Stats().Lines == 4 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, Stats{Lines: 4, Malformed: 2}, l.Stats())
+	assert.Positive(t, writes.Load())
+
+	load, err := db.Get(&usecase.Metric{ID: "servers.web1.load", MType: "gauge"})
+	require.NoError(t, err)
+	assert.Equal(t, 0.75, *load.Value)
+	requests, err := db.Get(&usecase.Metric{ID: "servers.web1.requests", MType: "counter"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *requests.Delta)
+
+	_, err = fmt.Fprint(conn, "servers.web1.load 1 1760875202\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return l.Stats().Lines == 5 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func Test_ListenerRejected(t *testing.T) {
+	db := memory.NewMemStorage()
+	db.Limit = 1
+	l := NewListener(db, nil, zap.NewNop().Sugar())
+	require.NoError(t, l.Start("127.0.0.1:0"))
+	defer l.Stop()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	fmt.Fprint(conn, "a 1 1760875200\nb 2 1760875200\n")
+	conn.Close()
+
+	require.Eventually(t, func() bool { s := l.Stats(); return s.Lines+s.Rejected == 2 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, Stats{Lines: 1, Rejected: 1}, l.Stats())
+}
+
+func Test_ListenerLoopbackOnly(t *testing.T) {
+	l := NewListener(memory.NewMemStorage(), nil, zap.NewNop().Sugar())
+	l.LoopbackOnly = true
+	require.Error(t, l.Start(":0"))
+
+	require.NoError(t, l.Start("127.0.0.1:0"))
+	l.Stop()
+}
+
+func Test_ListenerLogsCounts(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	l := NewListener(memory.NewMemStorage(), nil, zap.New(core).Sugar())
+	require.NoError(t, l.Start("127.0.0.1:0"))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	fmt.Fprint(conn, "a 1 1760875200\nbroken\n")
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("Graphite connection from "+conn.LocalAddr().String()+" ended: 1 lines stored, 1 malformed, 0 rejected").Len() == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	l.Stop()
+	assert.Equal(t, 1, logs.FilterMessage("Graphite listener stopped: 1 lines stored, 1 malformed, 0 rejected").Len())
+}
+
+func Test_ListenerStop(t *testing.T) {
+	l := NewListener(memory.NewMemStorage(), nil, zap.NewNop().Sugar())
+	require.NoError(t, l.Start("127.0.0.1:0"))
+
+	// an idle connection does not hold Stop up
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "a 1 1760875200\n")
+	require.Eventually(t, func() bool { return l.Stats().Lines == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		l.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop() hangs")
+	}
+}
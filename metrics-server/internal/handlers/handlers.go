@@ -3,10 +3,14 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"metrics-server/internal/alerting"
+	"metrics-server/internal/api"
 	"metrics-server/internal/storage"
 	"metrics-server/internal/usecase"
 	"metrics-server/internal/usecase/context"
 	"net/http"
+	"regexp"
+	"strconv"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 
@@ -19,14 +23,14 @@ func SetParam(app *context.AppContext) http.HandlerFunc {
 		var err error
 
 		if req.Method != http.MethodPost {
-			res.WriteHeader(http.StatusMethodNotAllowed)
+			writeError(res, http.StatusMethodNotAllowed, "", "method not allowed")
 			return
 		}
 
 		metric.ID = chi.URLParam(req, "name")
 
 		if metric.ID == "" {
-			res.WriteHeader(http.StatusNotFound)
+			writeError(res, http.StatusNotFound, "id", "name is not defined")
 			app.Log.Errorln("Name is not defined")
 			return
 		}
@@ -39,35 +43,35 @@ func SetParam(app *context.AppContext) http.HandlerFunc {
 		case "counter":
 			metric.Delta, err = storage.StringToCounter(chi.URLParam(req, "value"))
 		default:
-			res.WriteHeader(http.StatusBadRequest)
+			writeError(res, http.StatusBadRequest, "type", fmt.Sprintf("unsupported metric type %q", metric.MType))
 			app.Log.Errorln("Unsupported metric type")
 			return
 		}
 
 		if err != nil {
-			res.WriteHeader(http.StatusBadRequest)
+			writeError(res, http.StatusBadRequest, "value", "cannot parse value")
 			app.Log.Errorln(err.Error())
 			return
 		}
 
-		_, err = app.DB.Set(&metric)
-		if err != nil {
-			res.WriteHeader(http.StatusBadRequest)
+		if _, err = setMetric(app, req, &metric); err != nil {
+			writeAPIError(res, err)
+			app.Log.Errorln("Cannot set metric:", err)
 			return
 		}
 
-		if app.Cfg.StoreInterval == 0 {
-			err = app.DB.Dump(app.Cfg.FileStoragePath)
-			if err != nil {
-				res.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}
-
 		res.WriteHeader(http.StatusOK)
 	}
 }
 
+// syncDump stores every update when periodic dumping is disabled.
+func syncDump(app *context.AppContext, req *http.Request) error {
+	if app.Cfg.StoreInterval != 0 || app.Dumper == nil {
+		return nil
+	}
+	return app.Dumper.Sync(tenantID(req))
+}
+
 func GetParam(app *context.AppContext) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		var metric usecase.Metric
@@ -76,17 +80,16 @@ func GetParam(app *context.AppContext) http.HandlerFunc {
 		metric.ID = chi.URLParam(req, "name")
 
 		if metric.ID == "" {
-			res.WriteHeader(http.StatusNotFound)
+			writeError(res, http.StatusNotFound, "id", "name is not defined")
 			app.Log.Errorln("Name is not defined")
 			return
 		}
 
 		metric.MType = chi.URLParam(req, "mtype")
 
-		result, err := app.DB.Get(&metric)
+		result, err := tenantDB(app, req).Get(&metric)
 		if err != nil {
-			res.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(res, "Value of %s is absent\n", metric.ID)
+			writeGetError(app, res, &metric, err)
 			return
 		}
 
@@ -96,7 +99,7 @@ func GetParam(app *context.AppContext) http.HandlerFunc {
 		case "counter":
 			resultString = storage.CounterToString(*result.Delta)
 		default:
-			res.WriteHeader(http.StatusBadRequest)
+			writeError(res, http.StatusBadRequest, "type", fmt.Sprintf("unsupported metric type %q", metric.MType))
 			app.Log.Errorln("Unsupported metric type")
 			return
 		}
@@ -107,31 +110,45 @@ func GetParam(app *context.AppContext) http.HandlerFunc {
 	}
 }
 
+// writeGetError answers 404 for any metric which cannot be read, unless the
+// storage has failed.
+func writeGetError(app *context.AppContext, res http.ResponseWriter, metric *usecase.Metric, err error) {
+	app.Log.Errorln("Cannot get metric:", err)
+	if errorCode(err) == http.StatusInternalServerError {
+		writeError(res, http.StatusInternalServerError, "", "cannot get metric")
+		return
+	}
+	writeError(res, http.StatusNotFound, "", fmt.Sprintf("Value of %s is absent", metric.ID))
+}
+
 func GetAllParams(app *context.AppContext) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		var resultString string
 
-		result, err := app.DB.GetAll()
-		if err != nil {
-			res.WriteHeader(http.StatusBadGateway)
-			fmt.Fprintf(res, "Something went wrong\n")
-			return
-		}
-
 		res.Header().Set("Content-Type", "text/html; charset=utf-8")
-		res.WriteHeader(http.StatusOK)
-		for _, s := range *result {
+		wroteHeader := false
+
+		_, err := tenantDB(app, req).List(&usecase.ListQuery{Sort: usecase.SortByID}, func(s *usecase.Metric) error {
 			switch s.MType {
 			case "gauge":
 				resultString = storage.GaugeToString(*s.Value)
 			case "counter":
 				resultString = storage.CounterToString(*s.Delta)
 			default:
-				res.WriteHeader(http.StatusInternalServerError)
-				app.Log.Errorln("Unsupported metric type")
-				return
+				return fmt.Errorf("unsupported metric type %s", s.MType)
+			}
+			if !wroteHeader {
+				res.WriteHeader(http.StatusOK)
+				wroteHeader = true
 			}
 			fmt.Fprintf(res, "%s:\t%s\n", s.ID, resultString)
+			return nil
+		})
+		if err != nil {
+			app.Log.Errorln("Cannot get all metrics:", err)
+			if !wroteHeader {
+				writeError(res, http.StatusBadGateway, "", "cannot get metrics")
+			}
 		}
 	}
 }
@@ -140,82 +157,144 @@ func SetParamJSON(app *context.AppContext) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		var metric usecase.Metric
 
-		if err := json.NewDecoder(req.Body).Decode(&metric); err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
+		if err := decodeJSON(req, &metric); err != nil {
+			writeError(res, http.StatusBadRequest, "", err.Error())
 			app.Log.Errorln("Cannot decode request:", err)
 			return
 		}
 
 		if metric.ID == "" {
-			res.WriteHeader(http.StatusNotFound)
+			writeError(res, http.StatusNotFound, "id", "name is not defined")
 			app.Log.Errorln("Name is not defined")
 			return
 		}
 
-		result, err := app.DB.Set(&metric)
+		result, err := setMetric(app, req, &metric)
 		if err != nil {
-			res.WriteHeader(http.StatusBadRequest)
+			writeAPIError(res, err)
 			app.Log.Errorln("Cannot set metric:", err)
 			return
 		}
 
-		jsonData, err := json.Marshal(result)
-		if err != nil {
-			res.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(res, "Error in marshaler: %v\n", err)
-			app.Log.Errorln("Error in marshaller:", err)
-			return
-		}
+		writeJSON(app, res, http.StatusOK, result)
+	}
+}
 
-		if app.Cfg.StoreInterval == 0 {
-			err = app.DB.Dump(app.Cfg.FileStoragePath)
-			if err != nil {
-				res.WriteHeader(http.StatusInternalServerError)
-				app.Log.Errorln("Dump error:", err)
-				return
-			}
-		}
+// Batch modes of /updates/, chosen by the mode query parameter.
+const (
+	BatchAtomic     = "atomic"
+	BatchBestEffort = "best-effort"
+)
 
-		res.Header().Set("Content-Type", "application/json; charset=utf-8")
-		res.WriteHeader(http.StatusOK)
-		fmt.Fprintf(res, "%s", jsonData)
-	}
+type batchResult struct {
+	ID    string    `json:"id"`
+	MType string    `json:"type"`
+	Delta *int64    `json:"delta,omitempty"`
+	Value *float64  `json:"value,omitempty"`
+	Error *apiError `json:"error,omitempty"`
 }
 
+// SetMultiParamJSON answers the legacy POST /updates/, its batches are
+// best-effort unless the agent asks for an atomic one: see setBatch.
 func SetMultiParamJSON(app *context.AppContext) http.HandlerFunc {
+	return setBatch(app, BatchBestEffort)
+}
+
+// setBatch applies a batch and answers with per-item results in request
+// order. An atomic batch is applied only if all items are good, otherwise
+// nothing is applied and the status of the first failed item is returned.
+// A best-effort batch applies the good items and answers 207 Multi-Status
+// if some items failed. The mode query parameter overrides defaultMode.
+func setBatch(app *context.AppContext, defaultMode string) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		var metrics []usecase.Metric
 
-		if err := json.NewDecoder(req.Body).Decode(&metrics); err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
+		mode := req.URL.Query().Get("mode")
+		if mode == "" {
+			mode = defaultMode
+		}
+		if mode != BatchAtomic && mode != BatchBestEffort {
+			writeError(res, http.StatusBadRequest, "mode", "unsupported batch mode "+mode)
+			app.Log.Errorln("Unsupported batch mode:", mode)
+			return
+		}
+
+		if err := decodeJSON(req, &metrics); err != nil {
+			writeError(res, http.StatusBadRequest, "", err.Error())
 			app.Log.Errorln("Cannot decode request:", err)
 			return
 		}
 
-		for _, metric := range metrics {
+		results := make([]batchResult, len(metrics))
+		var valid []usecase.Metric
+		var validIndex []int
+		for i, metric := range metrics {
+			results[i] = batchResult{ID: metric.ID, MType: metric.MType}
 			if metric.ID == "" {
-				res.WriteHeader(http.StatusNotFound)
-				app.Log.Errorln("Name is not defined")
-				return
+				results[i].Error = &apiError{Code: http.StatusNotFound, Message: "name is not defined", Field: "id"}
+				continue
+			}
+			if err := usecase.Validate(&metric); err != nil {
+				results[i].Error = newAPIError(err)
+				continue
+			}
+			valid = append(valid, metric)
+			validIndex = append(validIndex, i)
+		}
+
+		atomic := mode == BatchAtomic
+		if atomic && len(valid) != len(metrics) {
+			// nothing reaches the storage
+			valid = nil
+			for i := range results {
+				if results[i].Error == nil {
+					results[i].Error = newAPIError(usecase.ErrAborted)
+				}
 			}
-			_, err := app.DB.Set(&metric)
+		}
+
+		applied := 0
+		if len(valid) > 0 {
+			items, err := tenantDB(app, req).SetBatch(valid, atomic)
 			if err != nil {
-				res.WriteHeader(http.StatusBadRequest)
-				app.Log.Errorln("Cannot set metric:", err)
+				writeError(res, http.StatusInternalServerError, "", "cannot set metrics")
+				app.Log.Errorln("Cannot set metrics:", err)
 				return
 			}
+			for k, item := range items {
+				r := &results[validIndex[k]]
+				if item.Err != nil {
+					r.Error = newAPIError(item.Err)
+					continue
+				}
+				r.Delta, r.Value = item.Metric.Delta, item.Metric.Value
+				applied++
+			}
 		}
 
-		if app.Cfg.StoreInterval == 0 {
-			err := app.DB.Dump(app.Cfg.FileStoragePath)
-			if err != nil {
-				res.WriteHeader(http.StatusInternalServerError)
+		status := http.StatusOK
+		for _, r := range results {
+			if r.Error == nil {
+				continue
+			}
+			app.Log.Errorln("Cannot set metric", r.ID, ":", r.Error.Message)
+			switch {
+			case !atomic:
+				status = http.StatusMultiStatus
+			case status == http.StatusOK && r.Error.Code != http.StatusFailedDependency:
+				status = r.Error.Code
+			}
+		}
+
+		if applied > 0 {
+			if err := syncDump(app, req); err != nil {
+				writeError(res, http.StatusInternalServerError, "", errDump.Error())
 				app.Log.Errorln("Dump error:", err)
 				return
 			}
 		}
 
-		res.WriteHeader(http.StatusOK)
+		writeJSON(app, res, status, results)
 	}
 }
 
@@ -223,61 +302,108 @@ func GetParamJSON(app *context.AppContext) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		var metric usecase.Metric
 
-		if err := json.NewDecoder(req.Body).Decode(&metric); err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
+		if err := decodeJSON(req, &metric); err != nil {
+			writeError(res, http.StatusBadRequest, "", err.Error())
 			app.Log.Errorln(err.Error())
 			return
 		}
 
 		if metric.ID == "" {
-			res.WriteHeader(http.StatusNotFound)
+			writeError(res, http.StatusNotFound, "id", "name is not defined")
 			app.Log.Errorln("Name is not defined")
 			return
 		}
 
-		result, err := app.DB.Get(&metric)
+		result, err := tenantDB(app, req).Get(&metric)
 		if err != nil {
-			res.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(res, "Value of %s is absent\n", metric.ID)
-			app.Log.Errorln("Cannot get metric:", err)
+			writeGetError(app, res, &metric, err)
 			return
 		}
 
-		jsonData, err := json.Marshal(result)
-		if err != nil {
-			res.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(res, "Error in marshaller: %v\n", err)
-			app.Log.Errorln("Error in marshaller:", err)
-			return
-		}
-
-		res.Header().Set("Content-Type", "application/json; charset=utf-8")
-		res.WriteHeader(http.StatusOK)
-		fmt.Fprintf(res, "%s", jsonData)
+		writeJSON(app, res, http.StatusOK, result)
 	}
 }
 
+// GetAllParamsJSON lists metrics page by page:
+// GET /values/?prefix=&type=&sort=id|value&limit=&cursor=
+// The page is streamed as {"metrics":[...],"next_cursor":"..."}, the cursor
+// is absent on the last page.
 func GetAllParamsJSON(app *context.AppContext) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
-		result, err := app.DB.GetAll()
-		if err != nil {
-			res.WriteHeader(http.StatusBadGateway)
-			fmt.Fprintf(res, "Something went wrong\n")
-			app.Log.Errorln("Cannot get all metrics:", err)
+		params := req.URL.Query()
+		query := usecase.ListQuery{
+			Prefix: params.Get("prefix"),
+			MType:  params.Get("type"),
+			Sort:   params.Get("sort"),
+		}
+
+		if query.Sort == "" {
+			query.Sort = usecase.SortByID
+		}
+		if query.Sort != usecase.SortByID && query.Sort != usecase.SortByValue {
+			writeError(res, http.StatusBadRequest, "sort", "unsupported sort "+query.Sort)
+			app.Log.Errorln("Unsupported sort:", query.Sort)
 			return
 		}
 
-		jsonData, err := json.Marshal(*result)
-		if err != nil {
-			res.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(res, "Error in marshaller: %v\n", err)
-			app.Log.Errorln("Error in marchaller:", err)
+		if query.MType != "" && query.MType != "gauge" && query.MType != "counter" {
+			writeError(res, http.StatusBadRequest, "type", fmt.Sprintf("unsupported metric type %q", query.MType))
+			app.Log.Errorln("Unsupported metric type:", query.MType)
 			return
 		}
 
+		if limit := params.Get("limit"); limit != "" {
+			var err error
+			query.Limit, err = strconv.Atoi(limit)
+			if err != nil || query.Limit < 0 {
+				writeError(res, http.StatusBadRequest, "limit", "limit must be a non-negative integer")
+				app.Log.Errorln("Bad limit:", limit)
+				return
+			}
+		}
+
+		if cursor := params.Get("cursor"); cursor != "" {
+			var err error
+			query.Cursor, err = usecase.ParseCursor(cursor)
+			if err != nil {
+				writeError(res, http.StatusBadRequest, "cursor", err.Error())
+				app.Log.Errorln("Bad cursor:", err)
+				return
+			}
+		}
+
 		res.Header().Set("Content-Type", "application/json; charset=utf-8")
-		res.WriteHeader(http.StatusOK)
-		fmt.Fprintf(res, "%s", jsonData)
+		enc := json.NewEncoder(res)
+		count := 0
+
+		next, err := tenantDB(app, req).List(&query, func(m *usecase.Metric) error {
+			if count == 0 {
+				res.WriteHeader(http.StatusOK)
+				fmt.Fprint(res, `{"metrics":[`)
+			} else {
+				fmt.Fprint(res, ",")
+			}
+			count++
+			return enc.Encode(m)
+		})
+		if err != nil {
+			app.Log.Errorln("Cannot get all metrics:", err)
+			if count == 0 {
+				writeError(res, http.StatusBadGateway, "", "cannot get metrics")
+			}
+			// a truncated document tells the client that the listing failed
+			return
+		}
+
+		if count == 0 {
+			res.WriteHeader(http.StatusOK)
+			fmt.Fprint(res, `{"metrics":[`)
+		}
+		fmt.Fprint(res, "]")
+		if next != nil {
+			fmt.Fprintf(res, `,"next_cursor":%q`, next.String())
+		}
+		fmt.Fprint(res, "}\n")
 	}
 }
 
@@ -285,15 +411,133 @@ func CheckDBConnect(app *context.AppContext) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 
 		if app.Cfg.DSN == "" {
-			res.WriteHeader(http.StatusInternalServerError)
+			writeError(res, http.StatusInternalServerError, "", "database is not configured")
 			return
 		}
 
 		if err := app.DB.Ping(); err != nil {
-			res.WriteHeader(http.StatusInternalServerError)
+			writeError(res, http.StatusInternalServerError, "", "database is not available")
 			app.Log.Errorln("DB check test failed:", err)
+			return
+		}
+
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+const defaultTopK = 10
+
+func GetAggregate(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		params := req.URL.Query()
+		query := usecase.AggregateQuery{
+			Op:    params.Get("op"),
+			Match: params.Get("match"),
+			MType: params.Get("type"),
+			K:     defaultTopK,
+		}
+
+		switch query.Op {
+		case usecase.AggSum, usecase.AggAvg, usecase.AggMin, usecase.AggMax, usecase.AggCount, usecase.AggTopK:
+		default:
+			writeError(res, http.StatusBadRequest, "op", "unsupported aggregation "+query.Op)
+			app.Log.Errorln("Unsupported aggregation:", query.Op)
+			return
+		}
+
+		if query.MType != "" && query.MType != "gauge" && query.MType != "counter" {
+			writeError(res, http.StatusBadRequest, "type", fmt.Sprintf("unsupported metric type %q", query.MType))
+			app.Log.Errorln("Unsupported metric type:", query.MType)
+			return
+		}
+
+		if query.Match == "" {
+			query.Match = "*"
+		}
+		if _, err := regexp.Compile(usecase.GlobToRegexp(query.Match)); err != nil {
+			writeError(res, http.StatusBadRequest, "match", "bad pattern "+query.Match)
+			app.Log.Errorln("Bad pattern:", query.Match, err)
+			return
+		}
+
+		if k := params.Get("k"); k != "" {
+			var err error
+			query.K, err = strconv.Atoi(k)
+			if err != nil || query.K <= 0 {
+				writeError(res, http.StatusBadRequest, "k", "k must be a positive integer")
+				app.Log.Errorln("Bad k:", k)
+				return
+			}
+		}
+
+		result, err := tenantDB(app, req).Aggregate(&query)
+		if err != nil {
+			writeError(res, http.StatusInternalServerError, "", "cannot aggregate metrics")
+			app.Log.Errorln("Cannot aggregate metrics:", err)
+			return
+		}
+
+		writeJSON(app, res, http.StatusOK, result)
+	}
+}
+
+func GetAlerts(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		result := []alerting.Alert{}
+		if app.Alerts != nil {
+			result = app.Alerts.Active(tenantID(req))
+		}
+
+		writeJSON(app, res, http.StatusOK, result)
+	}
+}
+
+func GetDumpStatus(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if app.Dumper == nil {
+			writeError(res, http.StatusNotFound, "", "dumps are not used with this storage")
+			return
+		}
+
+		writeDumpStatus(app, res, app.Dumper.Status(tenantID(req)))
+	}
+}
+
+func TriggerDump(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if app.Dumper == nil {
+			writeError(res, http.StatusNotFound, "", "dumps are not used with this storage")
+			return
+		}
+
+		status, err := app.Dumper.Dump(tenantID(req), true)
+		if err != nil {
+			app.Log.Errorln("Dump error:", err)
 		}
+		writeDumpStatus(app, res, status)
+	}
+}
 
+func writeDumpStatus(app *context.AppContext, res http.ResponseWriter, status storage.DumpStatus) {
+	if status.Healthy {
+		writeJSON(app, res, http.StatusOK, status)
+	} else {
+		writeJSON(app, res, http.StatusInternalServerError, status)
+	}
+}
+
+func GetOpenAPI(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json; charset=utf-8")
+		res.WriteHeader(http.StatusOK)
+		res.Write(api.Spec)
+	}
+}
+
+func GetDocs(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
 		res.WriteHeader(http.StatusOK)
+		res.Write(api.Docs)
 	}
 }
@@ -3,6 +3,11 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"metrics-server/internal/config"
+	"metrics-server/internal/influx"
+	"metrics-server/internal/mapping"
+	"metrics-server/internal/otlp"
+	"metrics-server/internal/ratelimit"
 	"metrics-server/internal/storage"
 	"metrics-server/internal/storage/memory"
 	"metrics-server/internal/usecase"
@@ -10,16 +15,28 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 var testCounter int64 = 527
 var testGauge float64 = 0.00005
 
+func newTestApp(db usecase.Repositories) *context.AppContext {
+	return &context.AppContext{
+		DB:  db,
+		Log: zap.NewNop().Sugar(),
+		Cfg: &config.Config{StoreInterval: 300},
+	}
+}
+
 func Test_SetParam(t *testing.T) {
 	type want struct {
 		code int
@@ -67,7 +84,7 @@ func Test_SetParam(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			app := &context.AppContext{DB: memory.NewMemStorage()}
+			app := newTestApp(memory.NewMemStorage())
 			r := chi.NewRouter()
 			r.Post(`/update/{mtype}/{name}/{value}`, SetParam(app))
 
@@ -93,14 +110,14 @@ func Test_GetParam(t *testing.T) {
 	}
 	tests := []struct {
 		name    string
-		storage memory.MemStorage
+		storage *memory.MemStorage
 		request string
 		want    want
 	}{
 		{
 			name:    "Existent counter",
 			request: "/value/counter/c1",
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{"c1": {MType: "counter", Delta: &testCounter}},
 			},
 			want: want{
@@ -111,18 +128,18 @@ func Test_GetParam(t *testing.T) {
 		{
 			name:    "Nonexistent counter",
 			request: "/value/counter/c2",
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{"c1": {MType: "counter", Delta: &testCounter}},
 			},
 			want: want{
 				code:   404,
-				answer: "Value of c2 is absent\n",
+				answer: "{\"code\":404,\"message\":\"Value of c2 is absent\"}\n",
 			},
 		},
 		{
 			name:    "Existent gauge",
 			request: "/value/gauge/g1",
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{"g1": {MType: "gauge", Value: &testGauge}},
 			},
 			want: want{
@@ -133,29 +150,29 @@ func Test_GetParam(t *testing.T) {
 		{
 			name:    "Nonexistent gauge",
 			request: "/value/gauge/g2",
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{"g1": {MType: "gauge", Value: &testGauge}},
 			},
 			want: want{
 				code:   404,
-				answer: "Value of g2 is absent\n",
+				answer: "{\"code\":404,\"message\":\"Value of g2 is absent\"}\n",
 			},
 		},
 		{
 			name:    "Bad mtype",
 			request: "/value/SomeWrongMType/g1",
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{"g1": {MType: "gauge", Value: &testGauge}},
 			},
 			want: want{
 				code:   404,
-				answer: "Value of g1 is absent\n",
+				answer: "{\"code\":404,\"message\":\"Value of g1 is absent\"}\n",
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			app := &context.AppContext{DB: &tt.storage}
+			app := newTestApp(tt.storage)
 			r := chi.NewRouter()
 			r.Get(`/value/{mtype}/{name}`, GetParam(app))
 
@@ -182,14 +199,14 @@ func Test_getAllParams(t *testing.T) {
 	}
 	tests := []struct {
 		name    string
-		storage memory.MemStorage
+		storage *memory.MemStorage
 		request string
 		want    want
 	}{
 		{
 			name:    "Simple check",
 			request: "/",
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{
 					"g1": {MType: "gauge", Value: &testGauge},
 					"c1": {MType: "counter", Delta: &testCounter},
@@ -197,13 +214,13 @@ func Test_getAllParams(t *testing.T) {
 			},
 			want: want{
 				code:   200,
-				answer: "g1:\t" + storage.GaugeToString(testGauge) + "\nc1:\t" + storage.CounterToString(testCounter) + "\n",
+				answer: "c1:\t" + storage.CounterToString(testCounter) + "\ng1:\t" + storage.GaugeToString(testGauge) + "\n",
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			app := &context.AppContext{DB: &tt.storage}
+			app := newTestApp(tt.storage)
 			r := chi.NewRouter()
 			r.Get(`/`, GetAllParams(app))
 
@@ -289,7 +306,7 @@ func Test_SetParamJSON(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			app := &context.AppContext{DB: memory.NewMemStorage()}
+			app := newTestApp(memory.NewMemStorage())
 			r := chi.NewRouter()
 			r.Post(`/update/`, SetParamJSON(app))
 
@@ -318,7 +335,7 @@ func Test_GetParamJSON(t *testing.T) {
 	}
 	tests := []struct {
 		name    string
-		storage memory.MemStorage
+		storage *memory.MemStorage
 		request usecase.Metric
 		want    want
 	}{
@@ -328,7 +345,7 @@ func Test_GetParamJSON(t *testing.T) {
 				ID:    "c1",
 				MType: "counter",
 			},
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{"c1": {MType: "counter", Delta: &testCounter}},
 			},
 			want: want{
@@ -342,12 +359,12 @@ func Test_GetParamJSON(t *testing.T) {
 				ID:    "c2",
 				MType: "counter",
 			},
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{"c1": {MType: "counter", Delta: &testCounter}},
 			},
 			want: want{
 				code:   404,
-				answer: "Value of c2 is absent\n",
+				answer: "{\"code\":404,\"message\":\"Value of c2 is absent\"}\n",
 			},
 		},
 		{
@@ -356,7 +373,7 @@ func Test_GetParamJSON(t *testing.T) {
 				ID:    "g1",
 				MType: "gauge",
 			},
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{"g1": {MType: "gauge", Value: &testGauge}},
 			},
 			want: want{
@@ -370,12 +387,12 @@ func Test_GetParamJSON(t *testing.T) {
 				ID:    "g2",
 				MType: "gauge",
 			},
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{"g1": {MType: "gauge", Value: &testGauge}},
 			},
 			want: want{
 				code:   404,
-				answer: "Value of g2 is absent\n",
+				answer: "{\"code\":404,\"message\":\"Value of g2 is absent\"}\n",
 			},
 		},
 		{
@@ -384,18 +401,18 @@ func Test_GetParamJSON(t *testing.T) {
 				ID:    "g1",
 				MType: "SomeWrongNType",
 			},
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{"g1": {MType: "gauge", Value: &testGauge}},
 			},
 			want: want{
 				code:   404,
-				answer: "Value of g1 is absent\n",
+				answer: "{\"code\":404,\"message\":\"Value of g1 is absent\"}\n",
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			app := &context.AppContext{DB: &tt.storage}
+			app := newTestApp(tt.storage)
 			r := chi.NewRouter()
 			r.Post(`/value/`, GetParamJSON(app))
 
@@ -425,14 +442,14 @@ func Test_getAllParamsJSON(t *testing.T) {
 	}
 	tests := []struct {
 		name    string
-		storage memory.MemStorage
+		storage *memory.MemStorage
 		request string
 		want    want
 	}{
 		{
 			name:    "Simple check",
 			request: "/",
-			storage: memory.MemStorage{
+			storage: &memory.MemStorage{
 				Metrics: map[string]memory.MetricParam{
 					"g1": {MType: "gauge", Value: &testGauge},
 					"c1": {MType: "counter", Delta: &testCounter},
@@ -440,13 +457,13 @@ func Test_getAllParamsJSON(t *testing.T) {
 			},
 			want: want{
 				code:   200,
-				answer: `[{"id":"g1","type":"gauge","value":` + strconv.FormatFloat(testGauge, 'f', -1, 64) + `},{"id":"c1","type":"counter","delta":` + strconv.FormatInt(testCounter, 10) + `}]`,
+				answer: `{"metrics":[{"id":"c1","type":"counter","delta":` + strconv.FormatInt(testCounter, 10) + `},{"id":"g1","type":"gauge","value":` + strconv.FormatFloat(testGauge, 'f', -1, 64) + `}]}`,
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			app := &context.AppContext{DB: &tt.storage}
+			app := newTestApp(tt.storage)
 			r := chi.NewRouter()
 			r.Get(`/`, GetAllParamsJSON(app))
 
@@ -470,3 +487,893 @@ func Test_getAllParamsJSON(t *testing.T) {
 		})
 	}
 }
+
+func Test_GetAggregate(t *testing.T) {
+	var g1, g2, g3 float64 = 1.5, 2.5, 8
+	var c1 int64 = 4
+	storage := &memory.MemStorage{
+		Metrics: map[string]memory.MetricParam{
+			"HeapAlloc.a1": {MType: "gauge", Value: &g1},
+			"HeapAlloc.a2": {MType: "gauge", Value: &g2},
+			"HeapInuse.a1": {MType: "gauge", Value: &g3},
+			"HeapAlloc.c":  {MType: "counter", Delta: &c1},
+		},
+	}
+
+	type want struct {
+		code   int
+		answer string
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    want
+	}{
+		{
+			name:    "sum",
+			request: "/aggregate?op=sum&match=HeapAlloc.*&type=gauge",
+			want: want{
+				code:   200,
+				answer: `{"op":"sum","match":"HeapAlloc.*","type":"gauge","count":2,"value":4}`,
+			},
+		},
+		{
+			name:    "avg of both types",
+			request: "/aggregate?op=avg&match=HeapAlloc.*",
+			want: want{
+				code:   200,
+				answer: `{"op":"avg","match":"HeapAlloc.*","count":3,"value":2.6666666666666665}`,
+			},
+		},
+		{
+			name:    "max with class",
+			request: "/aggregate?op=max&match=Heap*.a[12]",
+			want: want{
+				code:   200,
+				answer: `{"op":"max","match":"Heap*.a[12]","count":3,"value":8}`,
+			},
+		},
+		{
+			name:    "min of nothing",
+			request: "/aggregate?op=min&match=Nothing*",
+			want: want{
+				code:   200,
+				answer: `{"op":"min","match":"Nothing*","count":0}`,
+			},
+		},
+		{
+			name:    "count all",
+			request: "/aggregate?op=count",
+			want: want{
+				code:   200,
+				answer: `{"op":"count","match":"*","count":4,"value":4}`,
+			},
+		},
+		{
+			name:    "topk",
+			request: "/aggregate?op=topk&k=2&type=gauge",
+			want: want{
+				code:   200,
+				answer: `{"op":"topk","match":"*","type":"gauge","count":3,"top":[{"id":"HeapInuse.a1","type":"gauge","value":8},{"id":"HeapAlloc.a2","type":"gauge","value":2.5}]}`,
+			},
+		},
+		{
+			name:    "bad op",
+			request: "/aggregate?op=median",
+			want: want{
+				code: 400,
+			},
+		},
+		{
+			name:    "negated class with a bracket",
+			request: "/aggregate?op=count&match=HeapAlloc.[!]a]*",
+			want: want{
+				code:   200,
+				answer: `{"op":"count","match":"HeapAlloc.[!]a]*","count":1,"value":1}`,
+			},
+		},
+		{
+			name:    "bad range",
+			request: "/aggregate?op=count&match=Heap[z-a]",
+			want: want{
+				code: 400,
+			},
+		},
+		{
+			name:    "bad k",
+			request: "/aggregate?op=topk&k=-1",
+			want: want{
+				code: 400,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(storage)
+			r := chi.NewRouter()
+			r.Get(`/aggregate`, GetAggregate(app))
+
+			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+
+			res := w.Result()
+
+			defer request.Body.Close()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.want.code, res.StatusCode)
+			if tt.want.answer != "" {
+				assert.JSONEq(t, tt.want.answer, w.Body.String())
+			}
+		})
+	}
+}
+
+func Test_getAllParamsJSONPages(t *testing.T) {
+	var g1, g2, g3 float64 = 3, 1, 2
+	var c1 int64 = 10
+	storage := &memory.MemStorage{
+		Metrics: map[string]memory.MetricParam{
+			"a.g1": {MType: "gauge", Value: &g1},
+			"a.g2": {MType: "gauge", Value: &g2},
+			"a.g3": {MType: "gauge", Value: &g3},
+			"b.c1": {MType: "counter", Delta: &c1},
+		},
+	}
+
+	type page struct {
+		Metrics    []usecase.Metric `json:"metrics"`
+		NextCursor string           `json:"next_cursor"`
+	}
+	list := func(t *testing.T, request string) (int, page) {
+		app := newTestApp(storage)
+		r := chi.NewRouter()
+		r.Get(`/values/`, GetAllParamsJSON(app))
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, request, nil))
+
+		var p page
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+		}
+		return w.Code, p
+	}
+	ids := func(p page) []string {
+		result := []string{}
+		for _, m := range p.Metrics {
+			result = append(result, m.ID)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		pages   [][]string
+	}{
+		{
+			name:    "by id",
+			request: "/values/?limit=3",
+			pages:   [][]string{{"a.g1", "a.g2", "a.g3"}, {"b.c1"}},
+		},
+		{
+			name:    "by value",
+			request: "/values/?sort=value&limit=2",
+			pages:   [][]string{{"a.g2", "a.g3"}, {"a.g1", "b.c1"}},
+		},
+		{
+			name:    "prefix and type",
+			request: "/values/?prefix=a.&type=gauge&limit=2",
+			pages:   [][]string{{"a.g1", "a.g2"}, {"a.g3"}},
+		},
+		{
+			name:    "nothing",
+			request: "/values/?prefix=z",
+			pages:   [][]string{{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := tt.request
+			for i, want := range tt.pages {
+				code, p := list(t, request)
+				assert.Equal(t, http.StatusOK, code)
+				assert.Equal(t, want, ids(p))
+				if i == len(tt.pages)-1 {
+					assert.Empty(t, p.NextCursor)
+				} else {
+					assert.NotEmpty(t, p.NextCursor)
+				}
+				request = tt.request + "&cursor=" + p.NextCursor
+			}
+		})
+	}
+
+	for _, request := range []string{"/values/?sort=name", "/values/?limit=x", "/values/?cursor=@@", "/values/?type=x"} {
+		code, _ := list(t, request)
+		assert.Equal(t, http.StatusBadRequest, code, request)
+	}
+}
+
+func Test_SetMultiParamJSON(t *testing.T) {
+	type want struct {
+		code    int
+		answer  string
+		counter int64 // stored c1 after the batch
+	}
+	tests := []struct {
+		name   string
+		target string
+		batch  string
+		want   want
+	}{
+		{
+			name:   "good batch",
+			target: "/updates/",
+			batch:  `[{"id":"c1","type":"counter","delta":2},{"id":"g1","type":"gauge","value":1.5},{"id":"c1","type":"counter","delta":3}]`,
+			want: want{
+				code:    200,
+				answer:  `[{"id":"c1","type":"counter","delta":3},{"id":"g1","type":"gauge","value":1.5},{"id":"c1","type":"counter","delta":6}]`,
+				counter: 6,
+			},
+		},
+		{
+			name:   "atomic with bad item",
+			target: "/api/v1/metrics/",
+			batch:  `[{"id":"c1","type":"counter","delta":2},{"id":"g1","type":"gauge"}]`,
+			want: want{
+				code:    400,
+				answer:  `[{"id":"c1","type":"counter","error":{"code":424,"message":"not applied, batch aborted"}},{"id":"g1","type":"gauge","error":{"code":400,"message":"value is required for gauge","field":"value"}}]`,
+				counter: 1,
+			},
+		},
+		{
+			name:   "atomic without name",
+			target: "/updates/?mode=atomic",
+			batch:  `[{"id":"c1","type":"counter","delta":2},{"id":"","type":"gauge","value":1}]`,
+			want: want{
+				code:    404,
+				answer:  `[{"id":"c1","type":"counter","error":{"code":424,"message":"not applied, batch aborted"}},{"id":"","type":"gauge","error":{"code":404,"message":"name is not defined","field":"id"}}]`,
+				counter: 1,
+			},
+		},
+		{
+			name:   "best effort by default on the legacy route",
+			target: "/updates/",
+			batch:  `[{"id":"c1","type":"counter","delta":2},{"id":"c1","type":"gauge","value":1},{"id":"","type":"gauge","value":1}]`,
+			want: want{
+				code:    207,
+				answer:  `[{"id":"c1","type":"counter","delta":3},{"id":"c1","type":"gauge","error":{"code":400,"message":"value type changing is not enabled: gauge"}},{"id":"","type":"gauge","error":{"code":404,"message":"name is not defined","field":"id"}}]`,
+				counter: 3,
+			},
+		},
+		{
+			name:   "best effort on request",
+			target: "/api/v1/metrics/?mode=best-effort",
+			batch:  `[{"id":"c1","type":"counter","delta":2},{"id":"g1","type":"gauge"}]`,
+			want: want{
+				code:    207,
+				answer:  `[{"id":"c1","type":"counter","delta":3},{"id":"g1","type":"gauge","error":{"code":400,"message":"value is required for gauge","field":"value"}}]`,
+				counter: 3,
+			},
+		},
+		{
+			name:   "bad mode",
+			target: "/updates/?mode=some",
+			batch:  `[]`,
+			want: want{
+				code:    400,
+				counter: 1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var initial int64 = 1
+			storage := &memory.MemStorage{
+				Metrics: map[string]memory.MetricParam{"c1": {MType: "counter", Delta: &initial}},
+			}
+			app := newTestApp(storage)
+			r := chi.NewRouter()
+			r.Post(`/updates/`, SetMultiParamJSON(app))
+			r.Post(`/api/v1/metrics/`, PostMetrics(app))
+
+			request := httptest.NewRequest(http.MethodPost, tt.target, bytes.NewReader([]byte(tt.batch)))
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+
+			res := w.Result()
+
+			defer request.Body.Close()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.want.code, res.StatusCode)
+			if tt.want.answer != "" {
+				assert.JSONEq(t, tt.want.answer, w.Body.String())
+			}
+			assert.Equal(t, tt.want.counter, *storage.Metrics["c1"].Delta)
+		})
+	}
+}
+
+func Test_Validation(t *testing.T) {
+	type want struct {
+		code  int
+		field string
+	}
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   want
+	}{
+		{
+			name:   "NaN in URL",
+			target: "/update/gauge/g1/NaN",
+			want:   want{code: 400, field: "value"},
+		},
+		{
+			name:   "infinity in URL",
+			target: "/update/gauge/g1/+Inf",
+			want:   want{code: 400, field: "value"},
+		},
+		{
+			name:   "bad charset in URL",
+			target: "/update/counter/c%201/1",
+			want:   want{code: 400, field: "id"},
+		},
+		{
+			name:   "unknown field",
+			target: "/update/",
+			body:   `{"id":"g1","type":"gauge","value":1,"unit":"s"}`,
+			want:   want{code: 400},
+		},
+		{
+			name:   "huge ID",
+			target: "/update/",
+			body:   `{"id":"` + strings.Repeat("a", usecase.MaxIDLength+1) + `","type":"gauge","value":1}`,
+			want:   want{code: 400, field: "id"},
+		},
+		{
+			name:   "gauge with delta",
+			target: "/update/",
+			body:   `{"id":"g1","type":"gauge","value":1,"delta":1}`,
+			want:   want{code: 400, field: "delta"},
+		},
+		{
+			name:   "counter without delta",
+			target: "/update/",
+			body:   `{"id":"c1","type":"counter"}`,
+			want:   want{code: 400, field: "delta"},
+		},
+		{
+			name:   "batch item",
+			target: "/updates/?mode=atomic",
+			body:   `[{"id":"g/1","type":"gauge","value":1}]`,
+			want:   want{code: 400},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(memory.NewMemStorage())
+			r := chi.NewRouter()
+			r.Post(`/update/{mtype}/{name}/{value}`, SetParam(app))
+			r.Post(`/update/`, SetParamJSON(app))
+			r.Post(`/updates/`, SetMultiParamJSON(app))
+
+			request := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.want.code, res.StatusCode)
+			assert.Equal(t, "application/json; charset=utf-8", res.Header.Get("Content-Type"))
+
+			if strings.HasPrefix(tt.target, "/updates/") {
+				var results []batchResult
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&results))
+				require.Len(t, results, 1)
+				require.NotNil(t, results[0].Error)
+				assert.Equal(t, "id", results[0].Error.Field)
+				return
+			}
+
+			var body apiError
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+			assert.Equal(t, tt.want.code, body.Code)
+			assert.Equal(t, tt.want.field, body.Field)
+			assert.NotEmpty(t, body.Message)
+		})
+	}
+}
+
+func Test_MetricsV1(t *testing.T) {
+	app := newTestApp(memory.NewMemStorage())
+	r := chi.NewRouter()
+	r.Route(`/api/v1/metrics`, func(r chi.Router) {
+		r.Get(`/{mtype}/{name}`, GetMetric(app))
+		r.Put(`/{mtype}/{name}`, PutMetric(app))
+		r.Patch(`/{mtype}/{name}`, PatchMetric(app))
+		r.Delete(`/{mtype}/{name}`, DeleteMetric(app))
+	})
+
+	steps := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		code     int
+		answer   string
+		location string
+	}{
+		{
+			name:   "patch absent",
+			method: http.MethodPatch,
+			target: "/api/v1/metrics/counter/c1",
+			body:   `{"delta":1}`,
+			code:   404,
+		},
+		{
+			name:     "put creates",
+			method:   http.MethodPut,
+			target:   "/api/v1/metrics/counter/c1",
+			body:     `{"delta":5}`,
+			code:     201,
+			answer:   `{"id":"c1","type":"counter","delta":5}`,
+			location: "/api/v1/metrics/counter/c1",
+		},
+		{
+			name:   "patch adds to counter",
+			method: http.MethodPatch,
+			target: "/api/v1/metrics/counter/c1",
+			body:   `{"id":"c1","delta":2}`,
+			code:   200,
+			answer: `{"id":"c1","type":"counter","delta":7}`,
+		},
+		{
+			name:   "put replaces counter",
+			method: http.MethodPut,
+			target: "/api/v1/metrics/counter/c1",
+			body:   `{"delta":1}`,
+			code:   200,
+			answer: `{"id":"c1","type":"counter","delta":1}`,
+		},
+		{
+			name:   "put with other type",
+			method: http.MethodPut,
+			target: "/api/v1/metrics/gauge/c1",
+			body:   `{"value":1}`,
+			code:   400,
+		},
+		{
+			name:   "put with id not matching URL",
+			method: http.MethodPut,
+			target: "/api/v1/metrics/counter/c1",
+			body:   `{"id":"c2","delta":1}`,
+			code:   400,
+		},
+		{
+			name:   "put without value",
+			method: http.MethodPut,
+			target: "/api/v1/metrics/gauge/g1",
+			body:   `{}`,
+			code:   400,
+		},
+		{
+			name:   "get",
+			method: http.MethodGet,
+			target: "/api/v1/metrics/counter/c1",
+			code:   200,
+			answer: `{"id":"c1","type":"counter","delta":1}`,
+		},
+		{
+			name:   "get bad type",
+			method: http.MethodGet,
+			target: "/api/v1/metrics/histogram/c1",
+			code:   400,
+		},
+		{
+			name:   "delete",
+			method: http.MethodDelete,
+			target: "/api/v1/metrics/counter/c1",
+			code:   204,
+		},
+		{
+			name:   "get deleted",
+			method: http.MethodGet,
+			target: "/api/v1/metrics/counter/c1",
+			code:   404,
+		},
+		{
+			name:   "delete absent",
+			method: http.MethodDelete,
+			target: "/api/v1/metrics/counter/c1",
+			code:   404,
+		},
+		{
+			name:   "patch deleted",
+			method: http.MethodPatch,
+			target: "/api/v1/metrics/counter/c1",
+			body:   `{"delta":1}`,
+			code:   404,
+		},
+		{
+			name:   "get not recreated",
+			method: http.MethodGet,
+			target: "/api/v1/metrics/counter/c1",
+			code:   404,
+		},
+	}
+	for _, s := range steps {
+		request := httptest.NewRequest(s.method, s.target, strings.NewReader(s.body))
+		w := httptest.NewRecorder()
+
+		r.ServeHTTP(w, request)
+
+		res := w.Result()
+		defer res.Body.Close()
+
+		assert.Equal(t, s.code, res.StatusCode, s.name)
+		assert.Equal(t, s.location, res.Header.Get("Location"), s.name)
+		if s.answer != "" {
+			assert.JSONEq(t, s.answer, w.Body.String(), s.name)
+		}
+	}
+}
+
+func Test_PatchDeleteRace(t *testing.T) {
+	db := memory.NewMemStorage()
+	app := newTestApp(db)
+	r := chi.NewRouter()
+	r.Patch(`/api/v1/metrics/{mtype}/{name}`, PatchMetric(app))
+	r.Delete(`/api/v1/metrics/{mtype}/{name}`, DeleteMetric(app))
+
+	serve := func(method, body string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/api/v1/metrics/counter/c1", strings.NewReader(body)))
+		return w.Code
+	}
+	for range 200 {
+		var delta int64 = 1
+		_, err := db.Set(&usecase.Metric{ID: "c1", MType: "counter", Delta: &delta})
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(http.MethodPatch, `{"delta":1}`)
+		}()
+		assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, ""))
+		wg.Wait()
+
+		// whatever came first, a patch must not bring the metric back
+		_, err = db.Get(&usecase.Metric{ID: "c1", MType: "counter"})
+		require.ErrorIs(t, err, usecase.ErrNotFound)
+	}
+}
+
+func Test_Tenants(t *testing.T) {
+	db := memory.NewMemStorage()
+	db.Limit = 1
+	db.MaxTenants = 2
+	app := newTestApp(db)
+	r := chi.NewRouter()
+	r.Use(Tenant(app))
+	r.Post(`/update/`, SetParamJSON(app))
+	r.Post(`/value/`, GetParamJSON(app))
+
+	steps := []struct {
+		name   string
+		tenant string
+		target string
+		body   string
+		code   int
+		answer string
+	}{
+		{
+			name:   "default tenant",
+			target: "/update/",
+			body:   `{"id":"c1","type":"counter","delta":1}`,
+			code:   200,
+		},
+		{
+			name:   "other tenant",
+			tenant: "team-a",
+			target: "/update/",
+			body:   `{"id":"c1","type":"counter","delta":5}`,
+			code:   200,
+			answer: `{"id":"c1","type":"counter","delta":5}`,
+		},
+		{
+			name:   "isolated from default",
+			target: "/value/",
+			body:   `{"id":"c1","type":"counter"}`,
+			code:   200,
+			answer: `{"id":"c1","type":"counter","delta":1}`,
+		},
+		{
+			name:   "absent in another tenant",
+			tenant: "team-b",
+			target: "/value/",
+			body:   `{"id":"c1","type":"counter"}`,
+			code:   404,
+		},
+		{
+			name:   "limit exceeded",
+			tenant: "team-a",
+			target: "/update/",
+			body:   `{"id":"c2","type":"counter","delta":1}`,
+			code:   403,
+		},
+		{
+			name:   "existing metric within limit",
+			tenant: "team-a",
+			target: "/update/",
+			body:   `{"id":"c1","type":"counter","delta":1}`,
+			code:   200,
+			answer: `{"id":"c1","type":"counter","delta":6}`,
+		},
+		{
+			name:   "second tenant",
+			tenant: "team-c",
+			target: "/update/",
+			body:   `{"id":"c1","type":"counter","delta":1}`,
+			code:   200,
+		},
+		{
+			name:   "too many tenants",
+			tenant: "team-d",
+			target: "/update/",
+			body:   `{"id":"c1","type":"counter","delta":1}`,
+			code:   403,
+			answer: `{"code":403,"message":"tenant limit is exceeded: 2 tenants"}`,
+		},
+		{
+			name:   "bad tenant",
+			tenant: "../etc",
+			target: "/value/",
+			body:   `{"id":"c1","type":"counter"}`,
+			code:   400,
+			answer: `{"code":400,"message":"tenant contains '.', allowed are letters, digits, _ and -","field":"tenant"}`,
+		},
+	}
+	for _, s := range steps {
+		request := httptest.NewRequest(http.MethodPost, s.target, strings.NewReader(s.body))
+		if s.tenant != "" {
+			request.Header.Set(TenantHeader, s.tenant)
+		}
+		w := httptest.NewRecorder()
+
+		r.ServeHTTP(w, request)
+
+		assert.Equal(t, s.code, w.Code, s.name)
+		if s.answer != "" {
+			assert.JSONEq(t, s.answer, w.Body.String(), s.name)
+		}
+	}
+
+	tenants, err := db.Tenants()
+	require.NoError(t, err)
+	assert.Equal(t, []string{usecase.DefaultTenant, "team-a", "team-c"}, tenants, "reads must not make tenants")
+}
+
+func Test_RateLimit(t *testing.T) {
+	app := newTestApp(memory.NewMemStorage())
+	app.Limits = ratelimit.New(0.5, 2)
+	r := chi.NewRouter()
+	r.Use(RateLimit(app))
+	r.Get(`/values/`, GetAllParamsJSON(app))
+
+	steps := []struct {
+		name       string
+		remoteAddr string
+		code       int
+		retryAfter string
+	}{
+		{name: "first", remoteAddr: "192.0.2.1:40000", code: 200},
+		{name: "burst", remoteAddr: "192.0.2.1:40001", code: 200},
+		{name: "limited, any port", remoteAddr: "192.0.2.1:40002", code: 429, retryAfter: "2"},
+		{name: "other client", remoteAddr: "192.0.2.2:40000", code: 200},
+	}
+	for _, s := range steps {
+		request := httptest.NewRequest(http.MethodGet, "/values/", nil)
+		request.RemoteAddr = s.remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		res := w.Result()
+		res.Body.Close()
+
+		assert.Equal(t, s.code, res.StatusCode, s.name)
+		assert.Equal(t, s.retryAfter, res.Header.Get("Retry-After"), s.name)
+	}
+}
+
+func Test_WriteInflux(t *testing.T) {
+	db := memory.NewMemStorage()
+	db.Limit = 4
+	app := newTestApp(db)
+	rules := []mapping.Rule{{Match: `^net\..*\.errors$`, Type: "counter"}}
+	require.NoError(t, mapping.Compile(rules))
+	app.Influx = &influx.Mapper{Rules: rules, Tags: []string{"host"}}
+
+	steps := []struct {
+		name string
+		body string
+		code int
+		want map[string]string
+	}{
+		{
+			name: "gauges and counter",
+			body: "cpu,host=web1,cpu=total usage_idle=97.5,usage_user=1.25 1760870400000000000\n" +
+				"net,host=web1 errors=3i,iface=\"eth0\"\n",
+			code: 204,
+			want: map[string]string{"cpu.web1.usage_idle": "97.5", "cpu.web1.usage_user": "1.25", "net.web1.errors": "3"},
+		},
+		{
+			name: "counter is added",
+			body: "net,host=web1 errors=2i",
+			code: 204,
+			want: map[string]string{"net.web1.errors": "5"},
+		},
+		{
+			name: "bad line writes nothing",
+			body: "cpu,host=web1 usage_idle=50\ncpu,host=web1 usage_idle\n",
+			code: 400,
+			want: map[string]string{"cpu.web1.usage_idle": "97.5"},
+		},
+		{
+			name: "fractional counter",
+			body: "net,host=web1 errors=1.5",
+			code: 400,
+			want: map[string]string{"net.web1.errors": "5"},
+		},
+		{
+			name: "limit exceeded writes nothing",
+			body: "cpu,host=web1 usage_idle=10\nmem,host=web1 used=1,free=2",
+			code: 403,
+			want: map[string]string{"cpu.web1.usage_idle": "97.5"},
+		},
+	}
+	for _, s := range steps {
+		request := httptest.NewRequest(http.MethodPost, "/write?db=telegraf", strings.NewReader(s.body))
+		w := httptest.NewRecorder()
+
+		WriteInflux(app)(w, request)
+
+		assert.Equal(t, s.code, w.Code, s.name)
+		for id, value := range s.want {
+			metric := &usecase.Metric{ID: id, MType: "gauge"}
+			if strings.HasSuffix(id, "errors") {
+				metric.MType = "counter"
+			}
+			got, err := db.Get(metric)
+			require.NoError(t, err, s.name)
+			if got.Delta != nil {
+				assert.Equal(t, value, strconv.FormatInt(*got.Delta, 10), s.name)
+			} else {
+				assert.Equal(t, value, strconv.FormatFloat(*got.Value, 'f', -1, 64), s.name)
+			}
+		}
+	}
+}
+
+func Test_WriteInfluxTooLarge(t *testing.T) {
+	app := newTestApp(memory.NewMemStorage())
+	body := strings.Repeat("cpu usage_idle=97.5\n", MaxWriteBody/20+1)
+	request := httptest.NewRequest(http.MethodPost, "/write", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	WriteInflux(app)(w, request)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func Test_ReceiveOTLP(t *testing.T) {
+	db := memory.NewMemStorage()
+	app := newTestApp(db)
+	app.OTLP = otlp.NewReceiver([]string{"service.name"})
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+		wantType    string
+		answer      string
+	}{
+		{
+			name:        "json",
+			contentType: "application/json",
+			body: `{"resourceMetrics": [{"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "checkout"}}]},
+				"scopeMetrics": [{"metrics": [
+					{"name": "queue.size", "gauge": {"dataPoints": [{"asDouble": 12.5}]}},
+					{"name": "orders", "sum": {"aggregationTemporality": 1, "isMonotonic": true, "dataPoints": [{"asInt": "3"}]}}
+				]}]}]}`,
+			code:     200,
+			wantType: "application/json; charset=utf-8",
+			answer:   `{}`,
+		},
+		{
+			name:        "partial success",
+			contentType: "application/json",
+			body:        `{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": "rpc.latency", "summary": {"dataPoints": [{}]}}]}]}]}`,
+			code:        200,
+			wantType:    "application/json; charset=utf-8",
+			answer:      `{"partialSuccess": {"rejectedDataPoints": "1", "errorMessage": "rpc.latency: exponential histograms and summaries are not supported"}}`,
+		},
+		{
+			name:        "bad json",
+			contentType: "application/json",
+			body:        `{"resourceMetrics": {}}`,
+			code:        400,
+			wantType:    "application/json; charset=utf-8",
+		},
+		{
+			name:        "empty protobuf",
+			contentType: "application/x-protobuf",
+			code:        200,
+			wantType:    "application/x-protobuf",
+		},
+		{
+			name:        "truncated protobuf",
+			contentType: "application/x-protobuf",
+			body:        "\x0a\x05",
+			code:        400,
+			wantType:    "application/x-protobuf",
+		},
+		{
+			name:        "unsupported content type",
+			contentType: "text/plain",
+			body:        "orders 1",
+			code:        415,
+			wantType:    "application/json; charset=utf-8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(tt.body))
+			request.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+
+			ReceiveOTLP(app)(w, request)
+
+			assert.Equal(t, tt.code, w.Code)
+			assert.Equal(t, tt.wantType, w.Header().Get("Content-Type"))
+			if tt.answer != "" {
+				assert.JSONEq(t, tt.answer, w.Body.String())
+			}
+		})
+	}
+
+	m, err := db.Get(&usecase.Metric{ID: "queue.size.checkout", MType: "gauge"})
+	require.NoError(t, err)
+	assert.Equal(t, 12.5, *m.Value)
+	m, err = db.Get(&usecase.Metric{ID: "orders.checkout", MType: "counter"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *m.Delta)
+}
+
+func Test_ReceiveOTLPWithoutReceiver(t *testing.T) {
+	db := memory.NewMemStorage()
+	app := newTestApp(db)
+
+	request := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(
+		`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": "queue size", "gauge": {"dataPoints": [{"asDouble": 4}]}}]}]}]}`))
+	request.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ReceiveOTLP(app)(w, request)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	m, err := db.Get(&usecase.Metric{ID: "queue_size", MType: "gauge"})
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, *m.Value)
+}
@@ -2,9 +2,16 @@ package handlers
 
 import (
 	"compress/gzip"
+	gocontext "context"
+	"errors"
 	"io"
+	"math"
+	"metrics-server/internal/auth"
+	"metrics-server/internal/usecase"
 	"metrics-server/internal/usecase/context"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -67,17 +74,27 @@ func Logger(app *context.AppContext) func(next http.Handler) http.Handler {
 				"status", responseData.status,
 				"duration", duration,
 				"size", responseData.size,
+				"client", ClientIdentity(r),
 			)
 		})
 	}
 }
 
+// ClientIdentity returns the CN of the verified client certificate, the
+// identity of the agent under mutual TLS, or an empty string without one.
+func ClientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
 func CheckContentType(app *context.AppContext) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 			if r.Header.Get("Content-Type") != "application/json" {
-				http.Error(w, "Invalid Content-Type, expected application/json", http.StatusUnsupportedMediaType)
+				writeError(w, http.StatusUnsupportedMediaType, "", "invalid Content-Type, expected application/json")
 				app.Log.Errorln("Invalid Content-Type ", r.Header.Get("Content-Type"))
 				return
 			}
@@ -93,7 +110,7 @@ func GzipHandler(app *context.AppContext) func(next http.Handler) http.Handler {
 			if r.Header.Get("Content-Encoding") == "gzip" {
 				gzr, err := gzip.NewReader(r.Body)
 				if err != nil {
-					http.Error(w, "Bad Request: Invalid gzip data", http.StatusBadRequest)
+					writeError(w, http.StatusBadRequest, "", "invalid gzip data")
 					app.Log.Errorln("Bad Request: Invalid gzip data")
 					return
 				}
@@ -109,7 +126,7 @@ func GzipHandler(app *context.AppContext) func(next http.Handler) http.Handler {
 
 			gzw, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
 			if err != nil {
-				io.WriteString(w, err.Error())
+				writeError(w, http.StatusInternalServerError, "", err.Error())
 				return
 			}
 			defer gzw.Close()
@@ -120,3 +137,178 @@ func GzipHandler(app *context.AppContext) func(next http.Handler) http.Handler {
 		})
 	}
 }
+
+// TenantHeader selects the tenant of a request, requests without it belong
+// to the default tenant.
+const TenantHeader = "X-Tenant-ID"
+
+type tenantKey struct{}
+
+// Tenant puts the tenant of the request in its context. An API key binds
+// the request to the tenant of the key.
+func Tenant(app *context.AppContext) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(TenantHeader)
+			if key := requestKey(r); key != nil {
+				if id != "" && id != key.Tenant {
+					writeError(w, http.StatusForbidden, "tenant", "the key does not belong to tenant "+id)
+					app.Log.Errorln("Key", key.ID, "is used for tenant", id)
+					return
+				}
+				id = key.Tenant
+			}
+			if id == "" {
+				id = usecase.DefaultTenant
+			}
+
+			if err := usecase.ValidateTenant(id); err != nil {
+				writeAPIError(w, err)
+				app.Log.Errorln("Bad tenant:", err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(gocontext.WithValue(r.Context(), tenantKey{}, id)))
+		})
+	}
+}
+
+func tenantID(req *http.Request) string {
+	if id, ok := req.Context().Value(tenantKey{}).(string); ok {
+		return id
+	}
+	return usecase.DefaultTenant
+}
+
+// tenantDB returns the storage of the request tenant.
+func tenantDB(app *context.AppContext, req *http.Request) usecase.Repositories {
+	return app.DB.Tenant(tenantID(req))
+}
+
+type keyKey struct{}
+
+// Authenticate puts the API key of a bearer token in the request context.
+// Requests without a token pass on, RequireScope rejects them where a key is
+// needed.
+func Authenticate(app *context.AppContext) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if app.Keys == nil || header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				writeUnauthorized(w, "bearer token expected")
+				return
+			}
+
+			key, err := app.Keys.Lookup(auth.Hash(token))
+			if errors.Is(err, auth.ErrKeyNotFound) {
+				writeUnauthorized(w, "invalid token")
+				app.Log.Errorln("Invalid token from", r.RemoteAddr)
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "", "cannot check token")
+				app.Log.Errorln("Cannot check token:", err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(gocontext.WithValue(r.Context(), keyKey{}, key)))
+		})
+	}
+}
+
+// RequireScope lets through requests with a key granting the scope, or all
+// requests when authentication is disabled.
+func RequireScope(app *context.AppContext, scope string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if app.Keys == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := requestKey(r)
+			if key == nil {
+				writeUnauthorized(w, "API key required")
+				return
+			}
+			if !key.Allows(scope) {
+				writeError(w, http.StatusForbidden, "", "the key has no "+scope+" scope")
+				app.Log.Errorln("Key", key.ID, "has no", scope, "scope")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func requestKey(req *http.Request) *auth.Key {
+	key, _ := req.Context().Value(keyKey{}).(*auth.Key)
+	return key
+}
+
+func writeUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+	writeError(w, http.StatusUnauthorized, "", message)
+}
+
+// RateLimit answers 429 with Retry-After to clients sending requests faster
+// than the limiter allows, a client is told by its certificate or its
+// address. It comes before Authenticate, so that requests with bad tokens
+// are limited before their lookup.
+func RateLimit(app *context.AppContext) func(next http.Handler) http.Handler {
+	return limitRate(app, func(r *http.Request) string {
+		if id := ClientIdentity(r); id != "" {
+			return "cert:" + id
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		return "ip:" + host
+	})
+}
+
+// KeyRateLimit limits the requests of every API key like RateLimit, it
+// comes after Authenticate. Requests without a key pass on.
+func KeyRateLimit(app *context.AppContext) func(next http.Handler) http.Handler {
+	return limitRate(app, func(r *http.Request) string {
+		if key := requestKey(r); key != nil {
+			return "key:" + key.ID
+		}
+		return ""
+	})
+}
+
+// limitRate limits the requests of the client named by client, an empty
+// name is not limited.
+func limitRate(app *context.AppContext, client func(r *http.Request) string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := ""
+			if app.Limits != nil {
+				name = client(r)
+			}
+			if name == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ok, wait := app.Limits.Allow(name, time.Now())
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, http.StatusTooManyRequests, "", "too many requests")
+				app.Log.Errorln("Rate limit of", name, "is exceeded")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
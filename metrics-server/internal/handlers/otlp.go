@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"fmt"
+	"metrics-server/internal/otlp"
+	"metrics-server/internal/usecase/context"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// Content types of the OTLP/HTTP encodings.
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+)
+
+// ReceiveOTLP takes metrics exported by OpenTelemetry SDKs over OTLP/HTTP in
+// the protobuf or the JSON encoding, and answers in the encoding of the
+// request. Data points which cannot be applied are reported as a partial
+// success.
+func ReceiveOTLP(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		protobuf := contentType == contentTypeProtobuf
+		if !protobuf && contentType != contentTypeJSON {
+			writeError(res, http.StatusUnsupportedMediaType, "", fmt.Sprintf("%s or %s expected", contentTypeProtobuf, contentTypeJSON))
+			app.Log.Errorln("Unsupported OTLP content type:", contentType)
+			return
+		}
+
+		fail := func(code int, message string) {
+			if !protobuf {
+				writeError(res, code, "", message)
+				return
+			}
+			status := otlp.StatusInvalidArgument
+			if code >= http.StatusInternalServerError {
+				status = otlp.StatusInternal
+			}
+			res.Header().Set("Content-Type", contentTypeProtobuf)
+			res.WriteHeader(code)
+			res.Write(otlp.EncodeStatusProto(status, message))
+		}
+
+		body, code, err := readBody(res, req)
+		if err != nil {
+			fail(code, err.Error())
+			app.Log.Errorln("Cannot read OTLP request:", err)
+			return
+		}
+
+		var export *otlp.ExportRequest
+		if protobuf {
+			export, err = otlp.DecodeProto(body)
+		} else {
+			export, err = otlp.DecodeJSON(body)
+		}
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			app.Log.Errorln("Cannot decode OTLP request:", err)
+			return
+		}
+
+		receiver := app.OTLP
+		if receiver == nil {
+			// without the streams of earlier requests a cumulative sum only
+			// sets its baseline
+			receiver = otlp.NewReceiver(nil)
+		}
+		result, err := receiver.Write(tenantDB(app, req), tenantID(req), export, time.Now())
+		if err != nil {
+			fail(http.StatusInternalServerError, "cannot set metrics")
+			app.Log.Errorln("Cannot set metrics:", err)
+			return
+		}
+		if result.Rejected > 0 {
+			app.Log.Errorln("OTLP data points rejected:", result.Rejected, ", first:", result.Message)
+		}
+
+		if result.Accepted > 0 {
+			if err := syncDump(app, req); err != nil {
+				fail(http.StatusInternalServerError, errDump.Error())
+				app.Log.Errorln("Dump error:", err)
+				return
+			}
+		}
+
+		if protobuf {
+			res.Header().Set("Content-Type", contentTypeProtobuf)
+			res.WriteHeader(http.StatusOK)
+			res.Write(otlp.EncodeResponseProto(result.Rejected, result.Message))
+			return
+		}
+		var resp otlp.ExportResponse
+		if result.Rejected > 0 {
+			resp.PartialSuccess = &otlp.PartialSuccess{RejectedDataPoints: result.Rejected, ErrorMessage: result.Message}
+		}
+		writeJSON(app, res, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"metrics-server/internal/usecase"
+	"metrics-server/internal/usecase/context"
+	"net/http"
+)
+
+// writeJSON answers with v encoded as JSON.
+func writeJSON(app *context.AppContext, res http.ResponseWriter, code int, v any) {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		writeError(res, http.StatusInternalServerError, "", "error in marshaller")
+		app.Log.Errorln("Error in marshaller:", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.WriteHeader(code)
+	fmt.Fprintf(res, "%s", jsonData)
+}
+
+// apiError is the body of every error answer.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+func writeError(res http.ResponseWriter, code int, field, message string) {
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(code)
+	json.NewEncoder(res).Encode(apiError{Code: code, Message: message, Field: field})
+}
+
+// newAPIError describes an error of the validation or the storage.
+func newAPIError(err error) *apiError {
+	var ve *usecase.ValidationError
+	if errors.As(err, &ve) {
+		return &apiError{Code: http.StatusBadRequest, Message: ve.Message, Field: ve.Field}
+	}
+	return &apiError{Code: errorCode(err), Message: err.Error()}
+}
+
+func writeAPIError(res http.ResponseWriter, err error) {
+	e := newAPIError(err)
+	writeError(res, e.Code, e.Field, e.Message)
+}
+
+// errorCode maps storage errors to HTTP status codes.
+func errorCode(err error) int {
+	switch {
+	case errors.Is(err, usecase.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, usecase.ErrTypeMismatch),
+		errors.Is(err, usecase.ErrUnsupportedType),
+		errors.Is(err, usecase.ErrNoValue):
+		return http.StatusBadRequest
+	case errors.Is(err, usecase.ErrLimitExceeded),
+		errors.Is(err, usecase.ErrTooManyTenants):
+		return http.StatusForbidden
+	case errors.Is(err, usecase.ErrAborted):
+		return http.StatusFailedDependency
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// decodeJSON decodes a request body rejecting unknown fields.
+func decodeJSON(req *http.Request, v any) error {
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
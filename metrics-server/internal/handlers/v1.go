@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"metrics-server/internal/usecase"
+	"metrics-server/internal/usecase/context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Handlers of the /api/v1/metrics resource. A metric is addressed by
+// /api/v1/metrics/{mtype}/{name}, the legacy routes are adapters over the
+// same logic.
+
+var errDump = errors.New("dump failed")
+
+// setMetric validates and applies an update: a gauge is set, a counter is
+// added to.
+func setMetric(app *context.AppContext, req *http.Request, metric *usecase.Metric) (*usecase.Metric, error) {
+	return storeMetric(app, req, metric, tenantDB(app, req).Set)
+}
+
+// updateMetric applies an update like setMetric to an existing metric,
+// ErrNotFound otherwise.
+func updateMetric(app *context.AppContext, req *http.Request, metric *usecase.Metric) (*usecase.Metric, error) {
+	return storeMetric(app, req, metric, tenantDB(app, req).Update)
+}
+
+func storeMetric(app *context.AppContext, req *http.Request, metric *usecase.Metric,
+	store func(*usecase.Metric) (*usecase.Metric, error)) (*usecase.Metric, error) {
+	if err := usecase.Validate(metric); err != nil {
+		return nil, err
+	}
+
+	result, err := store(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syncDump(app, req); err != nil {
+		app.Log.Errorln("Dump error:", err)
+		return nil, errDump
+	}
+	return result, nil
+}
+
+// metricKey reads the metric address from the URL.
+func metricKey(req *http.Request) (usecase.Metric, error) {
+	metric := usecase.Metric{
+		ID:    chi.URLParam(req, "name"),
+		MType: chi.URLParam(req, "mtype"),
+	}
+	return metric, usecase.ValidateKey(&metric)
+}
+
+// metricBody reads the value of the metric addressed by the URL, id and
+// type may be repeated in the body but must match the URL.
+func metricBody(req *http.Request, key usecase.Metric) (usecase.Metric, error) {
+	var metric usecase.Metric
+	if err := decodeJSON(req, &metric); err != nil {
+		return metric, err
+	}
+
+	if metric.ID != "" && metric.ID != key.ID {
+		return metric, &usecase.ValidationError{Field: "id", Message: "id does not match the URL"}
+	}
+	if metric.MType != "" && metric.MType != key.MType {
+		return metric, &usecase.ValidationError{Field: "type", Message: "type does not match the URL"}
+	}
+	metric.ID = key.ID
+	metric.MType = key.MType
+	return metric, nil
+}
+
+func metricLocation(m *usecase.Metric) string {
+	return fmt.Sprintf("/api/v1/metrics/%s/%s", m.MType, m.ID)
+}
+
+// PostMetrics answers POST /api/v1/metrics/ with a batch, atomic unless
+// mode=best-effort is asked for: see setBatch.
+func PostMetrics(app *context.AppContext) http.HandlerFunc {
+	return setBatch(app, BatchAtomic)
+}
+
+// GetMetric answers GET /api/v1/metrics/{mtype}/{name}.
+func GetMetric(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key, err := metricKey(req)
+		if err != nil {
+			writeAPIError(res, err)
+			return
+		}
+
+		result, err := tenantDB(app, req).Get(&key)
+		if err != nil {
+			writeAPIError(res, err)
+			app.Log.Errorln("Cannot get metric:", err)
+			return
+		}
+
+		writeJSON(app, res, http.StatusOK, result)
+	}
+}
+
+// PutMetric answers PUT /api/v1/metrics/{mtype}/{name}, the metric is
+// stored as given: 201 if it is new, 200 if it is replaced.
+func PutMetric(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key, err := metricKey(req)
+		if err != nil {
+			writeAPIError(res, err)
+			return
+		}
+
+		metric, err := metricBody(req, key)
+		if err == nil {
+			err = usecase.Validate(&metric)
+		}
+		if err != nil {
+			writeError(res, http.StatusBadRequest, validationField(err), err.Error())
+			app.Log.Errorln("Invalid metric:", err)
+			return
+		}
+
+		result, created, err := tenantDB(app, req).Replace(&metric)
+		if err != nil {
+			writeAPIError(res, err)
+			app.Log.Errorln("Cannot replace metric:", err)
+			return
+		}
+
+		if err = syncDump(app, req); err != nil {
+			writeError(res, http.StatusInternalServerError, "", errDump.Error())
+			app.Log.Errorln("Dump error:", err)
+			return
+		}
+
+		if created {
+			res.Header().Set("Location", metricLocation(result))
+			writeJSON(app, res, http.StatusCreated, result)
+			return
+		}
+		writeJSON(app, res, http.StatusOK, result)
+	}
+}
+
+// PatchMetric answers PATCH /api/v1/metrics/{mtype}/{name}, it updates an
+// existing metric the way the legacy routes do: a gauge is set, a counter
+// is added to.
+func PatchMetric(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key, err := metricKey(req)
+		if err != nil {
+			writeAPIError(res, err)
+			return
+		}
+
+		metric, err := metricBody(req, key)
+		if err != nil {
+			writeError(res, http.StatusBadRequest, validationField(err), err.Error())
+			app.Log.Errorln("Invalid metric:", err)
+			return
+		}
+
+		result, err := updateMetric(app, req, &metric)
+		if err != nil {
+			writeAPIError(res, err)
+			app.Log.Errorln("Cannot update metric:", err)
+			return
+		}
+
+		writeJSON(app, res, http.StatusOK, result)
+	}
+}
+
+// DeleteMetric answers DELETE /api/v1/metrics/{mtype}/{name} with 204.
+func DeleteMetric(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key, err := metricKey(req)
+		if err != nil {
+			writeAPIError(res, err)
+			return
+		}
+
+		if err := tenantDB(app, req).Delete(&key); err != nil {
+			writeAPIError(res, err)
+			app.Log.Errorln("Cannot delete metric:", err)
+			return
+		}
+
+		if err = syncDump(app, req); err != nil {
+			writeError(res, http.StatusInternalServerError, "", errDump.Error())
+			app.Log.Errorln("Dump error:", err)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func validationField(err error) string {
+	var verr *usecase.ValidationError
+	if errors.As(err, &verr) {
+		return verr.Field
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"metrics-server/internal/influx"
+	"metrics-server/internal/usecase"
+	"metrics-server/internal/usecase/context"
+	"net/http"
+	"time"
+)
+
+// MaxWriteBody is the size limit of a decompressed body of the line protocol
+// and OTLP writes.
+const MaxWriteBody = 8 << 20
+
+// readBody reads a write body up to MaxWriteBody, the code tells the answer
+// to an error.
+func readBody(res http.ResponseWriter, req *http.Request) ([]byte, int, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, MaxWriteBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, errors.New("request body is too large")
+		}
+		return nil, http.StatusBadRequest, errors.New("cannot read request body")
+	}
+	return body, 0, nil
+}
+
+// WriteInflux takes metrics in the InfluxDB line protocol, like the /write
+// endpoint of InfluxDB 1.x, so Telegraf can send to the server. The query
+// parameters of InfluxDB (db, precision, ...) are ignored. A request is
+// applied atomically: nothing is written if a line or a metric is invalid.
+func WriteInflux(app *context.AppContext) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		body, code, err := readBody(res, req)
+		if err != nil {
+			writeError(res, code, "", err.Error())
+			app.Log.Errorln("Cannot read line protocol:", err)
+			return
+		}
+
+		points, err := influx.Parse(body)
+		if err != nil {
+			writeError(res, http.StatusBadRequest, "", err.Error())
+			app.Log.Errorln("Cannot parse line protocol:", err)
+			return
+		}
+
+		mapper := app.Influx
+		if mapper == nil {
+			mapper = &influx.Mapper{}
+		}
+		metrics, items, err := mapper.Write(tenantDB(app, req), tenantID(req), points, time.Now())
+		var ve *usecase.ValidationError
+		if errors.As(err, &ve) {
+			writeAPIError(res, err)
+			app.Log.Errorln("Invalid line protocol:", err)
+			return
+		}
+		if err != nil {
+			writeError(res, http.StatusInternalServerError, "", "cannot set metrics")
+			app.Log.Errorln("Cannot set metrics:", err)
+			return
+		}
+		for k, item := range items {
+			// the other items of an aborted batch fail with ErrAborted
+			if item.Err != nil && !errors.Is(item.Err, usecase.ErrAborted) {
+				writeAPIError(res, item.Err)
+				app.Log.Errorln("Cannot set metric", metrics[k].ID, ":", item.Err)
+				return
+			}
+		}
+
+		if len(items) > 0 {
+			if err := syncDump(app, req); err != nil {
+				writeError(res, http.StatusInternalServerError, "", errDump.Error())
+				app.Log.Errorln("Dump error:", err)
+				return
+			}
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
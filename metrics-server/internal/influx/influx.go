@@ -0,0 +1,384 @@
+// Package influx reads the InfluxDB line protocol and maps its fields to
+// metrics:
+//
+//	<measurement>[,<tag>=<value>...] <field>=<value>[,<field>=<value>...] [<timestamp>]
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"metrics-server/internal/mapping"
+	"metrics-server/internal/usecase"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StaleAfter is how long the total of a cumulative field is kept without
+// points.
+const StaleAfter = time.Hour
+
+// Point is a line of the protocol.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []Field
+	Timestamp   *int64
+}
+
+// Field has a value of float64, int64, uint64, bool or string.
+type Field struct {
+	Key   string
+	Value any
+}
+
+// ParseError tells the line which could not be parsed.
+type ParseError struct {
+	Line    int
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// Parse reads the lines of data, empty lines and comments are skipped.
+func Parse(data []byte) ([]Point, error) {
+	var points []Point
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		p, err := parseLine(string(line))
+		if err != nil {
+			return nil, &ParseError{Line: n + 1, Message: err.Error()}
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+func parseLine(line string) (Point, error) {
+	var p Point
+
+	key, rest, err := cut(line, ' ', false)
+	if err != nil {
+		return p, err
+	}
+	// the timestamp is optional
+	parts, err := splitN(rest, ' ', true, 2)
+	if err != nil {
+		return p, err
+	}
+	fields, timestamp := parts[0], ""
+	if len(parts) == 2 {
+		timestamp = parts[1]
+	}
+	if fields == "" {
+		return p, fmt.Errorf("no fields")
+	}
+
+	parts, err = split(key, ',', false)
+	if err != nil {
+		return p, err
+	}
+	p.Measurement = unescape(parts[0])
+	if p.Measurement == "" {
+		return p, fmt.Errorf("no measurement")
+	}
+	for _, tag := range parts[1:] {
+		k, v, err := cut(tag, '=', false)
+		if err != nil {
+			return p, err
+		}
+		if k == "" || v == "" {
+			return p, fmt.Errorf("bad tag %q", tag)
+		}
+		if p.Tags == nil {
+			p.Tags = make(map[string]string)
+		}
+		p.Tags[unescape(k)] = unescape(v)
+	}
+
+	parts, err = split(fields, ',', true)
+	if err != nil {
+		return p, err
+	}
+	for _, field := range parts {
+		k, v, err := cut(field, '=', true)
+		if err != nil {
+			return p, err
+		}
+		if k == "" {
+			return p, fmt.Errorf("bad field %q", field)
+		}
+		value, err := parseValue(v)
+		if err != nil {
+			return p, fmt.Errorf("field %s: %v", unescape(k), err)
+		}
+		p.Fields = append(p.Fields, Field{Key: unescape(k), Value: value})
+	}
+
+	if timestamp = strings.TrimSpace(timestamp); timestamp != "" {
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("bad timestamp %q", timestamp)
+		}
+		p.Timestamp = &ts
+	}
+	return p, nil
+}
+
+func parseValue(v string) (any, error) {
+	switch {
+	case v == "":
+		return nil, fmt.Errorf("no value")
+	case v[0] == '"':
+		if len(v) < 2 || v[len(v)-1] != '"' {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		s := v[1 : len(v)-1]
+		s = strings.ReplaceAll(s, `\"`, `"`)
+		return strings.ReplaceAll(s, `\\`, `\`), nil
+	case strings.HasSuffix(v, "i"):
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad integer %q", v)
+		}
+		return i, nil
+	case strings.HasSuffix(v, "u"):
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad unsigned integer %q", v)
+		}
+		return u, nil
+	}
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("bad value %q", v)
+	}
+	return f, nil
+}
+
+// cut splits s at the first sep which is not escaped, nor quoted if quotes
+// are taken into account.
+func cut(s string, sep byte, quotes bool) (string, string, error) {
+	parts, err := splitN(s, sep, quotes, 2)
+	if err != nil {
+		return "", "", err
+	}
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("%q expected in %q", sep, s)
+	}
+	return parts[0], parts[1], nil
+}
+
+func split(s string, sep byte, quotes bool) ([]string, error) {
+	return splitN(s, sep, quotes, -1)
+}
+
+func splitN(s string, sep byte, quotes bool, n int) ([]string, error) {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted && (n < 0 || len(parts) < n-1):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated string")
+	}
+	return append(parts, s[start:]), nil
+}
+
+// unescape drops the backslashes of escaped commas, equal signs and spaces.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	r := strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ")
+	return r.Replace(s)
+}
+
+// Mapper makes metrics of the fields of points. The ID of a metric is the
+// measurement, the values of the tags of Tags which the point has and the
+// field key, joined with dots, like cpu.web1.usage_idle for the tag host.
+// Rules match the IDs to turn them into counters, or rename them.
+// Characters the server does not take become _.
+type Mapper struct {
+	Rules []mapping.Rule
+	Tags  []string
+
+	mu     sync.Mutex
+	totals map[string]total // of the cumulative fields, by tenant and ID
+	swept  time.Time
+}
+
+// total is the last value of a cumulative field.
+type total struct {
+	value int64
+	seen  time.Time
+}
+
+// Write maps points to metrics and stores them in db, the storage of
+// tenant, atomically. The fields of cumulative rules are running totals,
+// like the bytes_recv of Telegraf: their counters get the increase since
+// the previous total of the field, the first total only sets the baseline
+// and a total which drops counts from zero, as after a restart of the
+// sender. The totals are kept once the batch is stored; requests are
+// applied one at a time so they see the totals in order.
+//
+// The error is a *usecase.ValidationError for a point which cannot be
+// stored, a failure of the storage otherwise. The items tell the outcome of
+// the metrics.
+func (m *Mapper) Write(db usecase.Repositories, tenant string, points []Point, now time.Time) ([]usecase.Metric, []usecase.BatchItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep(now)
+
+	metrics, cumulative, err := m.metrics(points)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// a field with several points in the request sees its earlier ones
+	pending := make(map[string]int64)
+	for i := range metrics {
+		if !cumulative[i] {
+			continue
+		}
+		value := *metrics[i].Delta
+		if value < 0 {
+			return nil, nil, &usecase.ValidationError{Field: "value", Message: fmt.Sprintf("cumulative counter %s is negative", metrics[i].ID)}
+		}
+		key := tenant + "\x00" + metrics[i].ID
+		prev, ok := pending[key]
+		if !ok {
+			var t total
+			t, ok = m.totals[key]
+			prev = t.value
+		}
+
+		var delta int64
+		switch {
+		case !ok:
+			// the baseline, the total before is not known
+		case value < prev:
+			delta = value
+		default:
+			delta = value - prev
+		}
+		pending[key] = value
+		metrics[i].Delta = &delta
+	}
+
+	for i := range metrics {
+		if err := usecase.Validate(&metrics[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(metrics) == 0 {
+		return nil, nil, nil
+	}
+
+	items, err := db.SetBatch(metrics, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, item := range items {
+		if item.Err != nil {
+			return metrics, items, nil
+		}
+	}
+	if m.totals == nil {
+		m.totals = make(map[string]total)
+	}
+	for key, value := range pending {
+		m.totals[key] = total{value: value, seen: now}
+	}
+	return metrics, items, nil
+}
+
+// sweep drops the totals which have not had points for StaleAfter, once a
+// minute, m.mu must be held.
+func (m *Mapper) sweep(now time.Time) {
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+	m.swept = now
+	for key, t := range m.totals {
+		if now.Sub(t.seen) > StaleAfter {
+			delete(m.totals, key)
+		}
+	}
+}
+
+// metrics returns the metrics of the numeric and boolean fields, strings
+// are skipped, and which of them are cumulative. A counter needs a whole
+// value, the total of a cumulative one is in Delta.
+func (m *Mapper) metrics(points []Point) ([]usecase.Metric, []bool, error) {
+	var result []usecase.Metric
+	var cumulative []bool
+	for _, p := range points {
+		prefix := []string{p.Measurement}
+		for _, tag := range m.Tags {
+			if v, ok := p.Tags[tag]; ok {
+				prefix = append(prefix, v)
+			}
+		}
+
+		for _, f := range p.Fields {
+			value, ok := number(f.Value)
+			if !ok {
+				continue
+			}
+			name := usecase.SanitizeID(strings.Join(append(prefix, f.Key), "."))
+			id, rule := mapping.Match(m.Rules, name)
+
+			metric := usecase.NewGauge(id, value)
+			if rule != nil && rule.Type == "counter" {
+				if value != math.Trunc(value) || math.Abs(value) > 1<<53 {
+					return nil, nil, &usecase.ValidationError{Field: "value", Message: fmt.Sprintf("counter %s needs a whole value, got %v", id, value)}
+				}
+				metric = usecase.NewCounter(id, int64(value))
+			}
+			result = append(result, metric)
+			cumulative = append(cumulative, rule != nil && rule.Cumulative)
+		}
+	}
+	return result, cumulative, nil
+}
+
+func number(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,168 @@
+package influx
+
+import (
+	"metrics-server/internal/mapping"
+	"metrics-server/internal/storage/memory"
+	"metrics-server/internal/usecase"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Parse(t *testing.T) {
+	ts := int64(1760870400000000000)
+	tests := []struct {
+		name    string
+		data    string
+		want    []Point
+		wantErr string
+	}{
+		{
+			name: "full line",
+			data: `cpu,host=web1,cpu=total usage_idle=97.5,count=3i,total=4u,up=t,state="ok" 1760870400000000000`,
+			want: []Point{{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "web1", "cpu": "total"},
+				Fields: []Field{
+					{Key: "usage_idle", Value: 97.5},
+					{Key: "count", Value: int64(3)},
+					{Key: "total", Value: uint64(4)},
+					{Key: "up", Value: true},
+					{Key: "state", Value: "ok"},
+				},
+				Timestamp: &ts,
+			}},
+		},
+		{
+			name: "no tags nor timestamp",
+			data: "mem used=1e3",
+			want: []Point{{Measurement: "mem", Fields: []Field{{Key: "used", Value: 1000.0}}}},
+		},
+		{
+			name: "escapes and quoted spaces",
+			data: `disk\ io,path=C:\,D: note="a, b=c \"d\"",free=1`,
+			want: []Point{{
+				Measurement: "disk io",
+				Tags:        map[string]string{"path": "C:,D:"},
+				Fields:      []Field{{Key: "note", Value: `a, b=c "d"`}, {Key: "free", Value: 1.0}},
+			}},
+		},
+		{
+			name: "comments and blank lines",
+			data: "# header\n\nload value=1\r\n\nload value=2\n",
+			want: []Point{
+				{Measurement: "load", Fields: []Field{{Key: "value", Value: 1.0}}},
+				{Measurement: "load", Fields: []Field{{Key: "value", Value: 2.0}}},
+			},
+		},
+		{name: "no fields", data: "cpu\n", wantErr: "line 1: ' ' expected"},
+		{name: "field without value", data: "ok value=1\ncpu value", wantErr: "line 2: '=' expected"},
+		{name: "bad integer", data: "cpu value=1.5i", wantErr: `line 1: field value: bad integer "1.5i"`},
+		{name: "bad value", data: "cpu value=abc", wantErr: `line 1: field value: bad value "abc"`},
+		{name: "unterminated string", data: `cpu value="abc`, wantErr: "line 1: unterminated string"},
+		{name: "bad timestamp", data: "cpu value=1 yesterday", wantErr: `line 1: bad timestamp "yesterday"`},
+		{name: "empty tag", data: "cpu,host= value=1", wantErr: `line 1: bad tag "host="`},
+		{name: "NaN", data: "cpu value=NaN", wantErr: `line 1: field value: bad value "NaN"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.data))
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_MapperMetrics(t *testing.T) {
+	rules := []mapping.Rule{
+		{Match: `^net\..*\.(bytes_recv|errors)$`, Type: "counter"},
+		{Match: `^system\.(.*)\.uptime$`, Type: "gauge", Name: "uptime.$1"},
+	}
+	require.NoError(t, mapping.Compile(rules))
+	m := Mapper{Rules: rules, Tags: []string{"host", "interface"}}
+
+	points, err := Parse([]byte("net,host=web1,interface=eth0,dc=eu bytes_recv=1024i,drop_rate=0.5\n" +
+		"system,host=web1 uptime=3600i,version=\"6.1\"\n" +
+		"cpu usage_idle=97.5,online=true\n" +
+		"disk,host=db:1/a used=1\n"))
+	require.NoError(t, err)
+
+	got, _, err := m.metrics(points)
+	require.NoError(t, err)
+
+	gauge := func(id string, v float64) usecase.Metric {
+		return usecase.Metric{ID: id, MType: "gauge", Value: &v}
+	}
+	delta := int64(1024)
+	want := []usecase.Metric{
+		{ID: "net.web1.eth0.bytes_recv", MType: "counter", Delta: &delta},
+		gauge("net.web1.eth0.drop_rate", 0.5),
+		gauge("uptime.web1", 3600),
+		gauge("cpu.usage_idle", 97.5),
+		gauge("cpu.online", 1),
+		gauge("disk.db:1_a.used", 1),
+	}
+	assert.Equal(t, want, got)
+
+	points, err = Parse([]byte("net,host=web1 errors=0.5"))
+	require.NoError(t, err)
+	_, _, err = m.metrics(points)
+	assert.EqualError(t, err, "value: counter net.web1.errors needs a whole value, got 0.5")
+}
+
+func Test_MapperWriteCumulative(t *testing.T) {
+	rules := []mapping.Rule{
+		{Match: `\.bytes_recv$`, Type: "counter", Cumulative: true},
+		{Match: `\.errors$`, Type: "counter"},
+	}
+	require.NoError(t, mapping.Compile(rules))
+	m := Mapper{Rules: rules, Tags: []string{"host"}}
+	db := memory.NewMemStorage()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	write := func(lines string) error {
+		points, err := Parse([]byte(lines))
+		require.NoError(t, err)
+		_, _, err = m.Write(db, usecase.DefaultTenant, points, now)
+		return err
+	}
+	counter := func(id string) int64 {
+		got, err := db.Get(&usecase.Metric{ID: id, MType: "counter"})
+		require.NoError(t, err)
+		return *got.Delta
+	}
+
+	steps := []struct {
+		name      string
+		lines     string
+		wantBytes int64
+	}{
+		{name: "first total is the baseline", lines: "net,host=web1 bytes_recv=1000i,errors=1i", wantBytes: 0},
+		{name: "increase is added", lines: "net,host=web1 bytes_recv=1500i", wantBytes: 500},
+		{name: "points of a request in order", lines: "net,host=web1 bytes_recv=1600i\nnet,host=web1 bytes_recv=1800i", wantBytes: 800},
+		{name: "drop counts from zero", lines: "net,host=web1 bytes_recv=100i", wantBytes: 900},
+	}
+	for _, s := range steps {
+		require.NoError(t, write(s.lines), s.name)
+		assert.Equal(t, s.wantBytes, counter("net.web1.bytes_recv"), s.name)
+	}
+	assert.Equal(t, int64(1), counter("net.web1.errors"), "delta fields are added")
+
+	// a failed write keeps the previous total
+	db.Limit = 2
+	require.NoError(t, write("net,host=web1 bytes_recv=300i,drop=1"))
+	assert.Equal(t, int64(900), counter("net.web1.bytes_recv"), "aborted batch")
+	db.Limit = 0
+	require.NoError(t, write("net,host=web1 bytes_recv=300i"))
+	assert.Equal(t, int64(1100), counter("net.web1.bytes_recv"), "increase since the stored total")
+
+	var ve *usecase.ValidationError
+	assert.ErrorAs(t, write("net,host=web1 bytes_recv=-1i"), &ve)
+}
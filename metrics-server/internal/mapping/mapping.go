@@ -0,0 +1,90 @@
+// Package mapping turns names of metrics from other protocols, like
+// Graphite paths, into IDs and types of metrics.
+package mapping
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// Rule maps the names matching Match to metrics of Type. Name is the ID of
+// the metric with $1-like references to the groups of Match, the name as is
+// if empty. The value of a counter is added to it and must be whole; with
+// Cumulative it is a running total of which the increase is added, where
+// the protocol supports it.
+type Rule struct {
+	Match      string `json:"match"`
+	Type       string `json:"type"`
+	Name       string `json:"name,omitempty"`
+	Cumulative bool   `json:"cumulative,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// LoadRules reads a JSON array of rules, the first matching rule applies
+// and names without one are gauges:
+//
+//	[{"match": "^stats_counts\\.(.+)$", "type": "counter", "name": "$1"},
+//	 {"match": "\\.requests$", "type": "counter"}]
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read rules file %s: %v", path, err)
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("cannot parse rules file %s: %v", path, err)
+	}
+	if err := Compile(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Compile checks the rules and prepares them for matching.
+func Compile(rules []Rule) error {
+	for i := range rules {
+		r := &rules[i]
+		if r.Type != "gauge" && r.Type != "counter" {
+			return fmt.Errorf("rule %d: type must be gauge or counter, got %q", i+1, r.Type)
+		}
+		if r.Cumulative && r.Type != "counter" {
+			return fmt.Errorf("rule %d: only counters may be cumulative", i+1)
+		}
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+// Map returns the ID and type of the metric of a name.
+func Map(rules []Rule, name string) (string, string) {
+	id, r := Match(rules, name)
+	if r == nil {
+		return id, "gauge"
+	}
+	return id, r.Type
+}
+
+// Match returns the ID of the metric of a name and the rule which applies,
+// nil if none does.
+func Match(rules []Rule, name string) (string, *Rule) {
+	for i := range rules {
+		r := &rules[i]
+		m := r.re.FindStringSubmatchIndex(name)
+		if m == nil {
+			continue
+		}
+		if r.Name == "" {
+			return name, r
+		}
+		return string(r.re.ExpandString(nil, r.Name, name, m)), r
+	}
+	return name, nil
+}
@@ -0,0 +1,63 @@
+package mapping
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Map(t *testing.T) {
+	rules := []Rule{
+		{Match: `^stats_counts\.(.+)$`, Type: "counter", Name: "$1"},
+		{Match: `\.requests$`, Type: "counter"},
+		{Match: `^disk\.`, Type: "gauge", Name: "storage"},
+	}
+	require.NoError(t, Compile(rules))
+
+	tests := []struct {
+		name     string
+		wantID   string
+		wantType string
+	}{
+		{name: "stats_counts.api.hits", wantID: "api.hits", wantType: "counter"},
+		{name: "web1.requests", wantID: "web1.requests", wantType: "counter"},
+		{name: "disk.used", wantID: "storage", wantType: "gauge"},
+		{name: "web1.load", wantID: "web1.load", wantType: "gauge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, mtype := Map(rules, tt.name)
+			assert.Equal(t, tt.wantID, id)
+			assert.Equal(t, tt.wantType, mtype)
+		})
+	}
+}
+
+func Test_LoadRules(t *testing.T) {
+	dir := t.TempDir()
+	write := func(data string) string {
+		path := filepath.Join(dir, "rules.json")
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+		return path
+	}
+
+	rules, err := LoadRules(write(`[{"match": "\\.requests$", "type": "counter"}]`))
+	require.NoError(t, err)
+	id, mtype := Map(rules, "web1.requests")
+	assert.Equal(t, "web1.requests", id)
+	assert.Equal(t, "counter", mtype)
+
+	_, err = LoadRules(write(`[{"match": "(", "type": "counter"}]`))
+	assert.Error(t, err, "bad expression")
+	_, err = LoadRules(write(`[{"match": "x", "type": "histogram"}]`))
+	assert.Error(t, err, "bad type")
+	_, err = LoadRules(write(`[{"match": "x", "type": "gauge", "cumulative": true}]`))
+	assert.Error(t, err, "cumulative gauge")
+	_, err = LoadRules(write(`{}`))
+	assert.Error(t, err, "not an array")
+	_, err = LoadRules(filepath.Join(dir, "absent.json"))
+	assert.Error(t, err)
+}
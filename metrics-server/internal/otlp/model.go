@@ -0,0 +1,226 @@
+// Package otlp receives metrics of OpenTelemetry SDKs exported over OTLP/HTTP
+// and maps them onto gauges and counters. Only the messages and fields it
+// needs are modelled, others are skipped.
+package otlp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExportRequest is ExportMetricsServiceRequest, the body of POST /v1/metrics.
+type ExportRequest struct {
+	ResourceMetrics []ResourceMetrics `json:"resourceMetrics"`
+}
+
+type ResourceMetrics struct {
+	Resource     Resource       `json:"resource"`
+	ScopeMetrics []ScopeMetrics `json:"scopeMetrics"`
+}
+
+type Resource struct {
+	Attributes []KeyValue `json:"attributes"`
+}
+
+type ScopeMetrics struct {
+	Scope   Scope    `json:"scope"`
+	Metrics []Metric `json:"metrics"`
+}
+
+type Scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Metric has one of the data kinds, the kinds which are not modelled
+// (exponential histograms, summaries) are only marked as unsupported.
+type Metric struct {
+	Name        string     `json:"name"`
+	Unit        string     `json:"unit"`
+	Gauge       *Gauge     `json:"gauge"`
+	Sum         *Sum       `json:"sum"`
+	Histogram   *Histogram `json:"histogram"`
+	Unsupported int        `json:"-"` // data points of other kinds
+
+	ExponentialHistogram *unsupportedData `json:"exponentialHistogram"`
+	Summary              *unsupportedData `json:"summary"`
+}
+
+type Gauge struct {
+	DataPoints []NumberDataPoint `json:"dataPoints"`
+}
+
+type Sum struct {
+	DataPoints             []NumberDataPoint `json:"dataPoints"`
+	AggregationTemporality Temporality       `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type Histogram struct {
+	DataPoints             []HistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality Temporality          `json:"aggregationTemporality"`
+}
+
+type NumberDataPoint struct {
+	Attributes        []KeyValue `json:"attributes"`
+	StartTimeUnixNano Uint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      Uint64     `json:"timeUnixNano"`
+	AsDouble          *float64   `json:"asDouble"`
+	AsInt             *Int64     `json:"asInt"`
+}
+
+// Number returns the value of the point, false if it has none.
+func (p *NumberDataPoint) Number() (float64, bool) {
+	switch {
+	case p.AsDouble != nil:
+		return *p.AsDouble, true
+	case p.AsInt != nil:
+		return float64(*p.AsInt), true
+	}
+	return 0, false
+}
+
+type HistogramDataPoint struct {
+	Attributes        []KeyValue `json:"attributes"`
+	StartTimeUnixNano Uint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      Uint64     `json:"timeUnixNano"`
+	Count             Uint64     `json:"count"`
+	Sum               *float64   `json:"sum"`
+	Min               *float64   `json:"min"`
+	Max               *float64   `json:"max"`
+}
+
+type unsupportedData struct {
+	DataPoints []json.RawMessage `json:"dataPoints"`
+}
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// AnyValue keeps the scalar values of attributes, arrays and maps are
+// dropped.
+type AnyValue struct {
+	StringValue *string  `json:"stringValue"`
+	BoolValue   *bool    `json:"boolValue"`
+	IntValue    *Int64   `json:"intValue"`
+	DoubleValue *float64 `json:"doubleValue"`
+}
+
+func (v AnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	}
+	return ""
+}
+
+// Temporality is AggregationTemporality of sums and histograms.
+type Temporality int32
+
+const (
+	TemporalityUnspecified Temporality = iota
+	TemporalityDelta
+	TemporalityCumulative
+)
+
+var temporalityNames = map[string]Temporality{
+	"AGGREGATION_TEMPORALITY_UNSPECIFIED": TemporalityUnspecified,
+	"AGGREGATION_TEMPORALITY_DELTA":       TemporalityDelta,
+	"AGGREGATION_TEMPORALITY_CUMULATIVE":  TemporalityCumulative,
+}
+
+// UnmarshalJSON takes the number or the name of the value.
+func (t *Temporality) UnmarshalJSON(data []byte) error {
+	var name string
+	if json.Unmarshal(data, &name) == nil {
+		v, ok := temporalityNames[name]
+		if !ok {
+			return fmt.Errorf("unknown aggregation temporality %q", name)
+		}
+		*t = v
+		return nil
+	}
+	var v int32
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("bad aggregation temporality %s", data)
+	}
+	*t = Temporality(v)
+	return nil
+}
+
+// Int64 and Uint64 take JSON numbers and, as the protobuf JSON mapping
+// writes 64 bit integers, strings.
+type Int64 int64
+
+func (i *Int64) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(unquote(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad integer %s", data)
+	}
+	*i = Int64(v)
+	return nil
+}
+
+type Uint64 uint64
+
+func (u *Uint64) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseUint(unquote(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad unsigned integer %s", data)
+	}
+	*u = Uint64(v)
+	return nil
+}
+
+func unquote(data []byte) string {
+	return strings.Trim(string(data), `"`)
+}
+
+// DecodeJSON reads a request of the OTLP/JSON encoding.
+func DecodeJSON(data []byte) (*ExportRequest, error) {
+	var req ExportRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("cannot decode request: %v", err)
+	}
+	for i := range req.ResourceMetrics {
+		for j := range req.ResourceMetrics[i].ScopeMetrics {
+			for k := range req.ResourceMetrics[i].ScopeMetrics[j].Metrics {
+				m := &req.ResourceMetrics[i].ScopeMetrics[j].Metrics[k]
+				if m.ExponentialHistogram != nil {
+					m.Unsupported += len(m.ExponentialHistogram.DataPoints)
+				}
+				if m.Summary != nil {
+					m.Unsupported += len(m.Summary.DataPoints)
+				}
+			}
+		}
+	}
+	return &req, nil
+}
+
+// ExportResponse is ExportMetricsServiceResponse, PartialSuccess is set when
+// data points are rejected.
+type ExportResponse struct {
+	PartialSuccess *PartialSuccess `json:"partialSuccess,omitempty"`
+}
+
+type PartialSuccess struct {
+	RejectedDataPoints int64  `json:"rejectedDataPoints,string"`
+	ErrorMessage       string `json:"errorMessage,omitempty"`
+}
+
+// Codes of google.rpc.Status in error answers.
+const (
+	StatusInvalidArgument = 3
+	StatusInternal        = 13
+)
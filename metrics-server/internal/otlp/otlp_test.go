@@ -0,0 +1,352 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"math"
+	"metrics-server/internal/storage/memory"
+	"metrics-server/internal/usecase"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (w *writer) fixed64(num int, v uint64) {
+	w.b = binary.AppendUvarint(w.b, uint64(num)<<3|wireFixed64)
+	w.b = binary.LittleEndian.AppendUint64(w.b, v)
+}
+
+func attribute(key, value string) []byte {
+	var v, kv writer
+	v.bytes(1, []byte(value))
+	kv.bytes(1, []byte(key))
+	kv.bytes(2, v.b)
+	return kv.b
+}
+
+// protoRequest encodes a request with a cumulative monotonic sum of an int
+// point, a gauge of a double point and a cumulative histogram.
+func protoRequest(start, now uint64) []byte {
+	var sumPoint, sum, sumMetric writer
+	sumPoint.bytes(7, attribute("method", "GET"))
+	sumPoint.fixed64(2, start)
+	sumPoint.fixed64(3, now)
+	sumPoint.fixed64(6, 42)
+	sum.bytes(1, sumPoint.b)
+	sum.varint(2, uint64(TemporalityCumulative))
+	sum.varint(3, 1)
+	sumMetric.bytes(1, []byte("http.requests"))
+	sumMetric.bytes(2, []byte("description is skipped"))
+	sumMetric.bytes(7, sum.b)
+
+	var gaugePoint, gauge, gaugeMetric writer
+	gaugePoint.fixed64(3, now)
+	gaugePoint.fixed64(4, math.Float64bits(0.75))
+	gauge.bytes(1, gaugePoint.b)
+	gaugeMetric.bytes(1, []byte("cpu.load"))
+	gaugeMetric.bytes(5, gauge.b)
+
+	var histPoint, hist, histMetric writer
+	histPoint.fixed64(2, start)
+	histPoint.fixed64(3, now)
+	histPoint.fixed64(4, 4)
+	histPoint.fixed64(5, math.Float64bits(2))
+	histPoint.fixed64(11, math.Float64bits(0.1))
+	histPoint.fixed64(12, math.Float64bits(1.2))
+	hist.bytes(1, histPoint.b)
+	hist.varint(2, uint64(TemporalityCumulative))
+	histMetric.bytes(1, []byte("http.duration"))
+	histMetric.bytes(9, hist.b)
+
+	var summary, summaryMetric writer
+	summary.bytes(1, []byte{})
+	summaryMetric.bytes(1, []byte("rpc.latency"))
+	summaryMetric.bytes(11, summary.b)
+
+	var scope, scopeMetrics, resource, resourceMetrics, req writer
+	scope.bytes(1, []byte("shop"))
+	scopeMetrics.bytes(1, scope.b)
+	scopeMetrics.bytes(2, sumMetric.b)
+	scopeMetrics.bytes(2, gaugeMetric.b)
+	scopeMetrics.bytes(2, histMetric.b)
+	scopeMetrics.bytes(2, summaryMetric.b)
+	resource.bytes(1, attribute("service.name", "checkout"))
+	resourceMetrics.bytes(1, resource.b)
+	resourceMetrics.bytes(2, scopeMetrics.b)
+	req.bytes(1, resourceMetrics.b)
+	return req.b
+}
+
+func Test_DecodeProto(t *testing.T) {
+	got, err := DecodeProto(protoRequest(100, 200))
+	require.NoError(t, err)
+
+	require.Len(t, got.ResourceMetrics, 1)
+	rm := got.ResourceMetrics[0]
+	assert.Equal(t, "checkout", rm.Resource.Attributes[0].Value.String())
+	require.Len(t, rm.ScopeMetrics, 1)
+	sm := rm.ScopeMetrics[0]
+	assert.Equal(t, "shop", sm.Scope.Name)
+	require.Len(t, sm.Metrics, 4)
+
+	sum := sm.Metrics[0]
+	assert.Equal(t, "http.requests", sum.Name)
+	require.NotNil(t, sum.Sum)
+	assert.True(t, sum.Sum.IsMonotonic)
+	assert.Equal(t, TemporalityCumulative, sum.Sum.AggregationTemporality)
+	p := sum.Sum.DataPoints[0]
+	assert.Equal(t, Uint64(100), p.StartTimeUnixNano)
+	assert.Equal(t, Uint64(200), p.TimeUnixNano)
+	value, ok := p.Number()
+	assert.True(t, ok)
+	assert.Equal(t, 42.0, value)
+	assert.Equal(t, "method", p.Attributes[0].Key)
+
+	value, _ = sm.Metrics[1].Gauge.DataPoints[0].Number()
+	assert.Equal(t, 0.75, value)
+
+	h := sm.Metrics[2].Histogram.DataPoints[0]
+	assert.Equal(t, Uint64(4), h.Count)
+	assert.Equal(t, 2.0, *h.Sum)
+	assert.Equal(t, 0.1, *h.Min)
+	assert.Equal(t, 1.2, *h.Max)
+
+	assert.Equal(t, 1, sm.Metrics[3].Unsupported)
+
+	_, err = DecodeProto([]byte{0x0a, 0x05, 0x01})
+	assert.ErrorContains(t, err, "truncated message")
+	_, err = DecodeProto([]byte{0x13})
+	assert.ErrorContains(t, err, "unsupported wire type 3")
+}
+
+func Test_DecodeJSON(t *testing.T) {
+	got, err := DecodeJSON([]byte(`{"resourceMetrics": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "checkout"}}]},
+		"scopeMetrics": [{"scope": {"name": "shop"}, "metrics": [
+			{"name": "http.requests", "sum": {"aggregationTemporality": "AGGREGATION_TEMPORALITY_DELTA", "isMonotonic": true,
+				"dataPoints": [{"asInt": "5", "timeUnixNano": "1760870400000000000", "attributes": [{"key": "code", "value": {"intValue": 200}}]}]}},
+			{"name": "http.duration", "histogram": {"aggregationTemporality": 2,
+				"dataPoints": [{"count": "3", "sum": 1.5, "bucketCounts": ["1", "2"], "explicitBounds": [1]}]}},
+			{"name": "rpc.latency", "summary": {"dataPoints": [{}, {}]}}
+		]}]
+	}]}`))
+	require.NoError(t, err)
+
+	metrics := got.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	sum := metrics[0].Sum
+	assert.Equal(t, TemporalityDelta, sum.AggregationTemporality)
+	assert.Equal(t, Int64(5), *sum.DataPoints[0].AsInt)
+	assert.Equal(t, Uint64(1760870400000000000), sum.DataPoints[0].TimeUnixNano)
+	assert.Equal(t, "200", sum.DataPoints[0].Attributes[0].Value.String())
+	assert.Equal(t, TemporalityCumulative, metrics[1].Histogram.AggregationTemporality)
+	assert.Equal(t, Uint64(3), metrics[1].Histogram.DataPoints[0].Count)
+	assert.Equal(t, 2, metrics[2].Unsupported)
+
+	_, err = DecodeJSON([]byte(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"sum": {"aggregationTemporality": "SOMETIMES"}}]}]}]}`))
+	assert.ErrorContains(t, err, `unknown aggregation temporality "SOMETIMES"`)
+}
+
+// sumRequest makes a request of one monotonic sum point.
+func sumRequest(temporality Temporality, start, now uint64, value float64, attrs ...KeyValue) *ExportRequest {
+	return &ExportRequest{ResourceMetrics: []ResourceMetrics{{
+		Resource: Resource{Attributes: []KeyValue{stringAttr("service.name", "checkout")}},
+		ScopeMetrics: []ScopeMetrics{{Metrics: []Metric{{
+			Name: "http.requests",
+			Sum: &Sum{
+				AggregationTemporality: temporality,
+				IsMonotonic:            true,
+				DataPoints: []NumberDataPoint{{
+					Attributes:        attrs,
+					StartTimeUnixNano: Uint64(start),
+					TimeUnixNano:      Uint64(now),
+					AsDouble:          &value,
+				}},
+			},
+		}}}},
+	}}}
+}
+
+func stringAttr(key, value string) KeyValue {
+	return KeyValue{Key: key, Value: AnyValue{StringValue: &value}}
+}
+
+func counter(t *testing.T, db usecase.Repositories, id string) int64 {
+	t.Helper()
+	m, err := db.Get(&usecase.Metric{ID: id, MType: "counter"})
+	require.NoError(t, err)
+	return *m.Delta
+}
+
+func gauge(t *testing.T, db usecase.Repositories, id string) float64 {
+	t.Helper()
+	m, err := db.Get(&usecase.Metric{ID: id, MType: "gauge"})
+	require.NoError(t, err)
+	return *m.Value
+}
+
+func Test_ReceiverCumulative(t *testing.T) {
+	db := memory.NewMemStorage()
+	r := NewReceiver([]string{"service.name", "method"})
+	now := time.Now()
+	before := uint64(r.started.Add(-time.Hour).UnixNano())
+	after := uint64(r.started.Add(time.Second).UnixNano())
+	get := stringAttr("method", "GET")
+
+	steps := []struct {
+		name  string
+		start uint64
+		time  uint64
+		value float64
+		want  int64
+	}{
+		{name: "started before the receiver sets the baseline", start: before, time: 10, value: 100, want: 0},
+		{name: "increase", start: before, time: 20, value: 103, want: 3},
+		{name: "older point is skipped", start: before, time: 15, value: 101, want: 3},
+		{name: "fraction is carried over", start: before, time: 30, value: 104.5, want: 4},
+		{name: "fraction completes", start: before, time: 40, value: 105, want: 5},
+		{name: "drop is a restart", start: before, time: 50, value: 2, want: 7},
+		{name: "new start time is a restart", start: after, time: 60, value: 1, want: 8},
+	}
+	for _, s := range steps {
+		res, err := r.Write(db, usecase.DefaultTenant, sumRequest(TemporalityCumulative, s.start, s.time, s.value, get), now)
+		require.NoError(t, err, s.name)
+		assert.Zero(t, res.Rejected, s.name)
+		assert.Equal(t, s.want, counter(t, db, "http.requests.checkout.GET"), s.name)
+	}
+
+	// a stream started after the receiver is counted from its first point
+	post := stringAttr("method", "POST")
+	_, err := r.Write(db, usecase.DefaultTenant, sumRequest(TemporalityCumulative, after, 10, 7, post), now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), counter(t, db, "http.requests.checkout.POST"))
+	assert.Equal(t, 2, r.Len())
+
+	// streams without points for StaleAfter are dropped
+	_, err = r.Write(db, usecase.DefaultTenant, &ExportRequest{}, now.Add(StaleAfter+time.Minute))
+	require.NoError(t, err)
+	assert.Zero(t, r.Len())
+}
+
+func Test_ReceiverDelta(t *testing.T) {
+	db := memory.NewMemStorage()
+	r := NewReceiver(nil)
+	now := time.Now()
+
+	for i, v := range []float64{0.5, 0.25, 0.5, 3} {
+		_, err := r.Write(db, usecase.DefaultTenant, sumRequest(TemporalityDelta, 0, uint64(i), v), now)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(4), counter(t, db, "http.requests"))
+
+	res, err := r.Write(db, usecase.DefaultTenant, sumRequest(TemporalityDelta, 0, 10, -1), now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.Rejected)
+	assert.Contains(t, res.Message, "is not a finite non-negative number")
+
+	res, err = r.Write(db, usecase.DefaultTenant, sumRequest(TemporalityUnspecified, 0, 10, 1), now)
+	require.NoError(t, err)
+	assert.Equal(t, Result{Rejected: 1, Message: "http.requests: aggregation temporality is not set"}, res)
+}
+
+func Test_ReceiverGaugesAndHistograms(t *testing.T) {
+	db := memory.NewMemStorage()
+	r := NewReceiver([]string{"service.name"})
+	now := time.Now()
+	start := uint64(r.started.Add(time.Second).UnixNano())
+
+	req, err := DecodeProto(protoRequest(start, start+10))
+	require.NoError(t, err)
+	res, err := r.Write(db, usecase.DefaultTenant, req, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), res.Accepted)
+	assert.Equal(t, int64(1), res.Rejected)
+	assert.Equal(t, "rpc.latency: exponential histograms and summaries are not supported", res.Message)
+
+	assert.Equal(t, int64(42), counter(t, db, "http.requests.checkout"))
+	assert.Equal(t, 0.75, gauge(t, db, "cpu.load.checkout"))
+	assert.Equal(t, int64(4), counter(t, db, "http.duration.checkout_count"))
+	assert.Equal(t, 0.5, gauge(t, db, "http.duration.checkout_avg"))
+	assert.Equal(t, 0.1, gauge(t, db, "http.duration.checkout_min"))
+	assert.Equal(t, 1.2, gauge(t, db, "http.duration.checkout_max"))
+
+	// the average is of the interval
+	count, sum := Uint64(6), 4.0
+	hist := req.ResourceMetrics[0].ScopeMetrics[0].Metrics[2]
+	hist.Histogram.DataPoints[0].Count = count
+	hist.Histogram.DataPoints[0].Sum = &sum
+	hist.Histogram.DataPoints[0].TimeUnixNano += 10
+	_, err = r.Write(db, usecase.DefaultTenant, &ExportRequest{ResourceMetrics: []ResourceMetrics{{
+		Resource:     req.ResourceMetrics[0].Resource,
+		ScopeMetrics: []ScopeMetrics{{Scope: Scope{Name: "shop"}, Metrics: []Metric{hist}}},
+	}}}, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), counter(t, db, "http.duration.checkout_count"))
+	assert.Equal(t, 1.0, gauge(t, db, "http.duration.checkout_avg"))
+
+	// an up-down counter is a gauge, its deltas are summed
+	for _, v := range []float64{5, -2} {
+		req := sumRequest(TemporalityDelta, 0, 0, v)
+		req.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Name = "db.connections"
+		req.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Sum.IsMonotonic = false
+		_, err := r.Write(db, usecase.DefaultTenant, req, now)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 3.0, gauge(t, db, "db.connections.checkout"))
+}
+
+func Test_ReceiverRejected(t *testing.T) {
+	db := memory.NewMemStorage()
+	db.Limit = 1
+	r := NewReceiver(nil)
+	now := time.Now()
+	start := uint64(r.started.Add(time.Second).UnixNano())
+
+	_, err := r.Write(db, usecase.DefaultTenant, sumRequest(TemporalityCumulative, start, 1, 5), now)
+	require.NoError(t, err)
+
+	// the limit rejects the second metric, its stream is not advanced
+	other := sumRequest(TemporalityCumulative, start, 1, 5)
+	other.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Name = "http.errors"
+	res, err := r.Write(db, usecase.DefaultTenant, other, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.Rejected)
+	assert.Contains(t, res.Message, "http.errors: ")
+	assert.Equal(t, 1, r.Len())
+
+	nan := math.NaN()
+	req := sumRequest(TemporalityCumulative, start, 2, 6)
+	req.ResourceMetrics[0].ScopeMetrics[0].Metrics = append(req.ResourceMetrics[0].ScopeMetrics[0].Metrics,
+		Metric{Name: "http.requests", Gauge: &Gauge{DataPoints: []NumberDataPoint{{AsDouble: &nan}, {}}}},
+		Metric{Name: "", Gauge: &Gauge{DataPoints: []NumberDataPoint{{}}}},
+	)
+	res, err = r.Write(db, usecase.DefaultTenant, req, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.Accepted)
+	assert.Equal(t, int64(3), res.Rejected)
+	assert.Equal(t, int64(6), counter(t, db, "http.requests"))
+}
+
+func Test_EncodeResponseProto(t *testing.T) {
+	assert.Empty(t, EncodeResponseProto(0, ""))
+
+	var partial ExportResponse
+	err := fields(EncodeResponseProto(2, "bad"), func(r *reader, num, typ int) (bool, error) {
+		return message(r, num, typ, func(b []byte) error {
+			partial.PartialSuccess = &PartialSuccess{}
+			return fields(b, func(r *reader, num, typ int) (bool, error) {
+				switch num {
+				case 1:
+					v, err := varintField(r, num, typ)
+					partial.PartialSuccess.RejectedDataPoints = int64(v)
+					return true, err
+				case 2:
+					return stringField(r, num, typ, &partial.PartialSuccess.ErrorMessage)
+				}
+				return false, nil
+			})
+		})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &PartialSuccess{RejectedDataPoints: 2, ErrorMessage: "bad"}, partial.PartialSuccess)
+}
@@ -0,0 +1,448 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Wire types of the protobuf encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated message")
+
+// reader walks the fields of a protobuf message.
+type reader struct {
+	b []byte
+}
+
+// next returns the number and the wire type of the next field.
+func (r *reader) next() (int, int, error) {
+	tag, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	num, typ := int(tag>>3), int(tag&7)
+	if num <= 0 {
+		return 0, 0, fmt.Errorf("bad field number %d", num)
+	}
+	return num, typ, nil
+}
+
+func (r *reader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *reader) fixed64() (uint64, error) {
+	if len(r.b) < 8 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v, nil
+}
+
+func (r *reader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.b)) {
+		return nil, errTruncated
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// skip passes over the value of a field which is not modelled.
+func (r *reader) skip(typ int) error {
+	var err error
+	switch typ {
+	case wireVarint:
+		_, err = r.varint()
+	case wireFixed64:
+		_, err = r.fixed64()
+	case wireBytes:
+		_, err = r.bytes()
+	case wireFixed32:
+		if len(r.b) < 4 {
+			return errTruncated
+		}
+		r.b = r.b[4:]
+	default:
+		return fmt.Errorf("unsupported wire type %d", typ)
+	}
+	return err
+}
+
+// fields calls fn for every field of the message b, fn reads the value of
+// the fields it knows and returns false for the others.
+func fields(b []byte, fn func(r *reader, num, typ int) (bool, error)) error {
+	r := &reader{b: b}
+	for len(r.b) > 0 {
+		num, typ, err := r.next()
+		if err != nil {
+			return err
+		}
+		known, err := fn(r, num, typ)
+		if err != nil {
+			return err
+		}
+		if !known {
+			if err := r.skip(typ); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expect checks the wire type of a known field.
+func expect(num, typ, want int) error {
+	if typ != want {
+		return fmt.Errorf("field %d has wire type %d, %d expected", num, typ, want)
+	}
+	return nil
+}
+
+// message decodes the embedded message of a field with fn.
+func message(r *reader, num, typ int, fn func(b []byte) error) (bool, error) {
+	if err := expect(num, typ, wireBytes); err != nil {
+		return true, err
+	}
+	b, err := r.bytes()
+	if err != nil {
+		return true, err
+	}
+	return true, fn(b)
+}
+
+// DecodeProto reads a request of the protobuf encoding.
+func DecodeProto(data []byte) (*ExportRequest, error) {
+	var req ExportRequest
+	err := fields(data, func(r *reader, num, typ int) (bool, error) {
+		if num != 1 {
+			return false, nil
+		}
+		return message(r, num, typ, func(b []byte) error {
+			req.ResourceMetrics = append(req.ResourceMetrics, ResourceMetrics{})
+			return decodeResourceMetrics(b, &req.ResourceMetrics[len(req.ResourceMetrics)-1])
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode request: %v", err)
+	}
+	return &req, nil
+}
+
+func decodeResourceMetrics(b []byte, rm *ResourceMetrics) error {
+	return fields(b, func(r *reader, num, typ int) (bool, error) {
+		switch num {
+		case 1:
+			return message(r, num, typ, func(b []byte) error {
+				return fields(b, func(r *reader, num, typ int) (bool, error) {
+					if num != 1 {
+						return false, nil
+					}
+					return message(r, num, typ, func(b []byte) error {
+						return decodeAttribute(b, &rm.Resource.Attributes)
+					})
+				})
+			})
+		case 2:
+			return message(r, num, typ, func(b []byte) error {
+				rm.ScopeMetrics = append(rm.ScopeMetrics, ScopeMetrics{})
+				return decodeScopeMetrics(b, &rm.ScopeMetrics[len(rm.ScopeMetrics)-1])
+			})
+		}
+		return false, nil
+	})
+}
+
+func decodeScopeMetrics(b []byte, sm *ScopeMetrics) error {
+	return fields(b, func(r *reader, num, typ int) (bool, error) {
+		switch num {
+		case 1:
+			return message(r, num, typ, func(b []byte) error {
+				return fields(b, func(r *reader, num, typ int) (bool, error) {
+					switch num {
+					case 1:
+						return stringField(r, num, typ, &sm.Scope.Name)
+					case 2:
+						return stringField(r, num, typ, &sm.Scope.Version)
+					}
+					return false, nil
+				})
+			})
+		case 2:
+			return message(r, num, typ, func(b []byte) error {
+				sm.Metrics = append(sm.Metrics, Metric{})
+				return decodeMetric(b, &sm.Metrics[len(sm.Metrics)-1])
+			})
+		}
+		return false, nil
+	})
+}
+
+func decodeMetric(b []byte, m *Metric) error {
+	return fields(b, func(r *reader, num, typ int) (bool, error) {
+		switch num {
+		case 1:
+			return stringField(r, num, typ, &m.Name)
+		case 3:
+			return stringField(r, num, typ, &m.Unit)
+		case 5:
+			m.Gauge = &Gauge{}
+			return message(r, num, typ, func(b []byte) error {
+				return decodeNumbers(b, &m.Gauge.DataPoints, nil, nil)
+			})
+		case 7:
+			m.Sum = &Sum{}
+			return message(r, num, typ, func(b []byte) error {
+				return decodeNumbers(b, &m.Sum.DataPoints, &m.Sum.AggregationTemporality, &m.Sum.IsMonotonic)
+			})
+		case 9:
+			m.Histogram = &Histogram{}
+			return message(r, num, typ, func(b []byte) error {
+				return decodeHistogram(b, m.Histogram)
+			})
+		case 10, 11:
+			// exponential histograms and summaries, only their points are
+			// counted
+			return message(r, num, typ, func(b []byte) error {
+				return fields(b, func(r *reader, num, typ int) (bool, error) {
+					if num == 1 {
+						m.Unsupported++
+					}
+					return false, nil
+				})
+			})
+		}
+		return false, nil
+	})
+}
+
+// decodeNumbers decodes Gauge and Sum, a gauge has no temporality and
+// monotonic fields.
+func decodeNumbers(b []byte, points *[]NumberDataPoint, temporality *Temporality, monotonic *bool) error {
+	return fields(b, func(r *reader, num, typ int) (bool, error) {
+		switch {
+		case num == 1:
+			return message(r, num, typ, func(b []byte) error {
+				*points = append(*points, NumberDataPoint{})
+				return decodeNumberDataPoint(b, &(*points)[len(*points)-1])
+			})
+		case num == 2 && temporality != nil:
+			v, err := varintField(r, num, typ)
+			*temporality = Temporality(v)
+			return true, err
+		case num == 3 && monotonic != nil:
+			v, err := varintField(r, num, typ)
+			*monotonic = v != 0
+			return true, err
+		}
+		return false, nil
+	})
+}
+
+func decodeNumberDataPoint(b []byte, p *NumberDataPoint) error {
+	return fields(b, func(r *reader, num, typ int) (bool, error) {
+		switch num {
+		case 2:
+			return fixed64Field(r, num, typ, (*uint64)(&p.StartTimeUnixNano))
+		case 3:
+			return fixed64Field(r, num, typ, (*uint64)(&p.TimeUnixNano))
+		case 4:
+			var bits uint64
+			known, err := fixed64Field(r, num, typ, &bits)
+			v := math.Float64frombits(bits)
+			p.AsDouble, p.AsInt = &v, nil
+			return known, err
+		case 6:
+			var bits uint64
+			known, err := fixed64Field(r, num, typ, &bits)
+			v := Int64(bits)
+			p.AsInt, p.AsDouble = &v, nil
+			return known, err
+		case 7:
+			return message(r, num, typ, func(b []byte) error {
+				return decodeAttribute(b, &p.Attributes)
+			})
+		}
+		return false, nil
+	})
+}
+
+func decodeHistogram(b []byte, h *Histogram) error {
+	return fields(b, func(r *reader, num, typ int) (bool, error) {
+		switch num {
+		case 1:
+			return message(r, num, typ, func(b []byte) error {
+				h.DataPoints = append(h.DataPoints, HistogramDataPoint{})
+				return decodeHistogramDataPoint(b, &h.DataPoints[len(h.DataPoints)-1])
+			})
+		case 2:
+			v, err := varintField(r, num, typ)
+			h.AggregationTemporality = Temporality(v)
+			return true, err
+		}
+		return false, nil
+	})
+}
+
+func decodeHistogramDataPoint(b []byte, p *HistogramDataPoint) error {
+	double := func(r *reader, num, typ int, v **float64) (bool, error) {
+		var bits uint64
+		known, err := fixed64Field(r, num, typ, &bits)
+		f := math.Float64frombits(bits)
+		*v = &f
+		return known, err
+	}
+	return fields(b, func(r *reader, num, typ int) (bool, error) {
+		switch num {
+		case 2:
+			return fixed64Field(r, num, typ, (*uint64)(&p.StartTimeUnixNano))
+		case 3:
+			return fixed64Field(r, num, typ, (*uint64)(&p.TimeUnixNano))
+		case 4:
+			return fixed64Field(r, num, typ, (*uint64)(&p.Count))
+		case 5:
+			return double(r, num, typ, &p.Sum)
+		case 9:
+			return message(r, num, typ, func(b []byte) error {
+				return decodeAttribute(b, &p.Attributes)
+			})
+		case 11:
+			return double(r, num, typ, &p.Min)
+		case 12:
+			return double(r, num, typ, &p.Max)
+		}
+		return false, nil
+	})
+}
+
+// decodeAttribute appends the KeyValue b to attrs.
+func decodeAttribute(b []byte, attrs *[]KeyValue) error {
+	var kv KeyValue
+	err := fields(b, func(r *reader, num, typ int) (bool, error) {
+		switch num {
+		case 1:
+			return stringField(r, num, typ, &kv.Key)
+		case 2:
+			return message(r, num, typ, func(b []byte) error {
+				return decodeAnyValue(b, &kv.Value)
+			})
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	*attrs = append(*attrs, kv)
+	return nil
+}
+
+func decodeAnyValue(b []byte, v *AnyValue) error {
+	return fields(b, func(r *reader, num, typ int) (bool, error) {
+		switch num {
+		case 1:
+			var s string
+			known, err := stringField(r, num, typ, &s)
+			v.StringValue = &s
+			return known, err
+		case 2:
+			n, err := varintField(r, num, typ)
+			b := n != 0
+			v.BoolValue = &b
+			return true, err
+		case 3:
+			n, err := varintField(r, num, typ)
+			i := Int64(n)
+			v.IntValue = &i
+			return true, err
+		case 4:
+			var bits uint64
+			known, err := fixed64Field(r, num, typ, &bits)
+			f := math.Float64frombits(bits)
+			v.DoubleValue = &f
+			return known, err
+		}
+		return false, nil
+	})
+}
+
+func stringField(r *reader, num, typ int, v *string) (bool, error) {
+	if err := expect(num, typ, wireBytes); err != nil {
+		return true, err
+	}
+	b, err := r.bytes()
+	*v = string(b)
+	return true, err
+}
+
+func varintField(r *reader, num, typ int) (uint64, error) {
+	if err := expect(num, typ, wireVarint); err != nil {
+		return 0, err
+	}
+	return r.varint()
+}
+
+func fixed64Field(r *reader, num, typ int, v *uint64) (bool, error) {
+	if err := expect(num, typ, wireFixed64); err != nil {
+		return true, err
+	}
+	var err error
+	*v, err = r.fixed64()
+	return true, err
+}
+
+// writer builds a protobuf message.
+type writer struct {
+	b []byte
+}
+
+func (w *writer) varint(num int, v uint64) {
+	w.b = binary.AppendUvarint(w.b, uint64(num)<<3|wireVarint)
+	w.b = binary.AppendUvarint(w.b, v)
+}
+
+func (w *writer) bytes(num int, v []byte) {
+	w.b = binary.AppendUvarint(w.b, uint64(num)<<3|wireBytes)
+	w.b = binary.AppendUvarint(w.b, uint64(len(v)))
+	w.b = append(w.b, v...)
+}
+
+// EncodeResponseProto returns ExportMetricsServiceResponse, with a partial
+// success when data points are rejected.
+func EncodeResponseProto(rejected int64, message string) []byte {
+	if rejected == 0 && message == "" {
+		return []byte{}
+	}
+	var partial, resp writer
+	partial.varint(1, uint64(rejected))
+	if message != "" {
+		partial.bytes(2, []byte(message))
+	}
+	resp.bytes(1, partial.b)
+	return resp.b
+}
+
+// EncodeStatusProto returns google.rpc.Status, the body of error answers.
+func EncodeStatusProto(code int, message string) []byte {
+	var w writer
+	w.varint(1, uint64(code))
+	w.bytes(2, []byte(message))
+	return w.b
+}
@@ -0,0 +1,402 @@
+package otlp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"metrics-server/internal/usecase"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffixes of the metrics a histogram is sent as.
+const (
+	CountSuffix = "_count"
+	MinSuffix   = "_min"
+	MaxSuffix   = "_max"
+	AvgSuffix   = "_avg"
+)
+
+// StaleAfter is how long the state of a stream is kept without points.
+const StaleAfter = time.Hour
+
+// Receiver maps OTLP data points onto metrics:
+//   - a gauge point sets a gauge;
+//   - a monotonic sum adds its increase to a counter, a cumulative sum is
+//     turned into deltas against the previous point of its stream;
+//   - a non-monotonic sum sets a gauge to its current value;
+//   - a histogram adds its count to a <name>_count counter and sets the
+//     <name>_avg gauge to the average of the interval, <name>_min and
+//     <name>_max to the reported extremes.
+//
+// The ID of a metric is the metric name and the values of the attributes of
+// Attributes the point or its resource has, joined with dots. Counters take
+// whole numbers only, fractions of a sum are carried over to later points.
+type Receiver struct {
+	Attributes []string
+
+	started time.Time
+	mu      sync.Mutex
+	series  map[string]*series
+	swept   time.Time
+}
+
+// series is the state of a sum or histogram stream: the data points of a
+// metric with the same attributes.
+type series struct {
+	start uint64  // start time of a cumulative stream
+	time  uint64  // time of the last point
+	total float64 // running total of a delta stream, last value of a cumulative one
+	sum   float64 // the same for the sum of a histogram
+	sent  int64   // whole part of total added to the counter
+	seen  time.Time
+}
+
+func NewReceiver(attributes []string) *Receiver {
+	now := time.Now()
+	return &Receiver{
+		Attributes: attributes,
+		started:    now,
+		series:     make(map[string]*series),
+		swept:      now,
+	}
+}
+
+// Result tells how many data points are applied and rejected, Message is
+// the error of the first rejected one.
+type Result struct {
+	Accepted int64
+	Rejected int64
+	Message  string
+}
+
+func (res *Result) reject(n int, format string, a ...any) {
+	if n == 0 {
+		return
+	}
+	res.Rejected += int64(n)
+	if res.Message == "" {
+		res.Message = fmt.Sprintf(format, a...)
+	}
+}
+
+// update is the new state of a stream, committed only if the first metric
+// of its point is applied so that a retried request is not counted twice.
+type update struct {
+	key  string
+	next series
+	item int
+}
+
+// span is the metrics of a data point in the batch, the point counts as
+// applied if they all are.
+type span struct {
+	first, n int
+}
+
+// Write applies the points of req to db, the storage of tenant. Points which
+// are invalid or rejected by the storage are counted in the result, the
+// error is returned for storage failures only. Requests are applied one at
+// a time so the streams see their points in order.
+func (r *Receiver) Write(db usecase.Repositories, tenant string, req *ExportRequest, now time.Time) (Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sweep(now)
+
+	var res Result
+	var batch []usecase.Metric
+	var updates []update
+	var points []span
+	// streams with several points in the request see their earlier ones
+	pending := make(map[string]*series)
+	previous := func(key string) *series {
+		if s, ok := pending[key]; ok {
+			return s
+		}
+		return r.series[key]
+	}
+	add := func(metrics ...usecase.Metric) (int, error) {
+		for i := range metrics {
+			if err := usecase.Validate(&metrics[i]); err != nil {
+				return 0, err
+			}
+		}
+		points = append(points, span{first: len(batch), n: len(metrics)})
+		batch = append(batch, metrics...)
+		return len(batch) - len(metrics), nil
+	}
+
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				res.reject(m.Unsupported, "%s: exponential histograms and summaries are not supported", m.Name)
+
+				name := usecase.SanitizeID(m.Name)
+				if name == "" {
+					res.reject(m.points(), "metric without a name")
+					continue
+				}
+				stream := func(attrs []KeyValue) (string, string) {
+					return r.id(name, attrs, rm.Resource.Attributes),
+						seriesKey(tenant, m.Name, rm.Resource.Attributes, sm.Scope.Name, attrs)
+				}
+
+				switch {
+				case m.Gauge != nil:
+					for _, p := range m.Gauge.DataPoints {
+						id, _ := stream(p.Attributes)
+						value, ok := p.Number()
+						if !ok {
+							res.reject(1, "%s: data point without a value", id)
+							continue
+						}
+						if _, err := add(usecase.NewGauge(id, value)); err != nil {
+							res.reject(1, "%s: %v", id, err)
+						}
+					}
+
+				case m.Sum != nil:
+					for _, p := range m.Sum.DataPoints {
+						id, key := stream(p.Attributes)
+						value, ok := p.Number()
+						if !ok {
+							res.reject(1, "%s: data point without a value", id)
+							continue
+						}
+						prev := previous(key)
+						if prev != nil && p.TimeUnixNano != 0 && uint64(p.TimeUnixNano) < prev.time {
+							continue // older than the last point of the stream
+						}
+						var next series
+						var metric usecase.Metric
+						var err error
+						if m.Sum.IsMonotonic {
+							var delta int64
+							next, delta, _, err = r.advance(prev, m.Sum.AggregationTemporality, uint64(p.StartTimeUnixNano), uint64(p.TimeUnixNano), value, 0)
+							metric = usecase.NewCounter(id, delta)
+						} else {
+							next, err = gaugeSum(prev, m.Sum.AggregationTemporality, &p, value)
+							metric = usecase.NewGauge(id, next.total)
+						}
+						if err != nil {
+							res.reject(1, "%s: %v", id, err)
+							continue
+						}
+						next.seen = now
+						item, err := add(metric)
+						if err != nil {
+							res.reject(1, "%s: %v", id, err)
+							continue
+						}
+						pending[key] = &next
+						updates = append(updates, update{key: key, next: next, item: item})
+					}
+
+				case m.Histogram != nil:
+					for _, p := range m.Histogram.DataPoints {
+						id, key := stream(p.Attributes)
+						prev := previous(key)
+						if prev != nil && p.TimeUnixNano != 0 && uint64(p.TimeUnixNano) < prev.time {
+							continue
+						}
+						sum := 0.0
+						if p.Sum != nil {
+							sum = *p.Sum
+						}
+						next, delta, interval, err := r.advance(prev, m.Histogram.AggregationTemporality, uint64(p.StartTimeUnixNano), uint64(p.TimeUnixNano), float64(p.Count), sum)
+						if err != nil {
+							res.reject(1, "%s: %v", id, err)
+							continue
+						}
+						next.seen = now
+						metrics := []usecase.Metric{usecase.NewCounter(id+CountSuffix, delta)}
+						if p.Sum != nil && interval[0] > 0 {
+							metrics = append(metrics, usecase.NewGauge(id+AvgSuffix, interval[1]/interval[0]))
+						}
+						if p.Min != nil {
+							metrics = append(metrics, usecase.NewGauge(id+MinSuffix, *p.Min))
+						}
+						if p.Max != nil {
+							metrics = append(metrics, usecase.NewGauge(id+MaxSuffix, *p.Max))
+						}
+						item, err := add(metrics...)
+						if err != nil {
+							res.reject(1, "%s: %v", id, err)
+							continue
+						}
+						pending[key] = &next
+						updates = append(updates, update{key: key, next: next, item: item})
+					}
+				}
+			}
+		}
+	}
+
+	if len(batch) == 0 {
+		return res, nil
+	}
+
+	items, err := db.SetBatch(batch, false)
+	if err != nil {
+		return res, err
+	}
+
+	for _, p := range points {
+		var failed error
+		for _, item := range items[p.first : p.first+p.n] {
+			if item.Err != nil {
+				failed = item.Err
+				break
+			}
+		}
+		if failed != nil {
+			res.reject(1, "%s: %v", batch[p.first].ID, failed)
+		} else {
+			res.Accepted++
+		}
+	}
+	for _, u := range updates {
+		if items[u.item].Err == nil {
+			next := u.next
+			r.series[u.key] = &next
+		}
+	}
+	return res, nil
+}
+
+var errTemporality = errors.New("aggregation temporality is not set")
+
+// advance moves a monotonic stream to a new point. It returns the new
+// state, the whole increase of the counter and the increase of the value
+// and of the sum over the interval. A cumulative stream which started
+// before the receiver has no previous point to compare with: its first
+// point only sets the baseline.
+func (r *Receiver) advance(prev *series, temporality Temporality, start, t uint64, value, sum float64) (series, int64, [2]float64, error) {
+	if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return series{}, 0, [2]float64{}, fmt.Errorf("monotonic value %v is not a finite non-negative number", value)
+	}
+
+	next := series{start: start, time: t}
+	var interval [2]float64
+	switch temporality {
+	case TemporalityDelta:
+		next.total, next.sum = value, sum
+		if prev != nil {
+			next.total += prev.total
+			next.sum += prev.sum
+			next.sent = prev.sent
+		}
+		interval = [2]float64{value, sum}
+
+	case TemporalityCumulative:
+		next.total, next.sum = value, sum
+		switch {
+		case prev == nil && (next.start == 0 || next.start < uint64(r.started.UnixNano())):
+			next.sent = int64(math.Floor(value))
+		case prev == nil, value < prev.total, next.start != 0 && next.start != prev.start:
+			// a new or restarted stream counts from zero
+			interval = [2]float64{value, sum}
+		default:
+			next.sent = prev.sent
+			interval = [2]float64{value - prev.total, sum - prev.sum}
+		}
+
+	default:
+		return series{}, 0, [2]float64{}, errTemporality
+	}
+
+	whole := math.Floor(next.total)
+	if whole > math.MaxInt64/2 {
+		return series{}, 0, [2]float64{}, fmt.Errorf("total %v is too large for a counter", next.total)
+	}
+	delta := int64(whole) - next.sent
+	next.sent += delta
+	return next, delta, interval, nil
+}
+
+// gaugeSum moves a non-monotonic stream to a new point, total is the
+// current value.
+func gaugeSum(prev *series, temporality Temporality, p *NumberDataPoint, value float64) (series, error) {
+	next := series{start: uint64(p.StartTimeUnixNano), time: uint64(p.TimeUnixNano), total: value}
+	switch temporality {
+	case TemporalityDelta:
+		if prev != nil {
+			next.total += prev.total
+		}
+	case TemporalityCumulative:
+	default:
+		return series{}, errTemporality
+	}
+	return next, nil
+}
+
+// sweep drops the streams which have not had points for StaleAfter, once a
+// minute, r.mu must be held.
+func (r *Receiver) sweep(now time.Time) {
+	if now.Sub(r.swept) < time.Minute {
+		return
+	}
+	r.swept = now
+	for key, s := range r.series {
+		if now.Sub(s.seen) > StaleAfter {
+			delete(r.series, key)
+		}
+	}
+}
+
+// Len returns the number of tracked streams.
+func (r *Receiver) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.series)
+}
+
+func (r *Receiver) id(name string, attrs, resource []KeyValue) string {
+	parts := []string{name}
+	for _, key := range r.Attributes {
+		if v, ok := lookup(attrs, key); ok {
+			parts = append(parts, v)
+		} else if v, ok := lookup(resource, key); ok {
+			parts = append(parts, v)
+		}
+	}
+	return usecase.SanitizeID(strings.Join(parts, "."))
+}
+
+func lookup(attrs []KeyValue, key string) (string, bool) {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return kv.Value.String(), true
+		}
+	}
+	return "", false
+}
+
+// seriesKey identifies a stream by everything which tells it apart.
+func seriesKey(tenant, name string, resource []KeyValue, scope string, attrs []KeyValue) string {
+	pairs := func(kvs []KeyValue) string {
+		s := make([]string, len(kvs))
+		for i, kv := range kvs {
+			s[i] = kv.Key + "=" + kv.Value.String()
+		}
+		slices.Sort(s)
+		return strings.Join(s, "\x01")
+	}
+	return strings.Join([]string{tenant, name, pairs(resource), scope, pairs(attrs)}, "\x00")
+}
+
+// points returns the number of supported data points.
+func (m *Metric) points() int {
+	switch {
+	case m.Gauge != nil:
+		return len(m.Gauge.DataPoints)
+	case m.Sum != nil:
+		return len(m.Sum.DataPoints)
+	case m.Histogram != nil:
+		return len(m.Histogram.DataPoints)
+	}
+	return 0
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Limiter(t *testing.T) {
+	l := New(2, 3)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("agent-1", now)
+		assert.True(t, ok, "request %d is within the burst", i)
+	}
+
+	ok, wait := l.Allow("agent-1", now)
+	assert.False(t, ok, "burst is spent")
+	assert.Equal(t, 500*time.Millisecond, wait, "a token comes every 1/rate seconds")
+
+	ok, _ = l.Allow("agent-2", now)
+	assert.True(t, ok, "clients have buckets of their own")
+
+	ok, _ = l.Allow("agent-1", now.Add(500*time.Millisecond))
+	assert.True(t, ok, "bucket is refilled")
+	ok, _ = l.Allow("agent-1", now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+
+	// full buckets of idle clients are dropped
+	assert.Equal(t, 2, l.Len())
+	l.Allow("agent-3", now.Add(sweepInterval+time.Second))
+	assert.Equal(t, 1, l.Len())
+}
+
+func Test_NewBurst(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		want  int
+	}{
+		{name: "explicit", rate: 10, burst: 4, want: 4},
+		{name: "rate rounded up", rate: 2.5, want: 3},
+		{name: "slow rate", rate: 0.1, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, New(tt.rate, tt.burst).Burst)
+		})
+	}
+}
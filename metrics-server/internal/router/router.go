@@ -1,6 +1,7 @@
 package router
 
 import (
+	"metrics-server/internal/auth"
 	"metrics-server/internal/handlers"
 	"metrics-server/internal/usecase/context"
 
@@ -12,22 +13,73 @@ func NewMultiplexer(app *context.AppContext) *chi.Mux {
 	r := chi.NewRouter()
 
 	r.Use(handlers.Logger(app))
+	r.Use(handlers.RateLimit(app))
 	r.Use(handlers.GzipHandler(app))
+	r.Use(handlers.Authenticate(app))
+	r.Use(handlers.KeyRateLimit(app))
+	r.Use(handlers.Tenant(app))
 
-	// legacy plaintext API
+	// API description, open to everyone
 	r.Group(func(r chi.Router) {
+		r.Get(`/openapi.json`, handlers.GetOpenAPI(app))
+		r.Get(`/docs`, handlers.GetDocs(app))
+	})
+
+	// reading
+	r.Group(func(r chi.Router) {
+		r.Use(handlers.RequireScope(app, auth.ScopeRead))
+
+		r.Get(`/api/v1/metrics/`, handlers.GetAllParamsJSON(app))
+		r.Get(`/api/v1/metrics/{mtype}/{name}`, handlers.GetMetric(app))
+
+		// legacy plaintext API, kept for the agents
 		r.Get(`/value/{mtype}/{name}`, handlers.GetParam(app))
-		r.Post(`/update/{mtype}/{name}/{value}`, handlers.SetParam(app))
 		r.Get(`/`, handlers.GetAllParams(app))
 		r.Get(`/ping`, handlers.CheckDBConnect(app))
+
+		// JSON queries
+		r.Get(`/values/`, handlers.GetAllParamsJSON(app))
+		r.Get(`/aggregate`, handlers.GetAggregate(app))
+		r.Get(`/alerts`, handlers.GetAlerts(app))
+
+		// legacy JSON API
+		r.With(handlers.CheckContentType(app)).Post(`/value/`, handlers.GetParamJSON(app))
+	})
+
+	// writing
+	r.Group(func(r chi.Router) {
+		r.Use(handlers.RequireScope(app, auth.ScopeWrite))
+
+		r.Delete(`/api/v1/metrics/{mtype}/{name}`, handlers.DeleteMetric(app))
+
+		// legacy plaintext API, kept for the agents
+		r.Post(`/update/{mtype}/{name}/{value}`, handlers.SetParam(app))
+
+		// InfluxDB line protocol, for Telegraf
+		r.Post(`/write`, handlers.WriteInflux(app))
+
+		// OpenTelemetry OTLP/HTTP exporters
+		r.Post(`/v1/metrics`, handlers.ReceiveOTLP(app))
+
+		r.Group(func(r chi.Router) {
+			r.Use(handlers.CheckContentType(app))
+
+			r.Post(`/api/v1/metrics/`, handlers.PostMetrics(app))
+			r.Put(`/api/v1/metrics/{mtype}/{name}`, handlers.PutMetric(app))
+			r.Patch(`/api/v1/metrics/{mtype}/{name}`, handlers.PatchMetric(app))
+
+			// legacy JSON API
+			r.Post(`/update/`, handlers.SetParamJSON(app))
+			r.Post(`/updates/`, handlers.SetMultiParamJSON(app))
+		})
 	})
 
-	// JSON API
+	// administration
 	r.Group(func(r chi.Router) {
-		r.Use(handlers.CheckContentType(app))
-		r.Post(`/value/`, handlers.GetParamJSON(app))
-		r.Post(`/update/`, handlers.SetParamJSON(app))
-		r.Post(`/updates/`, handlers.SetMultiParamJSON(app))
+		r.Use(handlers.RequireScope(app, auth.ScopeAdmin))
+
+		r.Get(`/admin/dump`, handlers.GetDumpStatus(app))
+		r.Post(`/admin/dump`, handlers.TriggerDump(app))
 	})
 
 	return r
@@ -0,0 +1,211 @@
+package router
+
+import (
+	"encoding/json"
+	"metrics-server/internal/api"
+	"metrics-server/internal/auth"
+	"metrics-server/internal/config"
+	"metrics-server/internal/ratelimit"
+	"metrics-server/internal/storage/memory"
+	"metrics-server/internal/usecase"
+	"metrics-server/internal/usecase/context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type spec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components map[string]map[string]json.RawMessage `json:"components"`
+}
+
+var operations = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true,
+	"options": true, "head": true, "patch": true, "trace": true,
+}
+
+func Test_RoutesMatchSpec(t *testing.T) {
+	var doc spec
+	require.NoError(t, json.Unmarshal(api.Spec, &doc))
+
+	documented := []string{}
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			if !operations[method] {
+				continue // parameters, summary and such of the path
+			}
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+
+	app := &context.AppContext{
+		DB:  memory.NewMemStorage(),
+		Log: zap.NewNop().Sugar(),
+		Cfg: &config.Config{},
+	}
+	routed := []string{}
+	err := chi.Walk(NewMultiplexer(app), func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		routed = append(routed, method+" "+route)
+		return nil
+	})
+	require.NoError(t, err)
+
+	sort.Strings(documented)
+	sort.Strings(routed)
+	assert.Equal(t, routed, documented, "openapi.json must describe exactly the routes of the router")
+}
+
+func Test_SpecRefsResolve(t *testing.T) {
+	var doc spec
+	require.NoError(t, json.Unmarshal(api.Spec, &doc))
+
+	var refs []string
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, item := range v {
+				if ref, ok := item.(string); ok && k == "$ref" {
+					refs = append(refs, ref)
+				}
+				walk(item)
+			}
+		case []any:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	var raw any
+	require.NoError(t, json.Unmarshal(api.Spec, &raw))
+	walk(raw)
+	require.NotEmpty(t, refs)
+
+	for _, ref := range refs {
+		parts := strings.Split(strings.TrimPrefix(ref, "#/components/"), "/")
+		require.Len(t, parts, 2, ref)
+		_, ok := doc.Components[parts[0]][parts[1]]
+		assert.True(t, ok, "unresolved %s", ref)
+	}
+}
+
+func Test_Scopes(t *testing.T) {
+	keys := auth.NewFileStore(filepath.Join(t.TempDir(), "keys.json"))
+	token := func(tenant string, scopes ...string) string {
+		token, key, err := auth.NewKey(tenant, scopes)
+		require.NoError(t, err)
+		require.NoError(t, keys.Create(key))
+		return token
+	}
+	reader := token(usecase.DefaultTenant, auth.ScopeRead)
+	writer := token("team-a", auth.ScopeWrite)
+	admin := token(usecase.DefaultTenant, auth.ScopeAdmin)
+
+	app := &context.AppContext{
+		DB:   memory.NewMemStorage(),
+		Log:  zap.NewNop().Sugar(),
+		Cfg:  &config.Config{},
+		Keys: keys,
+	}
+	r := NewMultiplexer(app)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		tenant string
+		code   int
+	}{
+		{name: "docs are open", method: http.MethodGet, target: "/openapi.json", code: 200},
+		{name: "no token", method: http.MethodGet, target: "/ping", code: 401},
+		{name: "bad token", method: http.MethodGet, target: "/values/", token: "nope", code: 401},
+		{name: "read", method: http.MethodGet, target: "/values/", token: reader, code: 200},
+		{name: "read cannot write", method: http.MethodPost, target: "/update/counter/c1/1", token: reader, code: 403},
+		{name: "write", method: http.MethodPost, target: "/update/counter/c1/1", token: writer, code: 200},
+		{name: "write to own tenant", method: http.MethodPost, target: "/update/counter/c1/1", token: writer, tenant: "team-a", code: 200},
+		{name: "write to other tenant", method: http.MethodPost, target: "/update/counter/c1/1", token: writer, tenant: "team-b", code: 403},
+		{name: "write cannot read", method: http.MethodGet, target: "/value/counter/c1", token: writer, code: 403},
+		{name: "read cannot dump", method: http.MethodGet, target: "/admin/dump", token: reader, code: 403},
+		{name: "admin reads", method: http.MethodGet, target: "/values/", token: admin, code: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.token != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.tenant != "" {
+				request.Header.Set("X-Tenant-ID", tt.tenant)
+			}
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.code, w.Code)
+			if tt.code == 401 {
+				assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// the writer has written to its own tenant only
+	_, err := app.DB.Tenant("team-a").Get(&usecase.Metric{ID: "c1", MType: "counter"})
+	assert.NoError(t, err)
+	_, err = app.DB.Get(&usecase.Metric{ID: "c1", MType: "counter"})
+	assert.ErrorIs(t, err, usecase.ErrNotFound)
+}
+
+// countingStore counts the lookups of tokens.
+type countingStore struct {
+	auth.Store
+	lookups int
+}
+
+func (s *countingStore) Lookup(hash string) (*auth.Key, error) {
+	s.lookups++
+	return s.Store.Lookup(hash)
+}
+
+func Test_RateLimitBeforeAuth(t *testing.T) {
+	keys := &countingStore{Store: auth.NewFileStore(filepath.Join(t.TempDir(), "keys.json"))}
+	token, key, err := auth.NewKey(usecase.DefaultTenant, []string{auth.ScopeRead})
+	require.NoError(t, err)
+	require.NoError(t, keys.Create(key))
+
+	app := &context.AppContext{
+		DB:     memory.NewMemStorage(),
+		Log:    zap.NewNop().Sugar(),
+		Cfg:    &config.Config{},
+		Keys:   keys,
+		Limits: ratelimit.New(0.001, 2),
+	}
+	r := NewMultiplexer(app)
+
+	get := func(remoteAddr, token string) int {
+		request := httptest.NewRequest(http.MethodGet, "/values/", nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		return w.Code
+	}
+
+	assert.Equal(t, 401, get("192.0.2.1:1", "bad"))
+	assert.Equal(t, 401, get("192.0.2.1:2", "bad"))
+	assert.Equal(t, 429, get("192.0.2.1:3", "bad"), "bad tokens are limited by address")
+	assert.Equal(t, 2, keys.lookups, "limited requests must not look keys up")
+
+	// a key is limited wherever it comes from
+	assert.Equal(t, 200, get("192.0.2.2:1", token))
+	assert.Equal(t, 200, get("192.0.2.3:1", token))
+	assert.Equal(t, 429, get("192.0.2.4:1", token))
+}
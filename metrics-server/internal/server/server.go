@@ -1,15 +1,54 @@
 package server
 
 import (
+	gocontext "context"
+	"errors"
 	"metrics-server/internal/router"
 	"metrics-server/internal/usecase/context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+const shutdownTimeout = 10 * time.Second
+
+// HTTPServer serves the API until SIGINT or SIGTERM is received.
 func HTTPServer(app *context.AppContext) {
-	err := http.ListenAndServe(app.Cfg.Addr, router.NewMultiplexer(app))
+	tlsConfig, err := NewTLSConfig(app.Cfg)
 	if err != nil {
 		app.Log.Fatalf("%v", err)
 		return
 	}
+
+	srv := &http.Server{
+		Addr:      app.Cfg.Addr,
+		Handler:   router.NewMultiplexer(app),
+		TLSConfig: tlsConfig,
+	}
+
+	ctx, stop := signal.NotifyContext(gocontext.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		app.Log.Infoln("Shutting down")
+		c, cancel := gocontext.WithTimeout(gocontext.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(c); err != nil {
+			app.Log.Errorln("Shutdown error:", err)
+		}
+	}()
+
+	if tlsConfig != nil {
+		app.Log.Infoln("Serving HTTPS on", srv.Addr)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		app.Log.Fatalf("%v", err)
+		return
+	}
 }
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"metrics-server/internal/config"
+	"metrics-server/internal/handlers"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCert is a certificate with its key, written as PEM files.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert issues a certificate signed by ca, self-signed if ca is nil.
+func newTestCert(t *testing.T, dir, cn string, ca *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, cn+".crt"),
+		keyFile:  filepath.Join(dir, cn+".key"),
+	}
+	require.NoError(t, os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return c
+}
+
+func Test_NewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "test-ca", nil)
+	srv := newTestCert(t, dir, "server", ca)
+
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "plain HTTP", wantNil: true},
+		{name: "TLS", cfg: config.Config{TLSCert: srv.certFile, TLSKey: srv.keyFile}},
+		{name: "mutual TLS", cfg: config.Config{TLSCert: srv.certFile, TLSKey: srv.keyFile, TLSClientCA: ca.certFile}},
+		{name: "no key", cfg: config.Config{TLSCert: srv.certFile}, wantErr: true},
+		{name: "client CA only", cfg: config.Config{TLSClientCA: ca.certFile}, wantErr: true},
+		{name: "bad CA", cfg: config.Config{TLSCert: srv.certFile, TLSKey: srv.keyFile, TLSClientCA: srv.keyFile}, wantErr: true},
+		{name: "absent file", cfg: config.Config{TLSCert: filepath.Join(dir, "absent"), TLSKey: srv.keyFile}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewTLSConfig(&tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantNil, got == nil)
+		})
+	}
+}
+
+func Test_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "test-ca", nil)
+	srvCert := newTestCert(t, dir, "server", ca)
+	agentCert := newTestCert(t, dir, "agent-1", ca)
+	otherCA := newTestCert(t, dir, "other-ca", nil)
+	strangerCert := newTestCert(t, dir, "stranger", otherCA)
+
+	tlsConfig, err := NewTLSConfig(&config.Config{TLSCert: srvCert.certFile, TLSKey: srvCert.keyFile, TLSClientCA: ca.certFile})
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, handlers.ClientIdentity(r))
+	}))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	client := func(c *testCert) *http.Client {
+		cfg := &tls.Config{RootCAs: roots}
+		if c != nil {
+			pair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+			require.NoError(t, err)
+			cfg.Certificates = []tls.Certificate{pair}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	}
+
+	res, err := client(agentCert).Get(ts.URL)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "agent-1", string(body), "CN is the identity of the agent")
+
+	_, err = client(nil).Get(ts.URL)
+	assert.Error(t, err, "client certificate is required")
+
+	_, err = client(strangerCert).Get(ts.URL)
+	assert.Error(t, err, "certificate of another CA is rejected")
+}
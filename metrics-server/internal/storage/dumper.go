@@ -1,13 +1,273 @@
 package storage
 
 import (
-	"metrics-server/internal/usecase/context"
+	"errors"
+	"fmt"
+	"metrics-server/internal/usecase"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
+
+	"go.uber.org/zap"
 )
 
-func Dumper(app *context.AppContext) {
-	for {
-		app.DB.Dump(app.Cfg.FileStoragePath)
-		time.Sleep(time.Duration(app.Cfg.StoreInterval) * time.Second)
+type DumpStatus struct {
+	Healthy      bool      `json:"healthy"`
+	LastDump     time.Time `json:"last_dump,omitzero"`
+	LastSize     int64     `json:"last_size"`
+	LastSnapshot string    `json:"last_snapshot,omitempty"`
+	LastSync     time.Time `json:"last_sync,omitzero"` // of the working dump
+	LastError    string    `json:"last_error,omitempty"`
+	LastErrorAt  time.Time `json:"last_error_at,omitzero"`
+	Dumps        int64     `json:"dumps"`
+	Failures     int64     `json:"failures"`
+}
+
+// Dumper saves snapshots of every tenant every interval, but only of the
+// tenants which have changed since their last successful dump. Without an
+// interval every update is stored by Sync.
+type Dumper struct {
+	db        usecase.Repositories // of the default tenant
+	snapshots *Snapshots           // of the default tenant
+	log       *zap.SugaredLogger
+	interval  time.Duration
+
+	// SnapshotEvery is the min time between the snapshots taken by Sync.
+	SnapshotEvery time.Duration
+
+	mu      sync.Mutex
+	tenants map[string]*tenantDump
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type tenantDump struct {
+	snapshots *Snapshots
+	version   uint64 // storage version saved by the last dump
+	synced    uint64 // storage version saved by the last Sync
+	status    DumpStatus
+}
+
+func NewDumper(db usecase.Repositories, snapshots *Snapshots, log *zap.SugaredLogger, interval time.Duration) *Dumper {
+	d := &Dumper{
+		db:        db,
+		snapshots: snapshots,
+		log:       log,
+		interval:  interval,
+		tenants:   make(map[string]*tenantDump),
+	}
+	// an untouched storage is not worth a snapshot
+	t := d.tenant(usecase.DefaultTenant)
+	t.version = db.Version()
+	t.synced = t.version
+	return d
+}
+
+// tenant returns the dump state of the tenant, d.mu must be held. A tenant
+// storage starts with version 0, so its changes made before are dumped.
+func (d *Dumper) tenant(id string) *tenantDump {
+	t, ok := d.tenants[id]
+	if !ok {
+		t = &tenantDump{
+			snapshots: d.snapshots.Tenant(id),
+			status:    DumpStatus{Healthy: true},
+		}
+		d.tenants[id] = t
+	}
+	return t
+}
+
+// Start runs periodic dumping in background, a zero interval disables it.
+func (d *Dumper) Start() {
+	if d.interval <= 0 || d.stop != nil {
+		return
+	}
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.DumpAll(false)
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends periodic dumping and saves the pending changes.
+func (d *Dumper) Stop() error {
+	if d.stop != nil {
+		close(d.stop)
+		<-d.done
+		d.stop = nil
+	}
+	return d.DumpAll(false)
+}
+
+// DumpAll saves snapshots of the dirty tenants, or of all if force is set.
+func (d *Dumper) DumpAll(force bool) error {
+	ids, err := d.db.Tenants()
+	if err != nil {
+		return fmt.Errorf("dump failed: %v", err)
+	}
+
+	var errs []error
+	for _, id := range ids {
+		if _, err := d.Dump(id, force); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %v", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Dump saves a snapshot of the tenant if it is dirty or force is set.
+func (d *Dumper) Dump(tenant string, force bool) (DumpStatus, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	db := d.db.Tenant(tenant)
+	version := db.Version()
+	if _, ok := d.tenants[tenant]; !ok && version == 0 {
+		// the tenant has stored nothing
+		return DumpStatus{Healthy: true}, nil
+	}
+
+	t := d.tenant(tenant)
+	if !force && version == t.version {
+		return t.status, nil
+	}
+	err := d.dump(tenant, t, db, version)
+	return t.status, err
+}
+
+// Sync replaces the working dump of the tenant if it is dirty. A snapshot
+// is saved as well once SnapshotEvery has passed since the previous one, so
+// a burst of updates does not push the older snapshots out of the history.
+func (d *Dumper) Sync(tenant string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	db := d.db.Tenant(tenant)
+	version := db.Version()
+	if _, ok := d.tenants[tenant]; !ok && version == 0 {
+		return nil
+	}
+
+	t := d.tenant(tenant)
+	if version == t.synced {
+		return nil
+	}
+
+	err := d.makeDir(tenant, t)
+	if err == nil {
+		err = t.snapshots.SaveWorking(db)
+	}
+	if err != nil {
+		d.fail(tenant, t, err)
+		return fmt.Errorf("dump failed: %v", err)
+	}
+	t.synced = version
+	t.status.LastSync = time.Now()
+
+	if version == t.version || time.Since(t.status.LastDump) < d.SnapshotEvery {
+		return nil
+	}
+	return d.dump(tenant, t, db, version)
+}
+
+// dump saves a snapshot of the tenant at version, d.mu must be held.
+func (d *Dumper) dump(tenant string, t *tenantDump, db usecase.Repositories, version uint64) error {
+	snapshot, err := d.save(tenant, t, db)
+	if err != nil {
+		d.fail(tenant, t, err)
+		return fmt.Errorf("dump failed: %v", err)
+	}
+
+	t.version = version
+	t.status.Healthy = true
+	t.status.LastDump = snapshot.Time
+	t.status.LastSize = snapshot.Size
+	t.status.LastSnapshot = snapshot.ID
+	t.status.Dumps++
+	d.log.Debugln("Dumped", tenant, "to", snapshot.Path, "size", snapshot.Size)
+	return nil
+}
+
+func (d *Dumper) fail(tenant string, t *tenantDump, err error) {
+	t.status.Healthy = false
+	t.status.LastError = err.Error()
+	t.status.LastErrorAt = time.Now()
+	t.status.Failures++
+	d.log.Errorln("Dump of", tenant, "failed:", err)
+}
+
+func (d *Dumper) save(tenant string, t *tenantDump, db usecase.Repositories) (*Snapshot, error) {
+	if err := d.makeDir(tenant, t); err != nil {
+		return nil, err
+	}
+	return t.snapshots.Save(db)
+}
+
+// makeDir creates the snapshot directory of the tenant: the one of the
+// default tenant is configured, the ones of other tenants are made on their
+// first dump.
+func (d *Dumper) makeDir(tenant string, t *tenantDump) error {
+	if tenant == usecase.DefaultTenant {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(t.snapshots.Path), 0755); err != nil {
+		return fmt.Errorf("cannot create snapshot directory: %v", err)
+	}
+	return nil
+}
+
+// Restore loads the selected snapshot of every tenant found on disk,
+// restored data is not dumped again until it changes. Tenants other than
+// the default one are skipped when they have no snapshot matching id.
+func (d *Dumper) Restore(id string) ([]*Snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tenants, err := d.snapshots.Tenants()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Snapshot
+	for _, tenant := range append([]string{usecase.DefaultTenant}, tenants...) {
+		t := d.tenant(tenant)
+		snapshot, err := t.snapshots.Restore(d.db.Tenant(tenant), id)
+		if tenant != usecase.DefaultTenant && errors.Is(err, ErrNoSnapshot) {
+			d.log.Warnln("Tenant", tenant, "is not restored:", err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot restore tenant %s: %v", tenant, err)
+		}
+		// the restored storage is kept by now
+		t.version = d.db.Tenant(tenant).Version()
+		t.synced = t.version
+		if snapshot != nil {
+			result = append(result, snapshot)
+		}
+	}
+	return result, nil
+}
+
+// Status returns the dump status of the tenant.
+func (d *Dumper) Status(tenant string) DumpStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.tenants[tenant]; ok {
+		return t.status
 	}
+	return DumpStatus{Healthy: true}
 }
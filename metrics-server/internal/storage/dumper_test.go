@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"metrics-server/internal/storage/memory"
+	"metrics-server/internal/usecase"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func Test_DumperDirtyTracking(t *testing.T) {
+	db := memory.NewMemStorage()
+	snapshots := &Snapshots{Path: filepath.Join(t.TempDir(), "metrics.dmp"), log: zap.NewNop().Sugar()}
+	d := NewDumper(db, snapshots, zap.NewNop().Sugar(), 0)
+
+	var delta int64 = 1
+	set := func() {
+		_, err := db.Set(&usecase.Metric{ID: "c1", MType: "counter", Delta: &delta})
+		require.NoError(t, err)
+	}
+
+	set()
+	status, err := d.Dump(usecase.DefaultTenant, false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), status.Dumps)
+	assert.True(t, status.Healthy)
+	assert.NotZero(t, status.LastSize)
+
+	status, err = d.Dump(usecase.DefaultTenant, false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), status.Dumps, "clean storage must not be dumped")
+
+	set()
+	require.NoError(t, d.Stop())
+	assert.Equal(t, int64(2), d.Status(usecase.DefaultTenant).Dumps, "pending changes must be dumped on stop")
+
+	status, err = d.Dump(usecase.DefaultTenant, true)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), status.Dumps)
+}
+
+func Test_DumperFailure(t *testing.T) {
+	snapshots := &Snapshots{Path: filepath.Join(t.TempDir(), "absent", "metrics.dmp"), log: zap.NewNop().Sugar()}
+	d := NewDumper(memory.NewMemStorage(), snapshots, zap.NewNop().Sugar(), 0)
+
+	status, err := d.Dump(usecase.DefaultTenant, true)
+	assert.Error(t, err)
+	assert.False(t, status.Healthy)
+	assert.Equal(t, int64(1), status.Failures)
+	assert.NotEmpty(t, status.LastError)
+}
+
+func Test_DumperTenants(t *testing.T) {
+	dir := t.TempDir()
+	snapshots := &Snapshots{Path: filepath.Join(dir, "metrics.dmp"), log: zap.NewNop().Sugar()}
+	db := memory.NewMemStorage()
+	d := NewDumper(db, snapshots, zap.NewNop().Sugar(), 0)
+
+	set := func(tenant string, delta int64) {
+		_, err := db.Tenant(tenant).Set(&usecase.Metric{ID: "c1", MType: "counter", Delta: &delta})
+		require.NoError(t, err)
+	}
+	set(usecase.DefaultTenant, 1)
+	set("team-a", 2)
+	require.NoError(t, d.Stop())
+
+	assert.Equal(t, int64(1), d.Status(usecase.DefaultTenant).Dumps)
+	assert.Equal(t, int64(1), d.Status("team-a").Dumps)
+	list, err := snapshots.Tenant("team-a").List()
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, filepath.Join(dir, "tenants", "team-a"), filepath.Dir(list[0].Path))
+
+	restored := memory.NewMemStorage()
+	result, err := NewDumper(restored, snapshots, zap.NewNop().Sugar(), 0).Restore("latest")
+	require.NoError(t, err)
+	assert.Len(t, result, 2)
+
+	for tenant, want := range map[string]int64{usecase.DefaultTenant: 1, "team-a": 2} {
+		m, err := restored.Tenant(tenant).Get(&usecase.Metric{ID: "c1", MType: "counter"})
+		require.NoError(t, err)
+		assert.Equal(t, want, *m.Delta, tenant)
+	}
+	_, err = restored.Tenant("team-b").Get(&usecase.Metric{ID: "c1", MType: "counter"})
+	assert.ErrorIs(t, err, usecase.ErrNotFound)
+}
+
+func Test_DumperSync(t *testing.T) {
+	db := memory.NewMemStorage()
+	snapshots := &Snapshots{Path: filepath.Join(t.TempDir(), "metrics.dmp"), log: zap.NewNop().Sugar()}
+	d := NewDumper(db, snapshots, zap.NewNop().Sugar(), 0)
+	d.SnapshotEvery = time.Hour
+
+	for range 20 {
+		var delta int64 = 1
+		_, err := db.Set(&usecase.Metric{ID: "c1", MType: "counter", Delta: &delta})
+		require.NoError(t, err)
+		require.NoError(t, d.Sync(usecase.DefaultTenant))
+	}
+
+	list, err := snapshots.List()
+	require.NoError(t, err)
+	assert.Len(t, list, 1, "updates within SnapshotEvery must not add snapshots")
+	assert.Equal(t, int64(1), d.Status(usecase.DefaultTenant).Dumps)
+	assert.NotZero(t, d.Status(usecase.DefaultTenant).LastSync)
+	assert.Equal(t, int64(20), restoredCounter(t, snapshots, "latest"), "the working dump is the newest")
+	assert.Equal(t, int64(1), restoredCounter(t, snapshots, list[0].ID))
+
+	d.SnapshotEvery = 0
+	var delta int64 = 1
+	_, err = db.Set(&usecase.Metric{ID: "c1", MType: "counter", Delta: &delta})
+	require.NoError(t, err)
+	require.NoError(t, d.Sync(usecase.DefaultTenant))
+	list, err = snapshots.List()
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+}
+
+func Test_DumperUnknownTenant(t *testing.T) {
+	dir := t.TempDir()
+	db := memory.NewMemStorage()
+	d := NewDumper(db, &Snapshots{Path: filepath.Join(dir, "metrics.dmp"), log: zap.NewNop().Sugar()}, zap.NewNop().Sugar(), 0)
+
+	assert.True(t, d.Status("ghost").Healthy)
+	_, err := d.Dump("ghost", true)
+	require.NoError(t, err)
+	require.NoError(t, d.Sync("ghost"))
+
+	assert.NoDirExists(t, filepath.Join(dir, "tenants", "ghost"))
+	assert.Len(t, d.tenants, 1, "only the default tenant has dump state")
+	tenants, err := db.Tenants()
+	require.NoError(t, err)
+	assert.Equal(t, []string{usecase.DefaultTenant}, tenants)
+}
@@ -2,11 +2,15 @@ package memory
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"log"
 	"metrics-server/internal/usecase"
-	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type MetricParam struct {
@@ -15,8 +19,19 @@ type MetricParam struct {
 	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
 }
 
+// MemStorage is the storage of the default tenant, the storages of other
+// tenants are kept by it from their first write on.
 type MemStorage struct {
-	Metrics map[string]MetricParam
+	Metrics    map[string]MetricParam
+	Limit      int // max number of metrics, 0 is unlimited
+	MaxTenants int // max number of tenants besides the default one, 0 is unlimited
+
+	mu      sync.RWMutex
+	version uint64
+	id      string                 // of the tenant
+	root    *MemStorage            // the default tenant, nil for itself
+	tenants map[string]*MemStorage // by tenant ID, kept by the root
+	kept    atomic.Bool            // the root keeps this storage
 }
 
 func NewMemStorage() *MemStorage {
@@ -25,64 +40,278 @@ func NewMemStorage() *MemStorage {
 	}
 }
 
+// Tenant returns the storage of the tenant, it inherits Limit. An unknown
+// tenant gets an empty storage which is kept from its first write on, so
+// reads do not make tenants.
+func (m *MemStorage) Tenant(id string) usecase.Repositories {
+	if m.root != nil {
+		return m.root.Tenant(id)
+	}
+	if id == usecase.DefaultTenant {
+		return m
+	}
+
+	m.mu.RLock()
+	t, ok := m.tenants[id]
+	m.mu.RUnlock()
+	if ok {
+		return t
+	}
+	return &MemStorage{
+		Metrics: make(map[string]MetricParam),
+		Limit:   m.Limit,
+		id:      id,
+		root:    m,
+	}
+}
+
+// keep returns the storage of the tenant which the root keeps, m itself if
+// it is the first to write.
+func (m *MemStorage) keep() (*MemStorage, error) {
+	if m.root == nil || m.kept.Load() {
+		return m, nil
+	}
+
+	root := m.root
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	if t, ok := root.tenants[m.id]; ok {
+		return t, nil
+	}
+	if root.MaxTenants > 0 && len(root.tenants) >= root.MaxTenants {
+		return nil, fmt.Errorf("%w: %d tenants", usecase.ErrTooManyTenants, root.MaxTenants)
+	}
+	if root.tenants == nil {
+		root.tenants = make(map[string]*MemStorage)
+	}
+	root.tenants[m.id] = m
+	m.kept.Store(true)
+	return m, nil
+}
+
+func (m *MemStorage) Tenants() ([]string, error) {
+	if m.root != nil {
+		return m.root.Tenants()
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := []string{usecase.DefaultTenant}
+	for id := range m.tenants {
+		result = append(result, id)
+	}
+	sort.Strings(result[1:])
+	return result, nil
+}
+
+// checkLimit fails if n new metrics do not fit in the limit.
+func (m *MemStorage) checkLimit(n int) error {
+	if m.Limit > 0 && n > 0 && len(m.Metrics)+n > m.Limit {
+		return fmt.Errorf("%w: %d metrics", usecase.ErrLimitExceeded, m.Limit)
+	}
+	return nil
+}
+
 func (m *MemStorage) Set(metric *usecase.Metric) (*usecase.Metric, error) {
+	m, err := m.keep()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	result := usecase.Metric{
-		ID:    metric.ID,
-		MType: metric.MType,
+	current, exists := m.Metrics[metric.ID]
+	if !exists {
+		if err := m.checkLimit(1); err != nil {
+			return nil, err
+		}
+	}
+	p, err := apply(current, exists, metric)
+	if err != nil {
+		return nil, err
 	}
 
-	switch metric.MType {
+	m.Metrics[metric.ID] = p
+	m.version++
+	return p.metric(metric.ID), nil
+}
 
-	case "gauge":
-		if _, ok := m.Metrics[metric.ID]; ok {
-			if m.Metrics[metric.ID].MType != "gauge" {
-				log.Printf("Value type changing is not enabled\n")
-				return nil, fmt.Errorf("value type changing is not enabled: %s", metric.MType)
+func (m *MemStorage) SetBatch(metrics []usecase.Metric, atomic bool) ([]usecase.BatchItem, error) {
+	m, err := m.keep()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// changes are staged aside, an atomic batch commits them only if all
+	// items succeed
+	staged := make(map[string]MetricParam)
+	result := make([]usecase.BatchItem, len(metrics))
+	failed := false
+	added := 0
+
+	for i := range metrics {
+		metric := &metrics[i]
+		current, exists := staged[metric.ID]
+		if !exists {
+			current, exists = m.Metrics[metric.ID]
+		}
+		if !exists {
+			if err := m.checkLimit(added + 1); err != nil {
+				result[i].Err = err
+				failed = true
+				continue
 			}
 		}
+
+		p, err := apply(current, exists, metric)
+		if err != nil {
+			result[i].Err = err
+			failed = true
+			continue
+		}
+		if !exists {
+			added++
+		}
+		staged[metric.ID] = p
+		result[i].Metric = p.metric(metric.ID)
+	}
+
+	if atomic && failed {
+		for i := range result {
+			if result[i].Err == nil {
+				result[i] = usecase.BatchItem{Err: usecase.ErrAborted}
+			}
+		}
+		return result, nil
+	}
+
+	for id, p := range staged {
+		m.Metrics[id] = p
+	}
+	if len(staged) > 0 {
+		m.version++
+	}
+	return result, nil
+}
+
+func (m *MemStorage) Update(metric *usecase.Metric) (*usecase.Metric, error) {
+	m, err := m.keep()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, exists := m.Metrics[metric.ID]
+	if !exists || current.MType != metric.MType {
+		return nil, fmt.Errorf("%s %w", metric.ID, usecase.ErrNotFound)
+	}
+	p, err := apply(current, true, metric)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Metrics[metric.ID] = p
+	m.version++
+	return p.metric(metric.ID), nil
+}
+
+func (m *MemStorage) Replace(metric *usecase.Metric) (*usecase.Metric, bool, error) {
+	m, err := m.keep()
+	if err != nil {
+		return nil, false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, exists := m.Metrics[metric.ID]
+	if exists && current.MType != metric.MType {
+		return nil, false, fmt.Errorf("%w: %s", usecase.ErrTypeMismatch, metric.MType)
+	}
+	if !exists {
+		if err := m.checkLimit(1); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// a replaced metric is stored as if it had not existed
+	p, err := apply(MetricParam{}, false, metric)
+	if err != nil {
+		return nil, false, err
+	}
+
+	m.Metrics[metric.ID] = p
+	m.version++
+	return p.metric(metric.ID), !exists, nil
+}
+
+func (m *MemStorage) Delete(metric *usecase.Metric) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, exists := m.Metrics[metric.ID]
+	if !exists || current.MType != metric.MType {
+		return fmt.Errorf("%s %w", metric.ID, usecase.ErrNotFound)
+	}
+
+	delete(m.Metrics, metric.ID)
+	m.version++
+	return nil
+}
+
+// apply returns the new state of a stored metric after the update.
+func apply(current MetricParam, exists bool, metric *usecase.Metric) (MetricParam, error) {
+	if exists && current.MType != metric.MType {
+		log.Printf("Value type changing is not enabled\n")
+		return MetricParam{}, fmt.Errorf("%w: %s", usecase.ErrTypeMismatch, metric.MType)
+	}
+
+	switch metric.MType {
+
+	case "gauge":
 		if metric.Value == nil {
 			log.Printf("Value is nil\n")
-			return nil, fmt.Errorf("value is nil")
+			return MetricParam{}, usecase.ErrNoValue
 		}
-
-		m.Metrics[metric.ID] = MetricParam{MType: "gauge", Value: metric.Value}
-		result.Value = m.Metrics[metric.ID].Value
+		return MetricParam{MType: "gauge", Value: metric.Value}, nil
 
 	case "counter":
-		if _, ok := m.Metrics[metric.ID]; !ok {
-			var initialDelta int64 = 0
-			m.Metrics[metric.ID] = MetricParam{MType: "counter", Delta: &initialDelta}
-		} else {
-			if m.Metrics[metric.ID].MType != "counter" {
-				log.Printf("Value type changing is not enabled\n")
-				return nil, fmt.Errorf("value type changing is not enabled: %s", metric.MType)
-			}
-		}
 		if metric.Delta == nil {
 			log.Printf("Delta is nil\n")
-			return nil, fmt.Errorf("delta is nil")
+			return MetricParam{}, fmt.Errorf("delta is nil: %w", usecase.ErrNoValue)
 		}
 
-		*m.Metrics[metric.ID].Delta += *metric.Delta
-		result.Delta = m.Metrics[metric.ID].Delta
+		// a new value is stored so that results and dumps do not race with updates
+		delta := *metric.Delta
+		if exists {
+			delta += *current.Delta
+		}
+		return MetricParam{MType: "counter", Delta: &delta}, nil
 
 	default:
 		log.Printf("Unsupported value kind\n")
-		return nil, fmt.Errorf("unsupported value kind: %s", metric.MType)
+		return MetricParam{}, fmt.Errorf("%w: %s", usecase.ErrUnsupportedType, metric.MType)
 	}
+}
 
-	return &result, nil
+func (p MetricParam) metric(id string) *usecase.Metric {
+	return &usecase.Metric{ID: id, MType: p.MType, Delta: p.Delta, Value: p.Value}
 }
 
 func (m *MemStorage) Get(metric *usecase.Metric) (*usecase.Metric, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	if _, ok := m.Metrics[metric.ID]; !ok {
-		return nil, fmt.Errorf("%s not found", metric.ID)
+		return nil, fmt.Errorf("%s %w", metric.ID, usecase.ErrNotFound)
 	}
 	if m.Metrics[metric.ID].MType != metric.MType {
 		log.Printf("Value type is wrong\n")
-		return nil, fmt.Errorf("value type is wrong: %s", metric.MType)
+		return nil, fmt.Errorf("value type is wrong: %s: %w", metric.MType, usecase.ErrNotFound)
 	}
 
 	switch metric.MType {
@@ -91,13 +320,16 @@ func (m *MemStorage) Get(metric *usecase.Metric) (*usecase.Metric, error) {
 	case "counter":
 		metric.Delta = m.Metrics[metric.ID].Delta
 	default:
-		return nil, fmt.Errorf("value %s has unsupported kind: %s", metric.ID, metric.MType)
+		return nil, fmt.Errorf("value %s has %w: %s", metric.ID, usecase.ErrUnsupportedType, metric.MType)
 	}
 
 	return metric, nil
 }
 
 func (m *MemStorage) GetAll() (*[]usecase.Metric, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	result := []usecase.Metric{}
 	for k, v := range m.Metrics {
 		result = append(result, usecase.Metric{
@@ -110,31 +342,159 @@ func (m *MemStorage) GetAll() (*[]usecase.Metric, error) {
 	return &result, nil
 }
 
-func (m *MemStorage) Dump(filepath string) error {
-	data, err := json.MarshalIndent(m.Metrics, "", "  ")
+func (m *MemStorage) List(query *usecase.ListQuery, fn func(m *usecase.Metric) error) (*usecase.Cursor, error) {
+	page, next := m.page(query)
+	for i := range page {
+		if err := fn(&page[i]); err != nil {
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+// page copies out the metrics of the page, so that they are streamed
+// without holding the lock.
+func (m *MemStorage) page(query *usecase.ListQuery) ([]usecase.Metric, *usecase.Cursor) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var matched []usecase.Metric
+	for id, p := range m.Metrics {
+		if (query.MType != "" && p.MType != query.MType) || !strings.HasPrefix(id, query.Prefix) {
+			continue
+		}
+		metric := usecase.Metric{ID: id, MType: p.MType, Delta: p.Delta, Value: p.Value}
+		if query.Cursor != nil && !query.Cursor.After(&metric, query.Sort) {
+			continue
+		}
+		matched = append(matched, metric)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return usecase.NewCursor(&matched[i], query.Sort).After(&matched[j], query.Sort)
+	})
+
+	if query.Limit > 0 && len(matched) > query.Limit {
+		matched = matched[:query.Limit]
+		return matched, usecase.NewCursor(&matched[len(matched)-1], query.Sort)
+	}
+	return matched, nil
+}
+
+func (m *MemStorage) Aggregate(query *usecase.AggregateQuery) (*usecase.AggregateResult, error) {
+	re, err := regexp.Compile(usecase.GlobToRegexp(query.Match))
 	if err != nil {
+		return nil, fmt.Errorf("bad match pattern %s: %v", query.Match, err)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := usecase.AggregateResult{Op: query.Op, Match: query.Match, MType: query.MType}
+	var matched []usecase.Metric
+	var sum, lowest, highest float64
+
+	for id, p := range m.Metrics {
+		if (query.MType != "" && p.MType != query.MType) || !re.MatchString(id) {
+			continue
+		}
+		metric := usecase.Metric{ID: id, MType: p.MType, Delta: p.Delta, Value: p.Value}
+		v, ok := metric.Number()
+		if !ok {
+			continue
+		}
+
+		if result.Count == 0 || v < lowest {
+			lowest = v
+		}
+		if result.Count == 0 || v > highest {
+			highest = v
+		}
+		sum += v
+		result.Count++
+
+		if query.Op == usecase.AggTopK {
+			matched = append(matched, metric)
+		}
+	}
+
+	if result.Count == 0 && (query.Op == usecase.AggAvg || query.Op == usecase.AggMin || query.Op == usecase.AggMax) {
+		return &result, nil
+	}
+
+	var value float64
+	switch query.Op {
+	case usecase.AggSum:
+		value = sum
+	case usecase.AggCount:
+		value = float64(result.Count)
+	case usecase.AggAvg:
+		value = sum / float64(result.Count)
+	case usecase.AggMin:
+		value = lowest
+	case usecase.AggMax:
+		value = highest
+	case usecase.AggTopK:
+		sort.Slice(matched, func(i, j int) bool {
+			vi, _ := matched[i].Number()
+			vj, _ := matched[j].Number()
+			if vi != vj {
+				return vi > vj
+			}
+			return matched[i].ID < matched[j].ID
+		})
+		if len(matched) > query.K {
+			matched = matched[:query.K]
+		}
+		result.Top = matched
+		return &result, nil
+	default:
+		return nil, fmt.Errorf("unsupported aggregation: %s", query.Op)
+	}
+
+	result.Value = &value
+	return &result, nil
+}
+
+func (m *MemStorage) Dump(w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m.Metrics); err != nil {
 		return fmt.Errorf("error in dump marshaller: %v", err)
 	}
-	return os.WriteFile(filepath, data, 0666)
+	return nil
 }
 
-func (m *MemStorage) Restore(filepath string) error {
-	var data []byte
-	var err error
-	data, err = os.ReadFile(filepath)
+func (m *MemStorage) Restore(r io.Reader) error {
+	// decode aside so that a broken dump does not leave partial data
+	metrics := make(map[string]MetricParam)
+	if err := json.NewDecoder(r).Decode(&metrics); err != nil {
+		return fmt.Errorf("cannot unmarshal data for restoration: %v", err)
+	}
+
+	m, err := m.keep()
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			log.Printf("File %s does not exist\n", filepath)
-			return nil
-		}
-		return fmt.Errorf("cannot read file %s for restoration: %v", filepath, err)
+		return err
 	}
-	if err = json.Unmarshal(data, &m.Metrics); err != nil {
-		return fmt.Errorf("cannot unmarshal file %s data for restoration: %v", filepath, err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, v := range metrics {
+		m.Metrics[k] = v
 	}
+	m.version++
 	return nil
 }
 
+func (m *MemStorage) Version() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.version
+}
+
 func (m *MemStorage) Ping() error {
 	return nil
 }
@@ -3,9 +3,12 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"metrics-server/internal/usecase"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -13,9 +16,16 @@ import (
 
 const table = "metrics"
 
+// PsqlStorage keeps the metrics of all tenants in one table, an instance
+// works with one tenant.
 type PsqlStorage struct {
 	DB              *sql.DB
 	BackOffSchedule *[]time.Duration
+	Limit           int // max number of metrics of a tenant, 0 is unlimited
+	MaxTenants      int // max number of tenants besides the default one, 0 is unlimited
+
+	tenant  string
+	version atomic.Uint64
 }
 
 var backoffSchedule = []time.Duration{
@@ -25,7 +35,7 @@ var backoffSchedule = []time.Duration{
 }
 
 func NewPsqlStorage(dsn string) (*PsqlStorage, error) {
-	p := PsqlStorage{BackOffSchedule: &backoffSchedule}
+	p := PsqlStorage{BackOffSchedule: &backoffSchedule, tenant: usecase.DefaultTenant}
 	var err error
 
 	p.DB, err = sql.Open("pgx", dsn)
@@ -40,82 +50,343 @@ func NewPsqlStorage(dsn string) (*PsqlStorage, error) {
 	return &p, nil
 }
 
-func (p *PsqlStorage) Migrate() error {
-	var err error
-	query := fmt.Sprintf(`
+// migrations are applied in order on every start, so they must be
+// idempotent. Tables made before tenants get the tenant column, and the
+// existing metrics go to the default tenant.
+var migrations = []string{
+	fmt.Sprintf(`
 	CREATE TABLE IF NOT EXISTS %s (
-		id VARCHAR(255) PRIMARY KEY,
+		tenant VARCHAR(64) NOT NULL DEFAULT '%s',
+		id VARCHAR(255) NOT NULL,
 		mtype VARCHAR(255) NOT NULL,
 		delta BIGINT NULL,
-		value FLOAT8 DEFAULT NULL)
-	`, table)
+		value FLOAT8 DEFAULT NULL,
+		PRIMARY KEY (tenant, id))
+	`, table, usecase.DefaultTenant),
+	fmt.Sprintf(`
+	ALTER TABLE %s ADD COLUMN IF NOT EXISTS tenant VARCHAR(64) NOT NULL DEFAULT '%s'
+	`, table, usecase.DefaultTenant),
+	fmt.Sprintf(`
+	DO $$
+	BEGIN
+		IF NOT EXISTS (
+			SELECT 1 FROM information_schema.key_column_usage
+			WHERE table_name = '%[1]s' AND constraint_name = '%[1]s_pkey' AND column_name = 'tenant'
+		) THEN
+			ALTER TABLE %[1]s DROP CONSTRAINT %[1]s_pkey, ADD PRIMARY KEY (tenant, id);
+		END IF;
+	END $$
+	`, table),
+}
 
-	for _, backoff := range *p.BackOffSchedule {
-		if _, err = p.DB.Exec(query); err == nil {
-			return nil
+func (p *PsqlStorage) Migrate() error {
+	for _, query := range migrations {
+		var err error
+		for _, backoff := range *p.BackOffSchedule {
+			if _, err = p.DB.Exec(query); err == nil {
+				break
+			}
+			time.Sleep(backoff)
 		}
-		time.Sleep(backoff)
+		if err != nil {
+			return fmt.Errorf("cannot migrate table %s: %s: %v", table, query, err)
+		}
+	}
+	return nil
+}
+
+// Tenant returns a storage of the tenant sharing the connection pool.
+func (p *PsqlStorage) Tenant(id string) usecase.Repositories {
+	if id == p.tenant {
+		return p
+	}
+	return &PsqlStorage{
+		DB:              p.DB,
+		BackOffSchedule: p.BackOffSchedule,
+		Limit:           p.Limit,
+		MaxTenants:      p.MaxTenants,
+		tenant:          id,
+	}
+}
+
+func (p *PsqlStorage) Tenants() ([]string, error) {
+	query := fmt.Sprintf("SELECT DISTINCT tenant FROM %s ORDER BY tenant", table)
+
+	rows, err := p.DB.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error in query for tenants: %v", err)
+	}
+	defer rows.Close()
+
+	result := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("cannot process a row: %v", err)
+		}
+		result = append(result, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot process all rows: %v", err)
+	}
+	return result, nil
+}
+
+// checkLimit fails for a new metric of a tenant which has Limit metrics, or
+// for the first metric of a tenant when there are MaxTenants tenants.
+// Concurrent inserts may overshoot the limits slightly.
+func (p *PsqlStorage) checkLimit(q querier, id string) error {
+	checkTenants := p.MaxTenants > 0 && p.tenant != usecase.DefaultTenant
+	if p.Limit <= 0 && !checkTenants {
+		return nil
+	}
+
+	query := fmt.Sprintf(`
+	SELECT EXISTS (SELECT 1 FROM %[1]s WHERE tenant = $1 AND id = $2),
+		(SELECT COUNT(*) FROM %[1]s WHERE tenant = $1)`, table)
+
+	var exists bool
+	var count int
+	if err := q.QueryRow(query, p.tenant, id).Scan(&exists, &count); err != nil {
+		return fmt.Errorf("cannot count metrics: %v", err)
+	}
+	if !exists && p.Limit > 0 && count >= p.Limit {
+		return fmt.Errorf("%w: %d metrics", usecase.ErrLimitExceeded, p.Limit)
 	}
+	if count > 0 || !checkTenants {
+		return nil
+	}
+
+	query = fmt.Sprintf("SELECT COUNT(DISTINCT tenant) FROM %s WHERE tenant <> $1", table)
+	var tenants int
+	if err := q.QueryRow(query, usecase.DefaultTenant).Scan(&tenants); err != nil {
+		return fmt.Errorf("cannot count tenants: %v", err)
+	}
+	if tenants >= p.MaxTenants {
+		return fmt.Errorf("%w: %d tenants", usecase.ErrTooManyTenants, p.MaxTenants)
+	}
+	return nil
+}
 
-	return fmt.Errorf("cannot create table %s: %v", query, err)
+// querier is either the database or a transaction.
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
 }
 
 func (p *PsqlStorage) Set(metric *usecase.Metric) (*usecase.Metric, error) {
-	var err error
+	result, err := p.set(p.DB, metric)
+	if err != nil {
+		return nil, err
+	}
+	p.version.Add(1)
+	return result, nil
+}
+
+func (p *PsqlStorage) SetBatch(metrics []usecase.Metric, atomic bool) ([]usecase.BatchItem, error) {
+	result := make([]usecase.BatchItem, len(metrics))
 
-	result, err := p.Get(metric)
+	if !atomic {
+		for i := range metrics {
+			result[i].Metric, result[i].Err = p.Set(&metrics[i])
+		}
+		return result, nil
+	}
+
+	tx, err := p.DB.Begin()
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			result = &usecase.Metric{
-				ID:    metric.ID,
-				MType: metric.MType,
-			}
-			if metric.MType == "counter" {
-				var initialDelta int64 = 0
-				result.Delta = &initialDelta
+		return nil, fmt.Errorf("cannot begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	failed := false
+	for i := range metrics {
+		result[i].Metric, result[i].Err = p.set(tx, &metrics[i])
+		if result[i].Err != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		for i := range result {
+			if result[i].Err == nil {
+				result[i] = usecase.BatchItem{Err: usecase.ErrAborted}
 			}
-		} else {
-			return nil, fmt.Errorf("cannot check metric: %v", err)
 		}
+		return result, nil
 	}
 
-	if metric.MType != result.MType {
-		return nil, fmt.Errorf("value type changing is not enabled: %s", metric.MType)
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("cannot commit transaction: %v", err)
 	}
+	p.version.Add(1)
+	return result, nil
+}
 
-	switch metric.MType {
+// set upserts the metric in one statement, a counter is increased by the
+// database, so that concurrent updates are not lost. A type conflict
+// leaves the row untouched and returns nothing.
+func (p *PsqlStorage) set(q querier, metric *usecase.Metric) (*usecase.Metric, error) {
+	var query string
+	var arg any
 
+	switch metric.MType {
 	case "gauge":
+		if metric.Value == nil {
+			return nil, usecase.ErrNoValue
+		}
+		arg = *metric.Value
+		query = fmt.Sprintf(`
+		INSERT INTO %s (id, mtype, value, tenant) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant, id)
+		DO UPDATE SET value = EXCLUDED.value WHERE %[1]s.mtype = EXCLUDED.mtype
+		RETURNING delta, value`, table)
+	case "counter":
+		if metric.Delta == nil {
+			return nil, fmt.Errorf("delta is nil: %w", usecase.ErrNoValue)
+		}
+		arg = *metric.Delta
+		query = fmt.Sprintf(`
+		INSERT INTO %s (id, mtype, delta, tenant) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant, id)
+		DO UPDATE SET delta = %[1]s.delta + EXCLUDED.delta WHERE %[1]s.mtype = EXCLUDED.mtype
+		RETURNING delta, value`, table)
+	default:
+		return nil, fmt.Errorf("%w: %s", usecase.ErrUnsupportedType, metric.MType)
+	}
 
-		result.Value = metric.Value
-
-		query := fmt.Sprintf(`
-		INSERT INTO %s (id, mtype, value) VALUES ($1, $2, $3)
-		ON CONFLICT (id)
-		DO UPDATE SET value = $3`, table)
+	if err := p.checkLimit(q, metric.ID); err != nil {
+		return nil, err
+	}
 
-		if _, err := p.DB.Exec(query, result.ID, result.MType, *result.Value); err == nil {
-			return result, nil
-		}
+	var delta sql.NullInt64
+	var value sql.NullFloat64
+	err := q.QueryRow(query, metric.ID, metric.MType, arg, p.tenant).Scan(&delta, &value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", usecase.ErrTypeMismatch, metric.MType)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("cannot set value: %v", err)
+	}
+
+	result := usecase.Metric{ID: metric.ID, MType: metric.MType}
+	if delta.Valid {
+		result.Delta = &delta.Int64
+	}
+	if value.Valid {
+		result.Value = &value.Float64
+	}
+	return &result, nil
+}
+
+// Update changes the row of the metric in one statement, so a concurrent
+// delete cannot be undone by it.
+func (p *PsqlStorage) Update(metric *usecase.Metric) (*usecase.Metric, error) {
+	var query string
+	var arg any
 
+	switch metric.MType {
+	case "gauge":
+		if metric.Value == nil {
+			return nil, usecase.ErrNoValue
+		}
+		arg = *metric.Value
+		query = fmt.Sprintf(`
+		UPDATE %s SET value = $3 WHERE id = $1 AND mtype = $2 AND tenant = $4
+		RETURNING delta, value`, table)
 	case "counter":
+		if metric.Delta == nil {
+			return nil, fmt.Errorf("delta is nil: %w", usecase.ErrNoValue)
+		}
+		arg = *metric.Delta
+		query = fmt.Sprintf(`
+		UPDATE %s SET delta = delta + $3 WHERE id = $1 AND mtype = $2 AND tenant = $4
+		RETURNING delta, value`, table)
+	default:
+		return nil, fmt.Errorf("%w: %s", usecase.ErrUnsupportedType, metric.MType)
+	}
 
-		*result.Delta += *metric.Delta
+	var delta sql.NullInt64
+	var value sql.NullFloat64
+	err := p.DB.QueryRow(query, metric.ID, metric.MType, arg, p.tenant).Scan(&delta, &value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s %w", metric.ID, usecase.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot update value: %v", err)
+	}
 
-		query := fmt.Sprintf(`
-		INSERT INTO %s (id, mtype, delta) VALUES ($1, $2, $3)
-		ON CONFLICT (id)
-		DO UPDATE SET delta = $3`, table)
+	p.version.Add(1)
+	result := usecase.Metric{ID: metric.ID, MType: metric.MType}
+	if delta.Valid {
+		result.Delta = &delta.Int64
+	}
+	if value.Valid {
+		result.Value = &value.Float64
+	}
+	return &result, nil
+}
 
-		if _, err := p.DB.Exec(query, result.ID, result.MType, *result.Delta); err == nil {
-			return result, nil
-		}
-		return nil, fmt.Errorf("cannot set delta: %v", err)
+func (p *PsqlStorage) Replace(metric *usecase.Metric) (*usecase.Metric, bool, error) {
+	var delta, value any
 
+	switch metric.MType {
+	case "gauge":
+		if metric.Value == nil {
+			return nil, false, usecase.ErrNoValue
+		}
+		value = *metric.Value
+	case "counter":
+		if metric.Delta == nil {
+			return nil, false, fmt.Errorf("delta is nil: %w", usecase.ErrNoValue)
+		}
+		delta = *metric.Delta
 	default:
-		return nil, fmt.Errorf("unsupported value kind: %s", metric.MType)
+		return nil, false, fmt.Errorf("%w: %s", usecase.ErrUnsupportedType, metric.MType)
+	}
+
+	// xmax is zero for a row inserted by this statement
+	query := fmt.Sprintf(`
+	INSERT INTO %s (id, mtype, delta, value, tenant) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (tenant, id)
+	DO UPDATE SET delta = EXCLUDED.delta, value = EXCLUDED.value WHERE %[1]s.mtype = EXCLUDED.mtype
+	RETURNING xmax = 0`, table)
+
+	if err := p.checkLimit(p.DB, metric.ID); err != nil {
+		return nil, false, err
+	}
+
+	var created bool
+	err := p.DB.QueryRow(query, metric.ID, metric.MType, delta, value, p.tenant).Scan(&created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, fmt.Errorf("%w: %s", usecase.ErrTypeMismatch, metric.MType)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot replace value: %v", err)
+	}
+
+	p.version.Add(1)
+	result := usecase.Metric{ID: metric.ID, MType: metric.MType, Delta: metric.Delta, Value: metric.Value}
+	return &result, created, nil
+}
+
+func (p *PsqlStorage) Delete(metric *usecase.Metric) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1 AND mtype = $2 AND tenant = $3", table)
+
+	result, err := p.DB.Exec(query, metric.ID, metric.MType, p.tenant)
+	if err != nil {
+		return fmt.Errorf("cannot delete value: %v", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cannot delete value: %v", err)
 	}
+	if n == 0 {
+		return fmt.Errorf("%s %w", metric.ID, usecase.ErrNotFound)
+	}
+
+	p.version.Add(1)
+	return nil
 }
 
 func (p *PsqlStorage) Get(metric *usecase.Metric) (*usecase.Metric, error) {
@@ -131,34 +402,34 @@ func (p *PsqlStorage) Get(metric *usecase.Metric) (*usecase.Metric, error) {
 
 	case "gauge":
 		result.Value = &value
-		query := fmt.Sprintf("SELECT value FROM %s WHERE id = $1 AND mtype = $2", table)
+		query := fmt.Sprintf("SELECT value FROM %s WHERE id = $1 AND mtype = $2 AND tenant = $3", table)
 
-		row := p.DB.QueryRow(query, metric.ID, metric.MType)
+		row := p.DB.QueryRow(query, metric.ID, metric.MType, p.tenant)
 		err = row.Scan(result.Value)
 		if err == nil {
 			return &result, nil
 		} else {
 			if err == sql.ErrNoRows {
-				return nil, fmt.Errorf("%s not found", metric.ID)
+				return nil, fmt.Errorf("%s %w", metric.ID, usecase.ErrNotFound)
 			}
 		}
 		return nil, fmt.Errorf("sql query error: %v", err)
 	case "counter":
 		result.Delta = &delta
-		query := fmt.Sprintf("SELECT delta FROM %s WHERE id = $1 AND mtype = $2", table)
+		query := fmt.Sprintf("SELECT delta FROM %s WHERE id = $1 AND mtype = $2 AND tenant = $3", table)
 
-		row := p.DB.QueryRow(query, metric.ID, metric.MType)
+		row := p.DB.QueryRow(query, metric.ID, metric.MType, p.tenant)
 		err = row.Scan(result.Delta)
 		if err == nil {
 			return &result, nil
 		} else {
 			if err == sql.ErrNoRows {
-				return nil, fmt.Errorf("%s not found", metric.ID)
+				return nil, fmt.Errorf("%s %w", metric.ID, usecase.ErrNotFound)
 			}
 		}
 		return nil, fmt.Errorf("sql query error: %v", err)
 	default:
-		return nil, fmt.Errorf("unsupported value kind: %s", metric.MType)
+		return nil, fmt.Errorf("%w: %s", usecase.ErrUnsupportedType, metric.MType)
 	}
 }
 
@@ -167,24 +438,21 @@ func (p *PsqlStorage) GetAll() (*[]usecase.Metric, error) {
 	var rows *sql.Rows
 	result := []usecase.Metric{}
 
-	query := fmt.Sprintf("SELECT id, mtype, delta, value FROM %s", table)
+	query := fmt.Sprintf("SELECT id, mtype, delta, value FROM %s WHERE tenant = $1", table)
 
-	rows, err = p.DB.Query(query)
+	rows, err = p.DB.Query(query, p.tenant)
 	if err != nil {
 		return nil, fmt.Errorf("error in query for all metrics: %v", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var id string
-		var mtype string
-		var delta int64
-		var value float64
-		if err := rows.Scan(&id, &mtype, &delta, &value); err != nil {
+		m, err := scanMetric(rows)
+		if err != nil {
 			return nil, fmt.Errorf("cannot process a row: %v", err)
 		}
 
-		result = append(result, usecase.Metric{ID: id, MType: mtype, Delta: &delta, Value: &value})
+		result = append(result, *m)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("cannot process all rows: %v", err)
@@ -193,16 +461,160 @@ func (p *PsqlStorage) GetAll() (*[]usecase.Metric, error) {
 	return &result, nil
 }
 
-func (p *PsqlStorage) Dump(filepath string) error {
+// List orders IDs bytewise like the in-memory storage does.
+func (p *PsqlStorage) List(query *usecase.ListQuery, fn func(m *usecase.Metric) error) (*usecase.Cursor, error) {
+	conditions := []string{"tenant = $1", `id LIKE $2 ESCAPE '\'`, "($3 = '' OR mtype = $3)"}
+	args := []any{p.tenant, likePrefix(query.Prefix), query.MType}
+
+	order := `id COLLATE "C"`
+	if query.Sort == usecase.SortByValue {
+		order = numberColumn + `, id COLLATE "C"`
+	}
+
+	if query.Cursor != nil {
+		if query.Sort == usecase.SortByValue {
+			conditions = append(conditions, fmt.Sprintf(`(%s, id COLLATE "C") > ($4, $5)`, numberColumn))
+			args = append(args, query.Cursor.Value, query.Cursor.ID)
+		} else {
+			conditions = append(conditions, `id COLLATE "C" > $4`)
+			args = append(args, query.Cursor.ID)
+		}
+	}
+
+	q := fmt.Sprintf("SELECT id, mtype, delta, value FROM %s WHERE %s ORDER BY %s",
+		table, strings.Join(conditions, " AND "), order)
+	if query.Limit > 0 {
+		// one more row tells whether there is a next page
+		q += fmt.Sprintf(" LIMIT %d", query.Limit+1)
+	}
+
+	rows, err := p.DB.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error in query for metrics: %v", err)
+	}
+	defer rows.Close()
+
+	var last *usecase.Metric
+	for n := 0; rows.Next(); n++ {
+		if query.Limit > 0 && n == query.Limit {
+			return usecase.NewCursor(last, query.Sort), nil
+		}
+		last, err = scanMetric(rows)
+		if err != nil {
+			return nil, fmt.Errorf("cannot process a row: %v", err)
+		}
+		if err := fn(last); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot process all rows: %v", err)
+	}
+
+	return nil, nil
+}
+
+// likePrefix makes a LIKE pattern matching strings with the prefix.
+func likePrefix(prefix string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(prefix) + "%"
+}
+
+var aggregateFunctions = map[string]string{
+	usecase.AggSum:   "COALESCE(SUM(%s), 0)",
+	usecase.AggAvg:   "AVG(%s)",
+	usecase.AggMin:   "MIN(%s)",
+	usecase.AggMax:   "MAX(%s)",
+	usecase.AggCount: "COUNT(%s)",
+}
+
+// numberColumn is the value of a gauge or a counter as float.
+const numberColumn = "COALESCE(value, delta::FLOAT8)"
+
+func (p *PsqlStorage) Aggregate(query *usecase.AggregateQuery) (*usecase.AggregateResult, error) {
+	result := usecase.AggregateResult{Op: query.Op, Match: query.Match, MType: query.MType}
+	where := "tenant = $1 AND id ~ $2 AND ($3 = '' OR mtype = $3)"
+	pattern := usecase.GlobToRegexp(query.Match)
+
+	if query.Op == usecase.AggTopK {
+		q := fmt.Sprintf(`
+		SELECT id, mtype, delta, value FROM %s WHERE %s
+		ORDER BY %s DESC, id COLLATE "C" LIMIT $4`, table, where, numberColumn)
+
+		rows, err := p.DB.Query(q, p.tenant, pattern, query.MType, query.K)
+		if err != nil {
+			return nil, fmt.Errorf("error in aggregation query: %v", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			m, err := scanMetric(rows)
+			if err != nil {
+				return nil, fmt.Errorf("cannot process a row: %v", err)
+			}
+			result.Top = append(result.Top, *m)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("cannot process all rows: %v", err)
+		}
+
+		// topk reports the number of all matched metrics like other operations
+		q = fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", table, where)
+		if err := p.DB.QueryRow(q, p.tenant, pattern, query.MType).Scan(&result.Count); err != nil {
+			return nil, fmt.Errorf("error in aggregation query: %v", err)
+		}
+		return &result, nil
+	}
+
+	function, ok := aggregateFunctions[query.Op]
+	if !ok {
+		return nil, fmt.Errorf("unsupported aggregation: %s", query.Op)
+	}
+
+	var value sql.NullFloat64
+	q := fmt.Sprintf("SELECT COUNT(*), %s FROM %s WHERE %s", fmt.Sprintf(function, numberColumn), table, where)
+	if err := p.DB.QueryRow(q, p.tenant, pattern, query.MType).Scan(&result.Count, &value); err != nil {
+		return nil, fmt.Errorf("error in aggregation query: %v", err)
+	}
+	if value.Valid {
+		result.Value = &value.Float64
+	}
+
+	return &result, nil
+}
+
+// scanMetric reads id, mtype, delta and value columns of a row.
+func scanMetric(rows *sql.Rows) (*usecase.Metric, error) {
+	var m usecase.Metric
+	var delta sql.NullInt64
+	var value sql.NullFloat64
+	if err := rows.Scan(&m.ID, &m.MType, &delta, &value); err != nil {
+		return nil, err
+	}
+	if delta.Valid {
+		m.Delta = &delta.Int64
+	}
+	if value.Valid {
+		m.Value = &value.Float64
+	}
+	return &m, nil
+}
+
+func (p *PsqlStorage) Dump(w io.Writer) error {
 	// not implemented
 	return nil
 }
 
-func (p *PsqlStorage) Restore(filepath string) error {
+func (p *PsqlStorage) Restore(r io.Reader) error {
 	// not implemented
 	return nil
 }
 
+// Version counts the changes made through this instance only.
+func (p *PsqlStorage) Version() uint64 {
+	return p.version.Load()
+}
+
 func (p *PsqlStorage) Ping() error {
 	var err error
 	for _, backoff := range *p.BackOffSchedule {
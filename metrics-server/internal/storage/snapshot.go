@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"metrics-server/internal/config"
+	"metrics-server/internal/usecase"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// snapshotLayout is the UTC timestamp used as snapshot ID and file name part.
+const snapshotLayout = "20060102T150405.000Z"
+
+const snapshotExt = ".gz"
+
+// tenantsDir keeps the snapshots of tenants other than the default one:
+// metrics.dmp -> tenants/<tenant>/metrics.dmp.20261019T120000.123Z.gz
+const tenantsDir = "tenants"
+
+var ErrNoSnapshot = errors.New("snapshot not found")
+
+// Snapshots keeps a rotating history of compressed dumps next to Path:
+// metrics.dmp -> metrics.dmp.20261019T120000.123Z.gz
+// Path itself is the working dump, a plain one rewritten on every update
+// when updates are stored synchronously.
+type Snapshots struct {
+	Path   string
+	Keep   int           // number of snapshots to keep, 0 keeps all
+	MaxAge time.Duration // snapshots older than this are removed, 0 disables
+	log    *zap.SugaredLogger
+}
+
+type Snapshot struct {
+	ID   string
+	Path string
+	Time time.Time
+	Size int64
+}
+
+func NewSnapshots(cfg *config.Config, log *zap.SugaredLogger) *Snapshots {
+	return &Snapshots{
+		Path:   cfg.FileStoragePath,
+		Keep:   cfg.SnapshotKeep,
+		MaxAge: cfg.SnapshotMaxAge,
+		log:    log,
+	}
+}
+
+// Tenant returns the snapshots of the tenant.
+func (s *Snapshots) Tenant(id string) *Snapshots {
+	if id == usecase.DefaultTenant {
+		return s
+	}
+	return &Snapshots{
+		Path:   filepath.Join(filepath.Dir(s.Path), tenantsDir, id, filepath.Base(s.Path)),
+		Keep:   s.Keep,
+		MaxAge: s.MaxAge,
+		log:    s.log,
+	}
+}
+
+// Tenants lists the tenants other than the default one which have a
+// snapshot directory.
+func (s *Snapshots) Tenants() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(filepath.Dir(s.Path), tenantsDir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot list tenants: %v", err)
+	}
+
+	var result []string
+	for _, e := range entries {
+		if e.IsDir() && usecase.ValidateTenant(e.Name()) == nil && e.Name() != usecase.DefaultTenant {
+			result = append(result, e.Name())
+		}
+	}
+	return result, nil
+}
+
+// Save writes a new snapshot of db and removes the expired ones.
+func (s *Snapshots) Save(db usecase.Repositories) (*Snapshot, error) {
+	now := time.Now().UTC()
+	id := now.Format(snapshotLayout)
+	path := s.Path + "." + id + snapshotExt
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create snapshot file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gw := gzip.NewWriter(tmp)
+	if err := db.Dump(gw); err != nil {
+		return nil, fmt.Errorf("cannot dump storage: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("cannot compress snapshot: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, fmt.Errorf("cannot sync snapshot file: %v", err)
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat snapshot file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("cannot close snapshot file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("cannot rename snapshot file: %v", err)
+	}
+
+	if err := s.prune(now); err != nil {
+		s.log.Errorln("Cannot prune snapshots:", err)
+	}
+
+	return &Snapshot{ID: id, Path: path, Time: now, Size: info.Size()}, nil
+}
+
+// SaveWorking replaces the working dump with the content of db.
+func (s *Snapshots) SaveWorking(db usecase.Repositories) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("cannot create dump file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := db.Dump(tmp); err != nil {
+		return fmt.Errorf("cannot dump storage: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("cannot sync dump file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot close dump file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("cannot rename dump file: %v", err)
+	}
+	return nil
+}
+
+// List returns the existing snapshots, newest first.
+func (s *Snapshots) List() ([]Snapshot, error) {
+	prefix := filepath.Base(s.Path) + "."
+	entries, err := os.ReadDir(filepath.Dir(s.Path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot list snapshots: %v", err)
+	}
+
+	var result []Snapshot
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, snapshotExt) {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(name, prefix), snapshotExt)
+		t, err := time.Parse(snapshotLayout, id)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		result = append(result, Snapshot{
+			ID:   id,
+			Path: filepath.Join(filepath.Dir(s.Path), name),
+			Time: t,
+			Size: info.Size(),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.After(result[j].Time) })
+	return result, nil
+}
+
+// Restore loads db from the snapshot selected by id: "latest" or a timestamp
+// prefix, the newest matching snapshot wins. For "latest" the working dump
+// comes first when it is newer than the snapshots, and broken dumps are
+// skipped in favor of older ones.
+func (s *Snapshots) Restore(db usecase.Repositories, id string) (*Snapshot, error) {
+	list, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	if id == "" || id == config.LatestSnapshot {
+		working, err := s.working()
+		if err != nil {
+			return nil, err
+		}
+		if working != nil {
+			// snapshots are listed newest first
+			i := sort.Search(len(list), func(i int) bool { return !list[i].Time.After(working.Time) })
+			list = slices.Insert(list, i, *working)
+		}
+
+		var workingErr error
+		for i := range list {
+			if err := s.load(db, &list[i]); err != nil {
+				s.log.Warnln("Snapshot", list[i].ID, "is not restored:", err)
+				if list[i].Path == s.Path {
+					workingErr = err
+				}
+				continue
+			}
+			return &list[i], nil
+		}
+		if workingErr != nil {
+			return nil, fmt.Errorf("cannot restore file %s: %v", s.Path, workingErr)
+		}
+		s.log.Infoln("No snapshots of", s.Path, "found")
+		return nil, nil
+	}
+
+	for i := range list {
+		if strings.HasPrefix(list[i].ID, id) {
+			if err := s.load(db, &list[i]); err != nil {
+				return nil, fmt.Errorf("cannot restore snapshot %s: %v", list[i].ID, err)
+			}
+			return &list[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoSnapshot, id)
+}
+
+// load reads a snapshot, or the plain working dump.
+func (s *Snapshots) load(db usecase.Repositories, snapshot *Snapshot) error {
+	f, err := os.Open(snapshot.Path)
+	if err != nil {
+		return fmt.Errorf("cannot open file %s: %v", snapshot.Path, err)
+	}
+	defer f.Close()
+
+	if snapshot.Path == s.Path {
+		return db.Restore(f)
+	}
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("cannot decompress file %s: %v", snapshot.Path, err)
+	}
+	defer gr.Close()
+
+	return db.Restore(gr)
+}
+
+// working returns the working dump, nil if there is none.
+func (s *Snapshots) working() (*Snapshot, error) {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read file %s for restoration: %v", s.Path, err)
+	}
+	return &Snapshot{ID: filepath.Base(s.Path), Path: s.Path, Time: info.ModTime().UTC(), Size: info.Size()}, nil
+}
+
+// prune removes snapshots beyond Keep and older than MaxAge, the newest one
+// always stays.
+func (s *Snapshots) prune(now time.Time) error {
+	list, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i, snapshot := range list {
+		if i == 0 {
+			continue
+		}
+		expired := s.MaxAge > 0 && now.Sub(snapshot.Time) > s.MaxAge
+		if (s.Keep > 0 && i >= s.Keep) || expired {
+			if err := os.Remove(snapshot.Path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
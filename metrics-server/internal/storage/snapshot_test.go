@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"metrics-server/internal/storage/memory"
+	"metrics-server/internal/usecase"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func saveCounter(t *testing.T, s *Snapshots, delta int64) *Snapshot {
+	db := memory.NewMemStorage()
+	_, err := db.Set(&usecase.Metric{ID: "c1", MType: "counter", Delta: &delta})
+	require.NoError(t, err)
+
+	snapshot, err := s.Save(db)
+	require.NoError(t, err)
+	// snapshot IDs have millisecond resolution
+	time.Sleep(2 * time.Millisecond)
+	return snapshot
+}
+
+func restoredCounter(t *testing.T, s *Snapshots, id string) int64 {
+	db := memory.NewMemStorage()
+	_, err := s.Restore(db, id)
+	require.NoError(t, err)
+
+	m, err := db.Get(&usecase.Metric{ID: "c1", MType: "counter"})
+	require.NoError(t, err)
+	return *m.Delta
+}
+
+func Test_SnapshotsRotation(t *testing.T) {
+	s := &Snapshots{Path: filepath.Join(t.TempDir(), "metrics.dmp"), Keep: 2, log: zap.NewNop().Sugar()}
+
+	saveCounter(t, s, 1)
+	second := saveCounter(t, s, 2)
+	saveCounter(t, s, 3)
+
+	list, err := s.List()
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, second.ID, list[1].ID)
+
+	assert.Equal(t, int64(3), restoredCounter(t, s, "latest"))
+	assert.Equal(t, int64(2), restoredCounter(t, s, second.ID))
+}
+
+func Test_SnapshotsMaxAge(t *testing.T) {
+	s := &Snapshots{Path: filepath.Join(t.TempDir(), "metrics.dmp"), MaxAge: time.Millisecond, log: zap.NewNop().Sugar()}
+
+	saveCounter(t, s, 1)
+	saveCounter(t, s, 2)
+
+	list, err := s.List()
+	require.NoError(t, err)
+	assert.Len(t, list, 1, "the newest snapshot must stay")
+}
+
+func Test_SnapshotsRestoreSkipsBroken(t *testing.T) {
+	s := &Snapshots{Path: filepath.Join(t.TempDir(), "metrics.dmp"), log: zap.NewNop().Sugar()}
+
+	saveCounter(t, s, 1)
+	broken := saveCounter(t, s, 2)
+	require.NoError(t, os.WriteFile(broken.Path, []byte("garbage"), 0666))
+
+	assert.Equal(t, int64(1), restoredCounter(t, s, "latest"))
+
+	_, err := s.Restore(memory.NewMemStorage(), broken.ID)
+	assert.Error(t, err)
+
+	_, err = s.Restore(memory.NewMemStorage(), "19700101")
+	assert.Error(t, err)
+}
+
+func Test_SnapshotsRestoreLegacy(t *testing.T) {
+	s := &Snapshots{Path: filepath.Join(t.TempDir(), "metrics.dmp"), log: zap.NewNop().Sugar()}
+
+	snapshot, err := s.Restore(memory.NewMemStorage(), "latest")
+	require.NoError(t, err)
+	assert.Nil(t, snapshot)
+
+	require.NoError(t, os.WriteFile(s.Path, []byte(`{"c1":{"type":"counter","delta":5}}`), 0666))
+	assert.Equal(t, int64(5), restoredCounter(t, s, "latest"))
+}
+
+func Test_SnapshotsRestoreWorking(t *testing.T) {
+	s := &Snapshots{Path: filepath.Join(t.TempDir(), "metrics.dmp"), log: zap.NewNop().Sugar()}
+
+	saveCounter(t, s, 1)
+	require.NoError(t, os.WriteFile(s.Path, []byte(`{"c1":{"type":"counter","delta":5}}`), 0666))
+	assert.Equal(t, int64(5), restoredCounter(t, s, "latest"), "a newer working dump wins")
+
+	saveCounter(t, s, 2)
+	assert.Equal(t, int64(2), restoredCounter(t, s, "latest"), "a newer snapshot wins")
+
+	require.NoError(t, os.WriteFile(s.Path, []byte("garbage"), 0666))
+	assert.Equal(t, int64(2), restoredCounter(t, s, "latest"), "a broken working dump is skipped")
+}
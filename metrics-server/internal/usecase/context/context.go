@@ -2,35 +2,113 @@ package context
 
 import (
 	"fmt"
+	"metrics-server/internal/alerting"
+	"metrics-server/internal/auth"
 	"metrics-server/internal/config"
+	"metrics-server/internal/graphite"
+	"metrics-server/internal/influx"
 	"metrics-server/internal/log"
+	"metrics-server/internal/mapping"
+	"metrics-server/internal/otlp"
+	"metrics-server/internal/ratelimit"
+	"metrics-server/internal/storage"
 	"metrics-server/internal/storage/memory"
 	"metrics-server/internal/storage/postgres"
 	"metrics-server/internal/usecase"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 type AppContext struct {
-	DB  usecase.Repositories
-	Log *zap.SugaredLogger
-	Cfg *config.Config
+	DB       usecase.Repositories // of the default tenant, see Repositories.Tenant
+	Log      *zap.SugaredLogger
+	Cfg      *config.Config
+	Dumper   *storage.Dumper    // nil unless the in-memory storage is used
+	Alerts   *alerting.Engine   // nil unless alerting rules are configured
+	Keys     auth.Store         // nil unless authentication is enabled
+	Limits   *ratelimit.Limiter // nil unless rate limiting is enabled
+	Graphite *graphite.Listener // nil unless the Graphite listener is configured
+	Influx   *influx.Mapper
+	OTLP     *otlp.Receiver
 }
 
 func NewAppContext(cfg *config.Config) (*AppContext, error) {
-	var err error
 	a := AppContext{
 		Log: log.NewLogger(),
 		Cfg: cfg,
 	}
 
 	if cfg.DSN == "" {
-		a.DB = memory.NewMemStorage()
+		db := memory.NewMemStorage()
+		db.Limit = cfg.TenantLimit
+		db.MaxTenants = cfg.MaxTenants
+		a.DB = db
+		if cfg.Auth {
+			a.Keys = auth.NewFileStore(cfg.AuthKeys)
+		}
+		interval := time.Duration(cfg.StoreInterval) * time.Second
+		a.Dumper = storage.NewDumper(a.DB, storage.NewSnapshots(cfg, a.Log), a.Log, interval)
+		a.Dumper.SnapshotEvery = cfg.SnapshotEvery
 	} else {
-		a.DB, err = postgres.NewPsqlStorage(cfg.DSN)
+		db, err := postgres.NewPsqlStorage(cfg.DSN)
 		if err != nil {
 			return nil, fmt.Errorf("cannot initialize new app context: %v", err)
 		}
+		db.Limit = cfg.TenantLimit
+		db.MaxTenants = cfg.MaxTenants
+		a.DB = db
+		if cfg.Auth {
+			a.Keys, err = auth.NewPsqlStore(db.DB)
+			if err != nil {
+				return nil, fmt.Errorf("cannot initialize new app context: %v", err)
+			}
+		}
+	}
+
+	if cfg.RateLimit > 0 {
+		a.Limits = ratelimit.New(cfg.RateLimit, cfg.RateBurst)
+	}
+
+	if cfg.GraphiteAddr != "" {
+		var rules []mapping.Rule
+		if cfg.GraphiteRules != "" {
+			var err error
+			if rules, err = mapping.LoadRules(cfg.GraphiteRules); err != nil {
+				return nil, fmt.Errorf("cannot initialize Graphite listener: %v", err)
+			}
+			for i, r := range rules {
+				if r.Cumulative {
+					return nil, fmt.Errorf("cannot initialize Graphite listener: rule %d: cumulative rules are taken by the line protocol only", i+1)
+				}
+			}
+		}
+		a.Graphite = graphite.NewListener(a.DB, rules, a.Log)
+		a.Graphite.LoopbackOnly = cfg.Auth
+		if cfg.StoreInterval == 0 && a.Dumper != nil {
+			a.Graphite.OnWrite = func() error {
+				return a.Dumper.Sync(usecase.DefaultTenant)
+			}
+		}
+	}
+
+	a.Influx = &influx.Mapper{Tags: cfg.InfluxTags}
+	if cfg.InfluxRules != "" {
+		var err error
+		if a.Influx.Rules, err = mapping.LoadRules(cfg.InfluxRules); err != nil {
+			return nil, fmt.Errorf("cannot initialize line protocol mapping: %v", err)
+		}
+	}
+
+	a.OTLP = otlp.NewReceiver(cfg.OTLPAttributes)
+
+	if cfg.AlertRules != "" {
+		rules, err := alerting.LoadRules(cfg.AlertRules)
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialize alerting: %v", err)
+		}
+		notifier := alerting.NewNotifier(cfg.AlertWebhooks, a.Log)
+		a.Alerts = alerting.NewEngine(a.DB, rules, notifier, a.Log, cfg.AlertInterval)
 	}
 
 	return &a, nil
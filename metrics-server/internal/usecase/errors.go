@@ -0,0 +1,14 @@
+package usecase
+
+import "errors"
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrTypeMismatch    = errors.New("value type changing is not enabled")
+	ErrUnsupportedType = errors.New("unsupported value kind")
+	ErrNoValue         = errors.New("value is nil")
+	ErrLimitExceeded   = errors.New("metric limit of the tenant is exceeded")
+	ErrTooManyTenants  = errors.New("tenant limit is exceeded")
+	// ErrAborted marks valid items of an atomic batch which has failed items.
+	ErrAborted = errors.New("not applied, batch aborted")
+)
@@ -1,5 +1,14 @@
 package usecase
 
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
 type Metric struct {
 	ID    string   `json:"id"`              // имя метрики
 	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
@@ -7,11 +16,205 @@ type Metric struct {
 	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
 }
 
+// NewGauge returns a gauge set to value.
+func NewGauge(id string, value float64) Metric {
+	return Metric{ID: id, MType: "gauge", Value: &value}
+}
+
+// NewCounter returns a counter adding delta.
+func NewCounter(id string, delta int64) Metric {
+	return Metric{ID: id, MType: "counter", Delta: &delta}
+}
+
 type Repositories interface {
 	Set(metric *Metric) (*Metric, error)
+	// SetBatch applies metrics in order. An atomic batch is applied only if
+	// all items succeed. The error is returned for storage failures only.
+	SetBatch(metrics []Metric, atomic bool) ([]BatchItem, error)
+	// Update applies the metric like Set, but only to a stored metric of
+	// the same type: ErrNotFound otherwise.
+	Update(metric *Metric) (*Metric, error)
+	// Replace stores the metric as given, a counter is not added to. The
+	// flag tells whether the metric is new.
+	Replace(metric *Metric) (*Metric, bool, error)
+	// Delete removes the metric, ErrNotFound if it has another type.
+	Delete(metric *Metric) error
 	Get(metric *Metric) (*Metric, error)
 	GetAll() (*[]Metric, error)
-	Dump(filepath string) error
-	Restore(filepath string) error
+	// List calls fn for every metric of the page in order and returns the
+	// cursor of the next page, nil for the last one.
+	List(query *ListQuery, fn func(m *Metric) error) (*Cursor, error)
+	Dump(w io.Writer) error
+	Restore(r io.Reader) error
+	Aggregate(query *AggregateQuery) (*AggregateResult, error)
+	Version() uint64 // grows on every change, used to skip unchanged dumps
+	// Tenant returns the storage of the tenant, the metrics of tenants are
+	// isolated from each other. It does not create the tenant, its first
+	// write does: ErrTooManyTenants if there are too many.
+	Tenant(id string) Repositories
+	// Tenants lists the tenants which have stored anything.
+	Tenants() ([]string, error)
 	Ping() error
 }
+
+// DefaultTenant owns the metrics of requests without a tenant, the storage
+// itself is its view.
+const DefaultTenant = "default"
+
+// Aggregation operations
+const (
+	AggSum   = "sum"
+	AggAvg   = "avg"
+	AggMin   = "min"
+	AggMax   = "max"
+	AggCount = "count"
+	AggTopK  = "topk"
+)
+
+type AggregateQuery struct {
+	Op    string // one of Agg* operations
+	Match string // glob pattern for metric IDs
+	MType string // gauge, counter or empty for both
+	K     int    // result size for topk
+}
+
+type AggregateResult struct {
+	Op    string   `json:"op"`
+	Match string   `json:"match"`
+	MType string   `json:"type,omitempty"`
+	Count int64    `json:"count"`
+	Value *float64 `json:"value,omitempty"` // absent for topk and for min/max/avg of nothing
+	Top   []Metric `json:"top,omitempty"`
+}
+
+// GlobToRegexp converts a glob (*, ?, [a-z], [!a-z]) to an anchored regular
+// expression understood both by Go and PostgreSQL. A ] right after [ or [!
+// belongs to the class, a [ without a closing ] is literal. The result does
+// not compile if a class has a bad range like [z-a].
+func GlobToRegexp(glob string) string {
+	runes := []rune(glob)
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '*':
+			b.WriteString(".*")
+		case c == '?':
+			b.WriteString(".")
+		case c == '[' && classEnd(runes, i) > 0:
+			end := classEnd(runes, i)
+			b.WriteByte('[')
+			i++
+			if runes[i] == '!' {
+				b.WriteByte('^')
+				i++
+			}
+			for ; i < end; i++ {
+				if strings.ContainsRune(`\[]^`, runes[i]) {
+					b.WriteByte('\\')
+				}
+				b.WriteRune(runes[i])
+			}
+			b.WriteByte(']')
+		case c == '\\' && i+1 < len(runes):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// classEnd returns the index of the ] closing the class opened at start, -1
+// if there is none.
+func classEnd(runes []rune, start int) int {
+	i := start + 1
+	if i < len(runes) && runes[i] == '!' {
+		i++
+	}
+	// the first character is a member even if it is ]
+	for i++; i < len(runes); i++ {
+		if runes[i] == ']' {
+			return i
+		}
+	}
+	return -1
+}
+
+// Listing orders
+const (
+	SortByID    = "id"
+	SortByValue = "value"
+)
+
+type ListQuery struct {
+	Prefix string // metric ID prefix
+	MType  string // gauge, counter or empty for both
+	Sort   string // SortByID or SortByValue
+	Limit  int    // page size, 0 returns everything
+	Cursor *Cursor
+}
+
+// Cursor points to the last metric of a page, the next page starts after it.
+type Cursor struct {
+	ID    string  `json:"id"`
+	Value float64 `json:"v,omitempty"`
+}
+
+// NewCursor makes a cursor for the metric in the given sort order.
+func NewCursor(m *Metric, sort string) *Cursor {
+	c := Cursor{ID: m.ID}
+	if sort == SortByValue {
+		c.Value, _ = m.Number()
+	}
+	return &c
+}
+
+func (c *Cursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad cursor: %v", err)
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("bad cursor: %v", err)
+	}
+	return &c, nil
+}
+
+// After tells whether the metric goes after the cursor in the sort order.
+func (c *Cursor) After(m *Metric, sort string) bool {
+	if sort == SortByValue {
+		v, _ := m.Number()
+		if v != c.Value {
+			return v > c.Value
+		}
+	}
+	return m.ID > c.ID
+}
+
+// Number returns the value of a gauge or a counter as float.
+func (m *Metric) Number() (float64, bool) {
+	switch {
+	case m.Value != nil:
+		return *m.Value, true
+	case m.Delta != nil:
+		return float64(*m.Delta), true
+	}
+	return 0, false
+}
+
+// BatchItem is the outcome of one metric of a batch: the applied metric
+// or the error.
+type BatchItem struct {
+	Metric *Metric
+	Err    error
+}
@@ -0,0 +1,56 @@
+package usecase
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_GlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		match   []string
+		noMatch []string
+	}{
+		{glob: "Heap*", match: []string{"Heap", "HeapAlloc"}, noMatch: []string{"heap"}},
+		{glob: "a?c", match: []string{"abc"}, noMatch: []string{"ac"}},
+		{glob: "a[12]", match: []string{"a1", "a2"}, noMatch: []string{"a3"}},
+		{glob: "a[!12]", match: []string{"a3"}, noMatch: []string{"a1"}},
+		{glob: "a[]]b", match: []string{"a]b"}, noMatch: []string{"ab"}},
+		{glob: "a[!]]b", match: []string{"axb"}, noMatch: []string{"a]b"}},
+		{glob: "a[!]b", match: []string{"a[!]b"}, noMatch: []string{"axb"}},
+		{glob: "a[b", match: []string{"a[b"}},
+		{glob: `a[\]`, match: []string{`a\`}},
+		{glob: `a\*`, match: []string{"a*"}, noMatch: []string{"ab"}},
+		{glob: "é?", match: []string{"éa"}, noMatch: []string{"\xc3a"}},
+		{glob: "[é]", match: []string{"é"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.glob, func(t *testing.T) {
+			re, err := regexp.Compile(GlobToRegexp(tt.glob))
+			require.NoError(t, err, GlobToRegexp(tt.glob))
+			for _, s := range tt.match {
+				assert.True(t, re.MatchString(s), "%q must match", s)
+			}
+			for _, s := range tt.noMatch {
+				assert.False(t, re.MatchString(s), "%q must not match", s)
+			}
+		})
+	}
+
+	_, err := regexp.Compile(GlobToRegexp("a[z-a]"))
+	assert.Error(t, err)
+}
+
+func Test_SanitizeID(t *testing.T) {
+	for name, want := range map[string]string{
+		"servers.web1:load-avg_1": "servers.web1:load-avg_1",
+		"disk /dev/sda":           "disk__dev_sda",
+		"température":             "temp_rature",
+		"":                        "",
+	} {
+		assert.Equal(t, want, SanitizeID(name), name)
+	}
+}
@@ -0,0 +1,100 @@
+package usecase
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	MaxIDLength       = 255
+	MaxTenantIDLength = 64
+)
+
+// ValidationError tells which field of a metric is wrong.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidateKey checks the metric name and type.
+func ValidateKey(m *Metric) error {
+	if m.ID == "" {
+		return &ValidationError{Field: "id", Message: "name is not defined"}
+	}
+	if len(m.ID) > MaxIDLength {
+		return &ValidationError{Field: "id", Message: fmt.Sprintf("name is longer than %d bytes", MaxIDLength)}
+	}
+	for _, c := range m.ID {
+		if !validIDChar(c) {
+			return &ValidationError{Field: "id", Message: fmt.Sprintf("name contains %q, allowed are letters, digits and _.:-", c)}
+		}
+	}
+	if m.MType != "gauge" && m.MType != "counter" {
+		return &ValidationError{Field: "type", Message: fmt.Sprintf("unsupported metric type %q", m.MType)}
+	}
+	return nil
+}
+
+// Validate checks a metric for update: a gauge needs a finite value, a
+// counter needs a delta, and the field of the other type must be absent.
+func Validate(m *Metric) error {
+	if err := ValidateKey(m); err != nil {
+		return err
+	}
+
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return &ValidationError{Field: "value", Message: "value is required for gauge"}
+		}
+		if math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+			return &ValidationError{Field: "value", Message: "value must be finite"}
+		}
+		if m.Delta != nil {
+			return &ValidationError{Field: "delta", Message: "delta is not allowed for gauge"}
+		}
+	case "counter":
+		if m.Delta == nil {
+			return &ValidationError{Field: "delta", Message: "delta is required for counter"}
+		}
+		if m.Value != nil {
+			return &ValidationError{Field: "value", Message: "value is not allowed for counter"}
+		}
+	}
+	return nil
+}
+
+func validIDChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == ':' || c == '-'
+}
+
+// SanitizeID replaces the characters not allowed in IDs with _, for names
+// taken from other protocols.
+func SanitizeID(name string) string {
+	return strings.Map(func(c rune) rune {
+		if validIDChar(c) {
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// ValidateTenant checks a tenant ID, it is used in file names so only
+// letters, digits, _ and - are allowed.
+func ValidateTenant(id string) error {
+	if id == "" || len(id) > MaxTenantIDLength {
+		return &ValidationError{Field: "tenant", Message: fmt.Sprintf("tenant must be 1 to %d bytes long", MaxTenantIDLength)}
+	}
+	for _, c := range id {
+		if !validIDChar(c) || c == '.' || c == ':' {
+			return &ValidationError{Field: "tenant", Message: fmt.Sprintf("tenant contains %q, allowed are letters, digits, _ and -", c)}
+		}
+	}
+	return nil
+}